@@ -2,17 +2,32 @@ package TeaDemo
 
 import (
 	"testing"
-	"os"
+	"time"
 	"github.com/iwind/TeaDemo/messages"
 	"github.com/iwind/TeaWorker/worker"
+	"github.com/iwind/TeaWorker/teatest"
 )
 
 func TestWorker_Start(t *testing.T) {
-	projectDir, _ := os.LookupEnv("GOPATH")
-	worker.
+	harness := teatest.New(t, nil)
+	harness.StartWorker(worker.
 		NewWorker().
 		Handle("GET_USER_PROFILE", messages.GetUserProfile).
-		Handle("UPDATE_USER_NAME", messages.UpdateUserName).
-		StartWithConfig(projectDir + "/src/main/worker/conf/worker.conf")
-}
+		HandleTyped("UPDATE_USER_NAME", messages.UpdateUserName), nil)
+
+	client := harness.NewClient()
+	client.Send("UPDATE_USER_NAME", map[string]interface{}{
+		"name": "Lily",
+	})
+	reply := client.ExpectMessage("UPDATE_USER_NAME", time.Second)
+	data, _ := reply.Body()["data"].(map[string]interface{})
+	if reply.Body()["code"] != float64(worker.ReplyCodeSuccess) || data["name"] != "Lily" {
+		t.Fatal("unexpected reply:", reply)
+	}
 
+	client.Send("UPDATE_USER_NAME", map[string]interface{}{})
+	reply = client.ExpectMessage("UPDATE_USER_NAME", time.Second)
+	if reply.Body()["code"] != float64(worker.ReplyCodeInvalidMessage) {
+		t.Fatal("empty name should be rejected:", reply)
+	}
+}
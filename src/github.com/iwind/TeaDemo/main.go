@@ -5,10 +5,14 @@ import (
 	"github.com/iwind/TeaDemo/messages"
 )
 
-func Start() {
-	worker.
+// 创建注册了所有消息处理函数的worker
+func NewWorker() *worker.Worker {
+	return worker.
 		NewWorker().
 		Handle("GET_USER_PROFILE", messages.GetUserProfile).
-		Handle("UPDATE_USER_NAME", messages.UpdateUserName).
-		Start()
+		HandleTyped("UPDATE_USER_NAME", messages.UpdateUserName)
+}
+
+func Start() {
+	NewWorker().Start()
 }
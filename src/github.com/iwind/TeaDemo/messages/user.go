@@ -5,10 +5,22 @@ import (
 	"github.com/iwind/TeaWorker/worker"
 )
 
-func GetUserProfile(message *message.Message, worker *worker.Worker) {
+type UpdateUserNameRequest struct {
+	Name string `json:"name" validate:"required"`
+}
 
+type UpdateUserNameResponse struct {
+	UserId int64  `json:"userId"`
+	Name   string `json:"name"`
 }
 
-func UpdateUserName(message *message.Message, worker *worker.Worker) {
+func GetUserProfile(message *message.Message, worker *worker.Worker) {
+
+}
 
-}
\ No newline at end of file
+func UpdateUserName(request *UpdateUserNameRequest, message *message.Message, worker *worker.Worker) (*UpdateUserNameResponse, error) {
+	return &UpdateUserNameResponse{
+		UserId: message.FromUserId,
+		Name:   request.Name,
+	}, nil
+}
@@ -0,0 +1,307 @@
+package logs
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 日志级别
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+// 输出格式
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+)
+
+// 常用的字段名
+const (
+	KeyConnectionId = "connectionId"
+	KeyUserId       = "userId"
+	KeyQueue        = "queue"
+	KeyWorkerId     = "workerId"
+	KeyMessageId    = "messageId"
+	KeyError        = "error"
+	KeyBody         = "body" // 消息内容，默认不输出
+)
+
+var levelNames = map[Level]string{
+	LevelDebug: "debug",
+	LevelInfo:  "info",
+	LevelWarn:  "warn",
+	LevelError: "error",
+}
+
+func (level Level) String() string {
+	name, found := levelNames[level]
+	if !found {
+		return "level(" + strconv.Itoa(int(level)) + ")"
+	}
+	return name
+}
+
+// 解析日志级别，为空时返回LevelInfo
+func ParseLevel(name string) (Level, error) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if len(name) == 0 {
+		return LevelInfo, nil
+	}
+	if name == "warning" {
+		return LevelWarn, nil
+	}
+	for level, levelName := range levelNames {
+		if levelName == name {
+			return level, nil
+		}
+	}
+	return LevelInfo, errors.New("invalid log level '" + name + "', should be one of debug, info, warn, error")
+}
+
+// 日志设置
+type Config struct {
+	Level  string `yaml:"level"`  // 日志级别：debug, info, warn, error，默认为info
+	Format string `yaml:"format"` // 输出格式：text, json，默认为text
+	Bodies bool   `yaml:"bodies"` // 是否输出消息内容，默认不输出，以免泄露用户数据
+}
+
+// 带级别和字段的日志
+// keyValues为 key1, value1, key2, value2, ... 的形式，key为字符串
+type Logger interface {
+	Debug(message string, keyValues ...interface{})
+	Info(message string, keyValues ...interface{})
+	Warn(message string, keyValues ...interface{})
+	Error(message string, keyValues ...interface{})
+
+	// 生成带有固定字段的日志
+	With(keyValues ...interface{}) Logger
+
+	// 判断某个级别的日志是否会输出
+	Enabled(level Level) bool
+}
+
+// 多个Logger共享的输出
+type output struct {
+	writer io.Writer
+	level  Level
+	format string
+	bodies bool
+
+	mutex *sync.Mutex
+}
+
+type logger struct {
+	output *output
+	fields []interface{}
+}
+
+// 创建日志
+func New(writer io.Writer, config Config) (Logger, error) {
+	level, err := ParseLevel(config.Level)
+	if err != nil {
+		return nil, err
+	}
+
+	format := strings.ToLower(config.Format)
+	if len(format) == 0 {
+		format = FormatText
+	}
+	if format != FormatText && format != FormatJSON {
+		return nil, errors.New("invalid log format '" + config.Format + "', should be one of text, json")
+	}
+
+	return &logger{
+		output: &output{
+			writer: writer,
+			level:  level,
+			format: format,
+			bodies: config.Bodies,
+			mutex:  &sync.Mutex{},
+		},
+	}, nil
+}
+
+func (l *logger) Debug(message string, keyValues ...interface{}) {
+	l.log(LevelDebug, message, keyValues)
+}
+
+func (l *logger) Info(message string, keyValues ...interface{}) {
+	l.log(LevelInfo, message, keyValues)
+}
+
+func (l *logger) Warn(message string, keyValues ...interface{}) {
+	l.log(LevelWarn, message, keyValues)
+}
+
+func (l *logger) Error(message string, keyValues ...interface{}) {
+	l.log(LevelError, message, keyValues)
+}
+
+func (l *logger) With(keyValues ...interface{}) Logger {
+	fields := make([]interface{}, 0, len(l.fields)+len(keyValues))
+	fields = append(fields, l.fields...)
+	fields = append(fields, keyValues...)
+	return &logger{
+		output: l.output,
+		fields: fields,
+	}
+}
+
+func (l *logger) Enabled(level Level) bool {
+	return level >= l.output.level
+}
+
+func (l *logger) log(level Level, message string, keyValues []interface{}) {
+	if !l.Enabled(level) {
+		return
+	}
+
+	fields := l.fields
+	if len(keyValues) > 0 {
+		fields = append(append([]interface{}{}, l.fields...), keyValues...)
+	}
+	if len(fields)%2 == 1 {
+		fields = append(fields, nil)
+	}
+
+	var line []byte
+	now := time.Now()
+	if l.output.format == FormatJSON {
+		line = l.formatJSON(now, level, message, fields)
+	} else {
+		line = l.formatText(now, level, message, fields)
+	}
+
+	l.output.mutex.Lock()
+	l.output.writer.Write(line)
+	l.output.mutex.Unlock()
+}
+
+func (l *logger) formatText(now time.Time, level Level, message string, fields []interface{}) []byte {
+	builder := &strings.Builder{}
+	builder.WriteString(now.Format("2006-01-02T15:04:05.000Z07:00"))
+	builder.WriteString(" " + strings.ToUpper(level.String()) + " ")
+	builder.WriteString(message)
+	for i := 0; i < len(fields); i += 2 {
+		key := fmt.Sprint(fields[i])
+		builder.WriteString(" " + key + "=" + quoteText(fmt.Sprint(l.value(key, fields[i+1]))))
+	}
+	builder.WriteString("\n")
+	return []byte(builder.String())
+}
+
+func (l *logger) formatJSON(now time.Time, level Level, message string, fields []interface{}) []byte {
+	entry := map[string]interface{}{
+		"time":  now.Format("2006-01-02T15:04:05.000Z07:00"),
+		"level": level.String(),
+		"msg":   message,
+	}
+	for i := 0; i < len(fields); i += 2 {
+		key := fmt.Sprint(fields[i])
+		if key == "time" || key == "level" || key == "msg" {
+			key = "field." + key
+		}
+		entry[key] = l.value(key, fields[i+1])
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		data, _ = json.Marshal(map[string]interface{}{
+			"time":  entry["time"],
+			"level": entry["level"],
+			"msg":   message,
+			"error": "can not encode log fields: " + err.Error(),
+		})
+	}
+	return append(data, '\n')
+}
+
+// 处理字段值，错误转换为字符串，消息内容在没有开启时隐藏
+func (l *logger) value(key string, value interface{}) interface{} {
+	if key == KeyBody && !l.output.bodies {
+		switch body := value.(type) {
+		case string:
+			return "[redacted " + strconv.Itoa(len(body)) + " bytes]"
+		case []byte:
+			return "[redacted " + strconv.Itoa(len(body)) + " bytes]"
+		}
+		return "[redacted]"
+	}
+
+	switch v := value.(type) {
+	case error:
+		return v.Error()
+	case []byte:
+		return string(v)
+	case time.Duration:
+		return v.String()
+	}
+	return value
+}
+
+// 含有空格、引号、等号的值或空值加上引号
+func quoteText(value string) string {
+	if len(value) == 0 || strings.ContainsAny(value, " \t\r\n\"=") {
+		return strconv.Quote(value)
+	}
+	return value
+}
+
+var defaultLogger Logger
+var defaultMutex = &sync.RWMutex{}
+
+func init() {
+	defaultLogger, _ = New(os.Stderr, Config{})
+}
+
+// 默认的日志，MQ和worker都使用此日志
+func Default() Logger {
+	defaultMutex.RLock()
+	defer defaultMutex.RUnlock()
+	return defaultLogger
+}
+
+// 替换默认的日志
+func SetDefault(logger Logger) {
+	defaultMutex.Lock()
+	defer defaultMutex.Unlock()
+	defaultLogger = logger
+}
+
+// 使用配置重新生成默认的日志，输出到标准错误
+func Configure(config Config) error {
+	logger, err := New(os.Stderr, config)
+	if err != nil {
+		return err
+	}
+	SetDefault(logger)
+	return nil
+}
+
+func Debug(message string, keyValues ...interface{}) {
+	Default().Debug(message, keyValues...)
+}
+
+func Info(message string, keyValues ...interface{}) {
+	Default().Info(message, keyValues...)
+}
+
+func Warn(message string, keyValues ...interface{}) {
+	Default().Warn(message, keyValues...)
+}
+
+func Error(message string, keyValues ...interface{}) {
+	Default().Error(message, keyValues...)
+}
@@ -0,0 +1,67 @@
+package logs
+
+import (
+	"testing"
+	"bytes"
+	"strings"
+	"encoding/json"
+	"errors"
+)
+
+func TestParseLevel(t *testing.T) {
+	for name, level := range map[string]Level{
+		"":        LevelInfo,
+		"debug":   LevelDebug,
+		"INFO":    LevelInfo,
+		"warning": LevelWarn,
+		"error":   LevelError,
+	} {
+		parsedLevel, err := ParseLevel(name)
+		if err != nil || parsedLevel != level {
+			t.Fatalf("level '%s' should be parsed as %s", name, level)
+		}
+	}
+
+	_, err := ParseLevel("verbose")
+	if err == nil {
+		t.Fatal("invalid level should be rejected")
+	}
+}
+
+func TestLogger_Text(t *testing.T) {
+	buffer := &bytes.Buffer{}
+	logger, err := New(buffer, Config{Level: "info"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	logger.Debug("hidden")
+	logger.With(KeyConnectionId, 1).Info("receive message", KeyQueue, "user.1", KeyBody, `{"password":"secret"}`, KeyError, errors.New("a b"))
+
+	line := buffer.String()
+	if strings.Contains(line, "hidden") || strings.Contains(line, "secret") {
+		t.Fatal("debug logs and bodies should not be written:", line)
+	}
+	if !strings.Contains(line, ` INFO receive message connectionId=1 queue=user.1 body="[redacted 21 bytes]" error="a b"`+"\n") {
+		t.Fatal("unexpected line:", line)
+	}
+}
+
+func TestLogger_JSON(t *testing.T) {
+	buffer := &bytes.Buffer{}
+	logger, err := New(buffer, Config{Level: "debug", Format: "json", Bodies: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	logger.Debug("receive message", KeyUserId, 5, KeyBody, "hello")
+
+	entry := map[string]interface{}{}
+	err = json.Unmarshal(buffer.Bytes(), &entry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry["level"] != "debug" || entry["msg"] != "receive message" || entry["userId"] != float64(5) || entry["body"] != "hello" {
+		t.Fatal("unexpected entry:", entry)
+	}
+}
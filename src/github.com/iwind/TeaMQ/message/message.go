@@ -6,20 +6,36 @@ import (
 	"time"
 	"fmt"
 	"math/rand"
+	"github.com/iwind/TeaMQ/utils/time"
+	"strings"
 )
 
+// 内置队列的前缀，只有MQ和worker之间的内置消息可以使用
+const BuiltinQueuePrefix = "$tea."
+
+// 默认队列名称的最大长度
+const DefaultMaxQueueLength = 128
+
 type Message struct {
 	id         string
 	isSent     bool
 	isReceived bool
 
-	fromUserId int64
+	fromUserId       int64
+	fromConnectionId int   // 发送消息的连接ID，转发给worker时使用
+	toConnectionId   int   // worker回复消息时指定的目标连接ID
+	toUserId         int64 // worker发送给某个用户的所有连接时指定的用户ID
+
 	Queue      string
+	Service    string // 目标服务，只转发给带有此标签的worker
 	Pattern    string
 	Body       map[string]interface{}
 	CreatedAt  float64
+	DeliverAt  float64 // 投递时间，unix时间戳，单位为秒
+	Delay      float64 // 延迟投递的时间，单位为秒
+	TTL        float64 // 有效期，单位为秒，从投递时间开始计算，为0时使用队列的设置
 	sentAt     float64
-	receivedAt float64
+	receivedAt float64 // 第一个MQ接收到消息的时间，转发和恢复时保持不变，用来计算有效期
 }
 
 func Unmarshal(data []byte) (*Message, error) {
@@ -53,6 +69,22 @@ func Unmarshal(data []byte) (*Message, error) {
 		}
 	}
 
+	// 回复的目标连接ID
+	toConnectionId, found := messageMap["toConnectionId"]
+	if found {
+		if toConnectionIdFloat64, ok := toConnectionId.(float64); ok {
+			message.toConnectionId = int(toConnectionIdFloat64)
+		}
+	}
+
+	// 目标用户ID
+	toUserId, found := messageMap["toUserId"]
+	if found {
+		if toUserIdFloat64, ok := toUserId.(float64); ok {
+			message.toUserId = int64(toUserIdFloat64)
+		}
+	}
+
 	// Queue
 	queue, found := messageMap["queue"]
 	if !found {
@@ -65,6 +97,16 @@ func Unmarshal(data []byte) (*Message, error) {
 	}
 	message.Queue = queueString
 
+	// Service
+	service, found := messageMap["service"]
+	if found {
+		serviceString, ok := service.(string)
+		if !ok {
+			return nil, errors.New("message service should be a string")
+		}
+		message.Service = serviceString
+	}
+
 	// Body
 	body, found := messageMap["body"]
 	if found {
@@ -83,13 +125,139 @@ func Unmarshal(data []byte) (*Message, error) {
 		}
 	}
 
+	// 接收时间，优先使用之前的MQ记录的接收时间，其次是创建时间，都只接受早于当前的时间，以免延长有效期
+	now := timeutil.UnixFloat(time.Now())
+	message.receivedAt = now
+	receivedAt, _ := messageMap["receivedAt"].(float64)
+	if receivedAt > 0 && receivedAt < now {
+		message.receivedAt = receivedAt
+	} else if message.CreatedAt > 0 && message.CreatedAt < now {
+		message.receivedAt = message.CreatedAt
+	}
+
+	// DeliverAt，支持时间戳和时间字符串
+	deliverAt, found := messageMap["deliverAt"]
+	if found {
+		if deliverAtFloat, ok := deliverAt.(float64); ok {
+			message.DeliverAt = deliverAtFloat
+		} else if deliverAtString, ok := deliverAt.(string); ok {
+			deliverAtTime, err := timeutil.Parse(deliverAtString)
+			if err != nil {
+				return nil, errors.New("message deliverAt is invalid: " + err.Error())
+			}
+			message.DeliverAt = timeutil.UnixFloat(deliverAtTime)
+		} else {
+			return nil, errors.New("message deliverAt should be a timestamp or a time string")
+		}
+	}
+
+	// Delay，支持秒数和时间长度字符串
+	delay, found := messageMap["delay"]
+	if found {
+		if delayFloat, ok := delay.(float64); ok {
+			message.Delay = delayFloat
+		} else if delayString, ok := delay.(string); ok {
+			delayDuration, err := timeutil.ParseDuration(delayString)
+			if err != nil {
+				return nil, errors.New("message delay is invalid: " + err.Error())
+			}
+			message.Delay = delayDuration.Seconds()
+		} else {
+			return nil, errors.New("message delay should be seconds or a duration string")
+		}
+		if message.Delay < 0 {
+			return nil, errors.New("message delay should not be negative")
+		}
+	}
+
+	// TTL，支持秒数和时间长度字符串
+	ttl, found := messageMap["ttl"]
+	if found {
+		if ttlFloat, ok := ttl.(float64); ok {
+			message.TTL = ttlFloat
+		} else if ttlString, ok := ttl.(string); ok {
+			ttlDuration, err := timeutil.ParseDuration(ttlString)
+			if err != nil {
+				return nil, errors.New("message ttl is invalid: " + err.Error())
+			}
+			message.TTL = ttlDuration.Seconds()
+		} else {
+			return nil, errors.New("message ttl should be seconds or a duration string")
+		}
+		if message.TTL < 0 {
+			return nil, errors.New("message ttl should not be negative")
+		}
+	}
+
 	return message, nil
 }
 
+func (message *Message) Id() string {
+	return message.id
+}
+
+func (message *Message) SetId(id string) {
+	message.id = id
+}
+
 func (message *Message) FromUserId() int64 {
 	return message.fromUserId
 }
 
+func (message *Message) SetFromUserId(userId int64) {
+	message.fromUserId = userId
+}
+
+func (message *Message) FromConnectionId() int {
+	return message.fromConnectionId
+}
+
+func (message *Message) SetFromConnectionId(connectionId int) {
+	message.fromConnectionId = connectionId
+}
+
+func (message *Message) ToConnectionId() int {
+	return message.toConnectionId
+}
+
+func (message *Message) ToUserId() int64 {
+	return message.toUserId
+}
+
+// 清除目标连接和用户，客户端发送的消息不能指定目标，只有worker可以
+func (message *Message) ClearTarget() {
+	message.toConnectionId = 0
+	message.toUserId = 0
+}
+
+// 判断是否需要延迟投递
+func (message *Message) IsScheduled() bool {
+	return message.DeliverAt > 0 || message.Delay > 0
+}
+
+// 根据接收时间计算投递时间
+func (message *Message) DeliveryTime(receivedAt time.Time) time.Time {
+	if message.DeliverAt > 0 {
+		return timeutil.FromUnixFloat(message.DeliverAt)
+	}
+	return receivedAt.Add(time.Duration(message.Delay * float64(time.Second)))
+}
+
+// 计算过期时间，从第一次接收的时间和投递时间中较晚的一个开始计算，ttl <= 0 时返回零值表示不过期
+func (message *Message) ExpiresAt(ttl float64) time.Time {
+	if ttl <= 0 {
+		return time.Time{}
+	}
+	start := message.receivedAt
+	if message.DeliverAt > start {
+		start = message.DeliverAt
+	}
+	if start <= 0 {
+		start = timeutil.UnixFloat(time.Now())
+	}
+	return timeutil.FromUnixFloat(start).Add(time.Duration(ttl * float64(time.Second)))
+}
+
 func (message *Message) Encode() ([]byte, error) {
 	uniqueId := fmt.Sprintf("%d%d", time.Now().Nanosecond(), rand.NewSource(time.Now().UnixNano()).Int63())
 	if len(uniqueId) > 32 {
@@ -106,6 +274,27 @@ func (message *Message) Encode() ([]byte, error) {
 			"sentAt":   float64(time.Now().UnixNano()) / 1000000000,
 		},
 	}
+	if len(message.Service) > 0 {
+		messageJSON["service"] = message.Service
+	}
+	if message.DeliverAt > 0 {
+		messageJSON["deliverAt"] = message.DeliverAt
+	}
+	if message.TTL > 0 {
+		messageJSON["ttl"] = message.TTL
+	}
+	if message.receivedAt > 0 {
+		messageJSON["receivedAt"] = message.receivedAt
+	}
+	if message.fromUserId > 0 {
+		messageJSON["fromUserId"] = message.fromUserId
+	}
+	if message.fromConnectionId > 0 {
+		messageJSON["fromConnectionId"] = message.fromConnectionId
+	}
+	if message.toUserId > 0 {
+		messageJSON["toUserId"] = message.toUserId
+	}
 	data, err := json.Marshal(messageJSON)
 	if err == nil {
 		data = append(data, []byte("\n")...)
@@ -113,6 +302,69 @@ func (message *Message) Encode() ([]byte, error) {
 	return data, err
 }
 
+// 检查队列名称，只能包含字母、数字和"_-.:"，"$"只能出现在内置队列的前缀中
+func ValidateQueue(queue string, maxLength int) error {
+	if len(queue) == 0 {
+		return errors.New("queue should not be empty")
+	}
+	if maxLength <= 0 {
+		maxLength = DefaultMaxQueueLength
+	}
+	if len(queue) > maxLength {
+		return fmt.Errorf("queue should not be longer than %d", maxLength)
+	}
+
+	name := queue
+	if strings.HasPrefix(name, BuiltinQueuePrefix) {
+		name = name[len(BuiltinQueuePrefix):]
+		if len(name) == 0 {
+			return errors.New("queue '" + queue + "' is incomplete")
+		}
+	}
+	for _, c := range name {
+		if (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') || c == '_' || c == '-' || c == '.' || c == ':' {
+			continue
+		}
+		return fmt.Errorf("queue '%s' contains invalid character '%c'", queue, c)
+	}
+	return nil
+}
+
+// 计算消息体的嵌套深度和键的总数，消息体本身的深度为1
+func (message *Message) BodyStats() (depth int, keys int) {
+	if message.Body == nil {
+		return 0, 0
+	}
+	return valueStats(message.Body)
+}
+
+func valueStats(value interface{}) (depth int, keys int) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		maxDepth := 0
+		keys = len(v)
+		for _, item := range v {
+			itemDepth, itemKeys := valueStats(item)
+			if itemDepth > maxDepth {
+				maxDepth = itemDepth
+			}
+			keys += itemKeys
+		}
+		return maxDepth + 1, keys
+	case []interface{}:
+		maxDepth := 0
+		for _, item := range v {
+			itemDepth, itemKeys := valueStats(item)
+			if itemDepth > maxDepth {
+				maxDepth = itemDepth
+			}
+			keys += itemKeys
+		}
+		return maxDepth + 1, keys
+	}
+	return 0, 0
+}
+
 func (message *Message) ValueForKey(key string) interface{} {
 	if message.Body != nil {
 		value, found := message.Body[key]
@@ -159,3 +411,25 @@ func (message *Message) MapForKey(key string) (map[string]interface{}, bool) {
 
 	return mapValue, true
 }
+
+func (message *Message) StringsForKey(key string) ([]string, bool) {
+	value := message.ValueForKey(key)
+	if value == nil {
+		return nil, false
+	}
+
+	sliceValue, ok := value.([]interface{})
+	if !ok {
+		return nil, false
+	}
+
+	strings := []string{}
+	for _, item := range sliceValue {
+		stringValue, ok := item.(string)
+		if !ok {
+			return nil, false
+		}
+		strings = append(strings, stringValue)
+	}
+	return strings, true
+}
@@ -6,6 +6,7 @@ import (
 	"log"
 	"time"
 	"encoding/json"
+	"fmt"
 )
 
 func TestMessage_Yaml(t *testing.T) {
@@ -70,4 +71,116 @@ func TestUnmarshal(t *testing.T) {
 		t.Logf("%#v\n", message)
 		t.Logf("%f", message.CreatedAt)
 	}
-}
\ No newline at end of file
+}
+func TestMessage_ExpiresAt(t *testing.T) {
+	message, err := Unmarshal([]byte(`{"queue":"user.login","ttl":"30s","deliverAt":4000000000}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if message.TTL != 30 {
+		t.Fatal("ttl should be 30 seconds")
+	}
+	if message.ExpiresAt(message.TTL).Unix() != 4000000030 {
+		t.Fatal("message should expire 30 seconds after delivery")
+	}
+	if !message.ExpiresAt(0).IsZero() {
+		t.Fatal("message without ttl should not expire")
+	}
+
+	_, err = Unmarshal([]byte(`{"queue":"user.login","ttl":-1}`))
+	if err == nil {
+		t.Fatal("negative ttl should be rejected")
+	}
+}
+
+func TestMessage_ExpiresAt_Forwarded(t *testing.T) {
+	now := time.Now()
+	receivedAt := float64(now.Add(-time.Minute).Unix())
+	message, err := Unmarshal([]byte(fmt.Sprintf(`{"queue":"user.login","ttl":30,"receivedAt":%f}`, receivedAt)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !message.ExpiresAt(message.TTL).Before(now) {
+		t.Fatal("ttl should start from the first receive time")
+	}
+
+	// 转发后仍然使用第一次接收的时间
+	data, err := message.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	forwarded, err := Unmarshal(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !forwarded.ExpiresAt(forwarded.TTL).Equal(message.ExpiresAt(message.TTL)) {
+		t.Fatal("forwarded message should keep the expiration")
+	}
+
+	// 没有接收时间时使用创建时间
+	message, err = Unmarshal([]byte(fmt.Sprintf(`{"queue":"user.login","ttl":30,"createdAt":%f}`, receivedAt)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !message.ExpiresAt(message.TTL).Before(now) {
+		t.Fatal("ttl should start from createdAt")
+	}
+
+	// 晚于当前的时间不能延长有效期
+	message, err = Unmarshal([]byte(fmt.Sprintf(`{"queue":"user.login","ttl":30,"receivedAt":%f}`, float64(now.Add(time.Hour).Unix()))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if message.ExpiresAt(message.TTL).After(time.Now().Add(30 * time.Second)) {
+		t.Fatal("receive time in the future should be ignored")
+	}
+}
+
+func TestValidateQueue(t *testing.T) {
+	for _, queue := range []string{"user.login", "GET_USER_PROFILE", "user:1", "$tea.worker.register"} {
+		if err := ValidateQueue(queue, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, queue := range []string{"", "user login", "user/1", "$user", "$tea.", "user.$tea"} {
+		if err := ValidateQueue(queue, 0); err == nil {
+			t.Fatal("queue '" + queue + "' should be invalid")
+		}
+	}
+	if err := ValidateQueue("user.login", 5); err == nil {
+		t.Fatal("queue longer than max length should be invalid")
+	}
+}
+
+func TestMessage_BodyStats(t *testing.T) {
+	message, err := Unmarshal([]byte(`{"queue":"user.login","body":{"a":1,"b":{"c":[{"d":1,"e":2}]}}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	depth, keys := message.BodyStats()
+	if depth != 4 || keys != 5 {
+		t.Fatalf("expected depth 4 and 5 keys, got %d and %d", depth, keys)
+	}
+}
+
+func TestUnmarshalResponse(t *testing.T) {
+	request := &Message{Queue: "$tea.subscribe.queue"}
+	request.SetId("abc")
+	data, err := NewResponse(request, ResponseCodeSuccess, "ok", map[string]interface{}{"queues": []string{"user.1"}}).Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	response, err := UnmarshalResponse(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !response.IsSuccess() || response.Id != "abc" || response.Queue != "$tea.subscribe.queue" || response.Data == nil {
+		t.Fatal("wrong response:", response)
+	}
+
+	_, err = UnmarshalResponse([]byte(`{"queue":"user.1","body":{}}`))
+	if err == nil {
+		t.Fatal("message without code should not be a response")
+	}
+}
@@ -0,0 +1,70 @@
+package message
+
+import (
+	"encoding/json"
+	"errors"
+)
+
+// 成功时的响应代码
+const ResponseCodeSuccess = 200
+
+// MQ对请求的响应，通过id和queue与请求对应，MQ和worker都使用此格式解析
+// 响应中一定包含code字段，普通消息中没有此字段
+type Response struct {
+	Id      string      `json:"id,omitempty"`    // 请求的消息ID
+	Queue   string      `json:"queue,omitempty"` // 请求的queue
+	Code    int         `json:"code"`            // 成功时为200，其他为错误代码
+	Message string      `json:"message"`         // 提示信息
+	Data    interface{} `json:"data"`            // 数据，可以为nil
+}
+
+// 生成对请求的响应，request为nil时不回显请求
+func NewResponse(request *Message, code int, message string, data interface{}) *Response {
+	response := &Response{
+		Code:    code,
+		Message: message,
+		Data:    data,
+	}
+	if request != nil {
+		response.Id = request.id
+		response.Queue = request.Queue
+	}
+	return response
+}
+
+// 从数据中解析响应，数据不是响应时返回错误
+func UnmarshalResponse(data []byte) (*Response, error) {
+	responseJSON := &struct {
+		Id      string      `json:"id"`
+		Queue   string      `json:"queue"`
+		Code    *int        `json:"code"`
+		Message string      `json:"message"`
+		Data    interface{} `json:"data"`
+	}{}
+	err := json.Unmarshal(data, responseJSON)
+	if err != nil {
+		return nil, err
+	}
+	if responseJSON.Code == nil {
+		return nil, errors.New("response should contains 'code' field")
+	}
+	return &Response{
+		Id:      responseJSON.Id,
+		Queue:   responseJSON.Queue,
+		Code:    *responseJSON.Code,
+		Message: responseJSON.Message,
+		Data:    responseJSON.Data,
+	}, nil
+}
+
+func (response *Response) IsSuccess() bool {
+	return response.Code == ResponseCodeSuccess
+}
+
+func (response *Response) Encode() ([]byte, error) {
+	data, err := json.Marshal(response)
+	if err == nil {
+		data = append(data, []byte("\n")...)
+	}
+	return data, err
+}
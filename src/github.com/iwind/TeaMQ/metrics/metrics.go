@@ -0,0 +1,351 @@
+package metrics
+
+import (
+	"bufio"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// 每个带标签的指标最多的标签组合数，超出后计入 "other"，防止客户端控制的标签值无限增长
+const maxLabelValues = 1000
+
+// 标签值超出上限时使用的值
+const OtherLabelValue = "other"
+
+// 指标注册表，按Prometheus文本格式输出所有指标
+type Registry struct {
+	collectors []collector
+
+	mutex *sync.Mutex
+}
+
+type collector interface {
+	write(writer *bufio.Writer)
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		mutex: &sync.Mutex{},
+	}
+}
+
+func (registry *Registry) register(c collector) {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+
+	registry.collectors = append(registry.collectors, c)
+}
+
+// 注册计数器
+func (registry *Registry) Counter(name string, help string) *Counter {
+	counter := &Counter{
+		desc:  desc{name: name, help: help, kind: "counter"},
+		mutex: &sync.Mutex{},
+	}
+	registry.register(counter)
+	return counter
+}
+
+// 注册带标签的计数器
+func (registry *Registry) CounterVec(name string, help string, labelNames ...string) *CounterVec {
+	vec := &CounterVec{
+		desc:       desc{name: name, help: help, kind: "counter"},
+		labelNames: labelNames,
+		counters:   map[string]*Counter{},
+		mutex:      &sync.Mutex{},
+	}
+	registry.register(vec)
+	return vec
+}
+
+// 注册仪表
+func (registry *Registry) Gauge(name string, help string) *Gauge {
+	gauge := &Gauge{
+		desc:  desc{name: name, help: help, kind: "gauge"},
+		mutex: &sync.Mutex{},
+	}
+	registry.register(gauge)
+	return gauge
+}
+
+// 注册在输出时才取值的仪表
+func (registry *Registry) GaugeFunc(name string, help string, valueFunc func() float64) {
+	registry.register(&gaugeFunc{
+		desc:      desc{name: name, help: help, kind: "gauge"},
+		valueFunc: valueFunc,
+	})
+}
+
+// 注册直方图，buckets为各个区间的上限，需从小到大排列
+func (registry *Registry) Histogram(name string, help string, buckets []float64) *Histogram {
+	histogram := &Histogram{
+		desc:    desc{name: name, help: help, kind: "histogram"},
+		buckets: buckets,
+		counts:  make([]uint64, len(buckets)),
+		mutex:   &sync.Mutex{},
+	}
+	registry.register(histogram)
+	return histogram
+}
+
+// 按Prometheus文本格式输出所有指标
+func (registry *Registry) WriteText(writer io.Writer) error {
+	registry.mutex.Lock()
+	collectors := append([]collector{}, registry.collectors...)
+	registry.mutex.Unlock()
+
+	bufferedWriter := bufio.NewWriter(writer)
+	for _, c := range collectors {
+		c.write(bufferedWriter)
+	}
+	return bufferedWriter.Flush()
+}
+
+// 输出指标的HTTP处理器
+func (registry *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		writer.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		registry.WriteText(writer)
+	})
+}
+
+// 指标的名称、说明和类型
+type desc struct {
+	name string
+	help string
+	kind string
+}
+
+func (d desc) writeHeader(writer *bufio.Writer) {
+	writer.WriteString("# HELP " + d.name + " " + escapeHelp(d.help) + "\n")
+	writer.WriteString("# TYPE " + d.name + " " + d.kind + "\n")
+}
+
+// 计数器，只增不减
+type Counter struct {
+	desc
+	value float64
+
+	mutex *sync.Mutex
+}
+
+func (counter *Counter) Inc() {
+	counter.Add(1)
+}
+
+// 增加计数，delta不能为负数
+func (counter *Counter) Add(delta float64) {
+	if delta < 0 {
+		return
+	}
+	counter.mutex.Lock()
+	counter.value += delta
+	counter.mutex.Unlock()
+}
+
+func (counter *Counter) Value() float64 {
+	counter.mutex.Lock()
+	defer counter.mutex.Unlock()
+	return counter.value
+}
+
+func (counter *Counter) write(writer *bufio.Writer) {
+	counter.writeHeader(writer)
+	writeSample(writer, counter.name, "", counter.Value())
+}
+
+// 带标签的计数器
+type CounterVec struct {
+	desc
+	labelNames []string
+	counters   map[string]*Counter // { Labels: Counter, ... }
+
+	mutex *sync.Mutex
+}
+
+// 取得标签值对应的计数器，values需和标签名一一对应
+func (vec *CounterVec) With(values ...string) *Counter {
+	labels := formatLabels(vec.labelNames, values)
+
+	vec.mutex.Lock()
+	defer vec.mutex.Unlock()
+
+	counter, found := vec.counters[labels]
+	if !found {
+		if len(vec.counters) >= maxLabelValues {
+			otherValues := make([]string, len(values))
+			for index := range otherValues {
+				otherValues[index] = OtherLabelValue
+			}
+			labels = formatLabels(vec.labelNames, otherValues)
+			if counter, found := vec.counters[labels]; found {
+				return counter
+			}
+		}
+		counter = &Counter{
+			mutex: &sync.Mutex{},
+		}
+		vec.counters[labels] = counter
+	}
+	return counter
+}
+
+func (vec *CounterVec) write(writer *bufio.Writer) {
+	vec.mutex.Lock()
+	labelsList := []string{}
+	for labels := range vec.counters {
+		labelsList = append(labelsList, labels)
+	}
+	sort.Strings(labelsList)
+	counters := map[string]*Counter{}
+	for labels, counter := range vec.counters {
+		counters[labels] = counter
+	}
+	vec.mutex.Unlock()
+
+	vec.writeHeader(writer)
+	for _, labels := range labelsList {
+		writeSample(writer, vec.name, labels, counters[labels].Value())
+	}
+}
+
+// 仪表，可增可减
+type Gauge struct {
+	desc
+	value float64
+
+	mutex *sync.Mutex
+}
+
+func (gauge *Gauge) Set(value float64) {
+	gauge.mutex.Lock()
+	gauge.value = value
+	gauge.mutex.Unlock()
+}
+
+func (gauge *Gauge) Add(delta float64) {
+	gauge.mutex.Lock()
+	gauge.value += delta
+	gauge.mutex.Unlock()
+}
+
+func (gauge *Gauge) Inc() {
+	gauge.Add(1)
+}
+
+func (gauge *Gauge) Dec() {
+	gauge.Add(-1)
+}
+
+func (gauge *Gauge) Value() float64 {
+	gauge.mutex.Lock()
+	defer gauge.mutex.Unlock()
+	return gauge.value
+}
+
+func (gauge *Gauge) write(writer *bufio.Writer) {
+	gauge.writeHeader(writer)
+	writeSample(writer, gauge.name, "", gauge.Value())
+}
+
+type gaugeFunc struct {
+	desc
+	valueFunc func() float64
+}
+
+func (gauge *gaugeFunc) write(writer *bufio.Writer) {
+	gauge.writeHeader(writer)
+	writeSample(writer, gauge.name, "", gauge.valueFunc())
+}
+
+// 直方图
+type Histogram struct {
+	desc
+	buckets []float64
+	counts  []uint64 // 每个区间内（不累计）的数量
+	count   uint64
+	sum     float64
+
+	mutex *sync.Mutex
+}
+
+func (histogram *Histogram) Observe(value float64) {
+	histogram.mutex.Lock()
+	defer histogram.mutex.Unlock()
+
+	for index, bucket := range histogram.buckets {
+		if value <= bucket {
+			histogram.counts[index] ++
+			break
+		}
+	}
+	histogram.count ++
+	histogram.sum += value
+}
+
+func (histogram *Histogram) write(writer *bufio.Writer) {
+	histogram.mutex.Lock()
+	counts := append([]uint64{}, histogram.counts...)
+	count := histogram.count
+	sum := histogram.sum
+	histogram.mutex.Unlock()
+
+	histogram.writeHeader(writer)
+	cumulative := uint64(0)
+	for index, bucket := range histogram.buckets {
+		cumulative += counts[index]
+		writeSample(writer, histogram.name+"_bucket", formatLabels([]string{"le"}, []string{formatFloat(bucket)}), float64(cumulative))
+	}
+	writeSample(writer, histogram.name+"_bucket", formatLabels([]string{"le"}, []string{"+Inf"}), float64(count))
+	writeSample(writer, histogram.name+"_sum", "", sum)
+	writeSample(writer, histogram.name+"_count", "", float64(count))
+}
+
+func writeSample(writer *bufio.Writer, name string, labels string, value float64) {
+	writer.WriteString(name)
+	if len(labels) > 0 {
+		writer.WriteString("{" + labels + "}")
+	}
+	writer.WriteString(" " + formatFloat(value) + "\n")
+}
+
+// 生成 name1="value1",name2="value2" 格式的标签
+func formatLabels(names []string, values []string) string {
+	pairs := []string{}
+	for index, name := range names {
+		value := ""
+		if index < len(values) {
+			value = values[index]
+		}
+		pairs = append(pairs, name+"=\""+escapeLabelValue(value)+"\"")
+	}
+	return strings.Join(pairs, ",")
+}
+
+func formatFloat(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	case math.IsNaN(value):
+		return "NaN"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+var labelValueReplacer = strings.NewReplacer("\\", "\\\\", "\"", "\\\"", "\n", "\\n")
+var helpReplacer = strings.NewReplacer("\\", "\\\\", "\n", "\\n")
+
+func escapeLabelValue(value string) string {
+	return labelValueReplacer.Replace(value)
+}
+
+func escapeHelp(help string) string {
+	return helpReplacer.Replace(help)
+}
@@ -0,0 +1,79 @@
+package metrics
+
+import (
+	"testing"
+	"bytes"
+	"strings"
+	"strconv"
+)
+
+func TestRegistry_WriteText(t *testing.T) {
+	registry := NewRegistry()
+	counter := registry.Counter("test_total", "A counter.")
+	counter.Inc()
+	counter.Add(2)
+	counter.Add(-1)
+
+	vec := registry.CounterVec("test_messages_total", "A counter with labels.", "prefix")
+	vec.With("user").Inc()
+	vec.With("a\"b").Add(3)
+
+	gauge := registry.Gauge("test_open", "A gauge.")
+	gauge.Inc()
+	gauge.Inc()
+	gauge.Dec()
+
+	registry.GaugeFunc("test_func", "A gauge func.", func() float64 {
+		return 1.5
+	})
+
+	histogram := registry.Histogram("test_seconds", "A histogram.", []float64{0.1, 1})
+	histogram.Observe(0.05)
+	histogram.Observe(0.5)
+	histogram.Observe(5)
+
+	buffer := &bytes.Buffer{}
+	err := registry.WriteText(buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `# HELP test_total A counter.
+# TYPE test_total counter
+test_total 3
+# HELP test_messages_total A counter with labels.
+# TYPE test_messages_total counter
+test_messages_total{prefix="a\"b"} 3
+test_messages_total{prefix="user"} 1
+# HELP test_open A gauge.
+# TYPE test_open gauge
+test_open 1
+# HELP test_func A gauge func.
+# TYPE test_func gauge
+test_func 1.5
+# HELP test_seconds A histogram.
+# TYPE test_seconds histogram
+test_seconds_bucket{le="0.1"} 1
+test_seconds_bucket{le="1"} 2
+test_seconds_bucket{le="+Inf"} 3
+test_seconds_sum 5.55
+test_seconds_count 3
+`
+	if buffer.String() != expected {
+		t.Fatal("unexpected output:\n" + buffer.String())
+	}
+}
+
+func TestCounterVec_MaxLabelValues(t *testing.T) {
+	registry := NewRegistry()
+	vec := registry.CounterVec("test_total", "A counter with labels.", "queue")
+	for i := 0; i < maxLabelValues+10; i ++ {
+		vec.With(strconv.Itoa(i)).Inc()
+	}
+
+	buffer := &bytes.Buffer{}
+	registry.WriteText(buffer)
+	if !strings.Contains(buffer.String(), `test_total{queue="other"} 10`) {
+		t.Fatal("label values over the limit should be counted as 'other'")
+	}
+}
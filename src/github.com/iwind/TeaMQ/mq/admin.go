@@ -0,0 +1,284 @@
+package mq
+
+import (
+	"github.com/iwind/TeaMQ/message"
+	"github.com/iwind/TeaMQ/worker"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"github.com/iwind/TeaMQ/logs"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 管理API的请求体最大字节数
+const maxAdminRequestSize = 1024 * 1024
+
+// 开始监听管理API
+func (mq *MQ) listenAdmin(bind string, token string) error {
+	if len(token) == 0 {
+		return errors.New("'admin.token' must be set to enable the admin API")
+	}
+
+	listener, err := net.Listen("tcp", bind)
+	if err != nil {
+		return err
+	}
+	mq.adminListener = listener
+
+	server := &http.Server{
+		Handler:     mq.adminHandler(token),
+		ReadTimeout: 30 * time.Second,
+	}
+	mq.adminServer = server
+	go func() {
+		err := server.Serve(listener)
+		if err != nil && err != http.ErrServerClosed {
+			logs.Error("serve admin API failed", logs.KeyError, err)
+		}
+	}()
+
+	logs.Info("admin API listen", "addr", listener.Addr().String())
+	return nil
+}
+
+// 管理API，所有请求都需要在 Authorization: Bearer <token> 中提供令牌
+//
+// GET  /connections          所有连接
+// GET  /workers              所有worker
+// GET  /subscriptions        { Queue: [ ConnectionId, ... ], ... }
+// GET  /users                { UserId: [ ConnectionId, ... ], ... }
+// POST /connections/kick?id= 断开连接
+// POST /workers/evict?id=    移除worker并断开它的连接，id为worker ID
+// POST /broadcast            发送消息，请求体和worker发送的消息格式相同
+// GET  /metrics              Prometheus文本格式的指标
+func (mq *MQ) adminHandler(token string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/connections", mq.adminMethod(http.MethodGet, mq.handleAdminConnections))
+	mux.HandleFunc("/workers", mq.adminMethod(http.MethodGet, mq.handleAdminWorkers))
+	mux.HandleFunc("/subscriptions", mq.adminMethod(http.MethodGet, mq.handleAdminSubscriptions))
+	mux.HandleFunc("/users", mq.adminMethod(http.MethodGet, mq.handleAdminUsers))
+	mux.HandleFunc("/connections/kick", mq.adminMethod(http.MethodPost, mq.handleAdminKick))
+	mux.HandleFunc("/workers/evict", mq.adminMethod(http.MethodPost, mq.handleAdminEvict))
+	mux.HandleFunc("/broadcast", mq.adminMethod(http.MethodPost, mq.handleAdminBroadcast))
+	mux.Handle("/metrics", mq.metrics.registry.Handler())
+
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		requestToken := strings.TrimPrefix(request.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(requestToken), []byte(token)) != 1 {
+			writeAdminResponse(writer, http.StatusUnauthorized, ErrorCodeAuthFailed, "Invalid admin token", nil)
+			return
+		}
+		mux.ServeHTTP(writer, request)
+	})
+}
+
+// 限制请求方法
+func (mq *MQ) adminMethod(method string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		if request.Method != method {
+			writeAdminResponse(writer, http.StatusMethodNotAllowed, ErrorCodeInvalidMessage, "Method must be "+method, nil)
+			return
+		}
+		handler(writer, request)
+	}
+}
+
+// 列出所有连接
+func (mq *MQ) handleAdminConnections(writer http.ResponseWriter, request *http.Request) {
+	mq.mutex.Lock()
+	connectionIds := []int{}
+	for connectionId := range mq.connections {
+		connectionIds = append(connectionIds, connectionId)
+	}
+	sort.Ints(connectionIds)
+
+	connections := []map[string]interface{}{}
+	for _, connectionId := range connectionIds {
+		connection := mq.connections[connectionId]
+		queues := connection.Queues()
+		sort.Strings(queues)
+		connections = append(connections, map[string]interface{}{
+			"id":          connectionId,
+			"userId":      connection.UserId(),
+			"queues":      queues,
+			"isWorker":    connection.IsWorker(),
+			"isRemote":    connection.IsRemote(),
+			"remoteAddr":  connection.RemoteAddr(),
+			"bytesIn":     connection.BytesIn(),
+			"bytesOut":    connection.BytesOut(),
+			"outbound":    connection.OutboundLen(),
+			"connectedAt": connection.ConnectedAt(),
+		})
+	}
+	mq.mutex.Unlock()
+
+	writeAdminResponse(writer, http.StatusOK, message.ResponseCodeSuccess, "ok", connections)
+}
+
+// 列出所有worker，不返回其密钥
+func (mq *MQ) handleAdminWorkers(writer http.ResponseWriter, request *http.Request) {
+	mq.mutex.Lock()
+	connectionIds := []int{}
+	for connectionId := range mq.workers {
+		connectionIds = append(connectionIds, connectionId)
+	}
+	sort.Ints(connectionIds)
+
+	workers := []map[string]interface{}{}
+	for _, connectionId := range connectionIds {
+		workerObject := *mq.workers[connectionId]
+		workerObject.Key = ""
+		workerObject.States = append([]worker.State{}, workerObject.States...)
+		workers = append(workers, map[string]interface{}{
+			"connectionId": connectionId,
+			"worker":       workerObject,
+		})
+	}
+	mq.mutex.Unlock()
+
+	writeAdminResponse(writer, http.StatusOK, message.ResponseCodeSuccess, "ok", workers)
+}
+
+// 列出订阅表
+func (mq *MQ) handleAdminSubscriptions(writer http.ResponseWriter, request *http.Request) {
+	mq.mutex.Lock()
+	subscriptions := map[string][]int{}
+	for queue, connectionIds := range mq.subscriberQueues {
+		if len(connectionIds) > 0 {
+			subscriptions[queue] = sortedConnectionIds(connectionIds)
+		}
+	}
+	mq.mutex.Unlock()
+
+	writeAdminResponse(writer, http.StatusOK, message.ResponseCodeSuccess, "ok", subscriptions)
+}
+
+// 列出用户的连接
+func (mq *MQ) handleAdminUsers(writer http.ResponseWriter, request *http.Request) {
+	mq.mutex.Lock()
+	users := map[string][]int{}
+	for userId, connectionIds := range mq.users {
+		users[strconv.FormatInt(userId, 10)] = sortedConnectionIds(connectionIds)
+	}
+	mq.mutex.Unlock()
+
+	writeAdminResponse(writer, http.StatusOK, message.ResponseCodeSuccess, "ok", users)
+}
+
+// 断开连接
+func (mq *MQ) handleAdminKick(writer http.ResponseWriter, request *http.Request) {
+	connectionId, err := strconv.Atoi(request.URL.Query().Get("id"))
+	if err != nil {
+		writeAdminResponse(writer, http.StatusBadRequest, ErrorCodeInvalidMessage, "'id' should be a connection id", nil)
+		return
+	}
+
+	mq.mutex.Lock()
+	connection, found := mq.connections[connectionId]
+	mq.mutex.Unlock()
+	if !found {
+		writeAdminResponse(writer, http.StatusNotFound, ErrorCodeNotFound, "Connection "+strconv.Itoa(connectionId)+" is not found", nil)
+		return
+	}
+
+	logs.Info("kick connection", logs.KeyConnectionId, connectionId)
+	if connection.IsRemote() {
+		mq.removeRemoteConnection(connection.remoteNode, connection.remoteConnectionId)
+	} else {
+		connection.Close()
+	}
+	writeAdminResponse(writer, http.StatusOK, message.ResponseCodeSuccess, "ok", nil)
+}
+
+// 移除worker，并断开它的连接
+func (mq *MQ) handleAdminEvict(writer http.ResponseWriter, request *http.Request) {
+	workerId := request.URL.Query().Get("id")
+	if len(workerId) == 0 {
+		writeAdminResponse(writer, http.StatusBadRequest, ErrorCodeInvalidMessage, "'id' should be a worker id", nil)
+		return
+	}
+
+	mq.mutex.Lock()
+	connections := []*Connection{}
+	for connectionId, workerObject := range mq.workers {
+		if workerObject.Id != workerId {
+			continue
+		}
+		if connection, found := mq.connections[connectionId]; found {
+			connections = append(connections, connection)
+		}
+	}
+	mq.mutex.Unlock()
+	if len(connections) == 0 {
+		writeAdminResponse(writer, http.StatusNotFound, ErrorCodeNotFound, "Worker '"+workerId+"' is not found", nil)
+		return
+	}
+
+	logs.Info("evict worker", logs.KeyWorkerId, workerId)
+	for _, connection := range connections {
+		connection.Close()
+	}
+	writeAdminResponse(writer, http.StatusOK, message.ResponseCodeSuccess, "ok", nil)
+}
+
+// 发送消息，和worker发送的消息一样投递
+func (mq *MQ) handleAdminBroadcast(writer http.ResponseWriter, request *http.Request) {
+	data, err := ioutil.ReadAll(http.MaxBytesReader(writer, request.Body, maxAdminRequestSize))
+	if err != nil {
+		writeAdminResponse(writer, http.StatusBadRequest, ErrorCodeInvalidMessage, err.Error(), nil)
+		return
+	}
+
+	messageObject, err := message.Unmarshal(data)
+	if err != nil {
+		writeAdminResponse(writer, http.StatusBadRequest, ErrorCodeInvalidMessage, err.Error(), nil)
+		return
+	}
+	if strings.HasPrefix(messageObject.Queue, message.BuiltinQueuePrefix) {
+		writeAdminResponse(writer, http.StatusBadRequest, ErrorCodeReservedQueue, "Can not broadcast to builtin queue '"+messageObject.Queue+"'", nil)
+		return
+	}
+	err = mq.validateIngress(messageObject)
+	if err != nil {
+		writeAdminResponse(writer, http.StatusBadRequest, ErrorCode(err), err.Error(), nil)
+		return
+	}
+
+	logs.Info("broadcast message", logs.KeyQueue, messageObject.Queue)
+	messageObject.Pattern = messageObject.Queue
+	mq.route(messageObject, true)
+	writeAdminResponse(writer, http.StatusOK, message.ResponseCodeSuccess, "ok", nil)
+}
+
+// 输出JSON响应，格式和连接上的响应相同
+func writeAdminResponse(writer http.ResponseWriter, status int, code int, responseMessage string, data interface{}) {
+	responseBytes, err := json.Marshal(map[string]interface{}{
+		"code":    code,
+		"message": responseMessage,
+		"data":    data,
+	})
+	if err != nil {
+		logs.Error("encode admin response failed", logs.KeyError, err)
+		http.Error(writer, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writer.Header().Set("Content-Type", "application/json; charset=utf-8")
+	writer.WriteHeader(status)
+	writer.Write(responseBytes)
+}
+
+func sortedConnectionIds(connectionIds map[int]int) []int {
+	result := []int{}
+	for connectionId := range connectionIds {
+		result = append(result, connectionId)
+	}
+	sort.Ints(result)
+	return result
+}
@@ -0,0 +1,91 @@
+package mq
+
+import (
+	"testing"
+	"net/http"
+	"strings"
+	"encoding/json"
+	"strconv"
+)
+
+func TestMQ_AdminAPI(t *testing.T) {
+	config := &Config{
+		Bind: "127.0.0.1",
+	}
+	config.Admin.Bind = "127.0.0.1:0"
+	config.Admin.Token = "t1"
+
+	mq := startTestMQ(t, config)
+
+	client := dialTestNode(t, mq)
+	client.send(map[string]interface{}{
+		"queue": "$tea.subscribe.queue",
+		"body": map[string]interface{}{
+			"queue": "news",
+		},
+	})
+	client.read()
+
+	baseURL := "http://" + mq.adminListener.Addr().String()
+	call := func(method string, path string, token string, body string) (int, map[string]interface{}) {
+		request, err := http.NewRequest(method, baseURL+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		request.Header.Set("Authorization", "Bearer "+token)
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer response.Body.Close()
+		result := map[string]interface{}{}
+		err = json.NewDecoder(response.Body).Decode(&result)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return response.StatusCode, result
+	}
+
+	if status, _ := call(http.MethodGet, "/connections", "wrong", ""); status != http.StatusUnauthorized {
+		t.Fatal("invalid token should be rejected, status:", status)
+	}
+
+	status, result := call(http.MethodGet, "/connections", "t1", "")
+	connections, _ := result["data"].([]interface{})
+	if status != http.StatusOK || len(connections) != 1 {
+		t.Fatal("unexpected connections:", result)
+	}
+	connection := connections[0].(map[string]interface{})
+	if connection["bytesIn"].(float64) == 0 || connection["bytesOut"].(float64) == 0 || len(connection["remoteAddr"].(string)) == 0 {
+		t.Fatal("unexpected connection:", connection)
+	}
+
+	status, result = call(http.MethodGet, "/subscriptions", "t1", "")
+	if subscriptions, _ := result["data"].(map[string]interface{}); status != http.StatusOK || subscriptions["news"] == nil {
+		t.Fatal("unexpected subscriptions:", result)
+	}
+
+	status, _ = call(http.MethodPost, "/broadcast", "t1", `{"queue":"news","body":{"title":"admin"}}`)
+	if status != http.StatusOK {
+		t.Fatal("broadcast failed, status:", status)
+	}
+	if published := client.read(); published["queue"] != "news" {
+		t.Fatal("unexpected broadcast message:", published)
+	}
+
+	if status, _ = call(http.MethodPost, "/broadcast", "t1", `{"queue":"$tea.worker.register"}`); status != http.StatusBadRequest {
+		t.Fatal("broadcast to builtin queue should be rejected, status:", status)
+	}
+
+	if status, _ = call(http.MethodPost, "/workers/evict?id=w1", "t1", ""); status != http.StatusNotFound {
+		t.Fatal("evicting unknown worker should fail, status:", status)
+	}
+
+	id := int(connection["id"].(float64))
+	if status, _ = call(http.MethodPost, "/connections/kick?id="+strconv.Itoa(id), "t1", ""); status != http.StatusOK {
+		t.Fatal("kick failed, status:", status)
+	}
+	if client.scanner.Scan() {
+		t.Fatal("connection should be closed")
+	}
+}
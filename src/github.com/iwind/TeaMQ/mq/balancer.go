@@ -0,0 +1,118 @@
+package mq
+
+import (
+	"github.com/iwind/TeaMQ/message"
+	"github.com/iwind/TeaMQ/worker"
+	"time"
+)
+
+// 为消息选择worker，返回worker所在的连接ID，没有可用的worker时返回0，调用者需持有mq.mutex
+// 选择顺序为：用户范围内的普通节点 -> 用户范围内的普通节点都不可用时，用户范围内的备用节点 -> 其他普通节点 -> 用户范围内的备用节点
+// 备用节点只处理其用户范围内的消息，匿名消息和不在任何普通节点范围内的消息优先转发到其他普通节点，同一级别中选择负载最低的
+// 只在能处理此消息类型的worker中选择，如果消息指定了目标服务，则只在带有对应标签的worker中选择
+// 严格模式下只选择用户范围内的worker，已达到每秒最大消息数的worker不参与选择
+func (mq *MQ) selectWorker(messageObject *message.Message) int {
+	return mq.selectWorkerWithRateLimits(messageObject, true)
+}
+
+func (mq *MQ) selectWorkerWithRateLimits(messageObject *message.Message, checkRateLimits bool) int {
+	userId := messageObject.FromUserId()
+	service := messageObject.Service
+	connectionIds := mq.types[messageObject.Queue]
+	now := time.Now()
+	canHandleType := func(connectionId int, workerObject *worker.Worker) bool {
+		// 没有声明消息类型的worker可以处理所有类型
+		if len(workerObject.Types) > 0 && connectionIds[connectionId] == 0 {
+			return false
+		}
+		return len(service) == 0 || workerObject.HasTag(service)
+	}
+	canHandle := func(connectionId int, workerObject *worker.Worker) bool {
+		if checkRateLimits && mq.isWorkerRateLimited(connectionId, now) {
+			return false
+		}
+		return canHandleType(connectionId, workerObject)
+	}
+	selectBackup := func() int {
+		return mq.selectLeastLoadedWorker(func(connectionId int, workerObject *worker.Worker) bool {
+			return canHandle(connectionId, workerObject) && workerObject.IsBackup && workerObject.ContainsUser(userId)
+		})
+	}
+
+	connectionId := mq.selectLeastLoadedWorker(func(connectionId int, workerObject *worker.Worker) bool {
+		return canHandle(connectionId, workerObject) && !workerObject.IsBackup && workerObject.ContainsUser(userId)
+	})
+	if connectionId > 0 {
+		return connectionId
+	}
+
+	// 用户范围内有普通节点，但都不可用时，由备用节点接替
+	strict := mq.currentConfig().Workers.Strict
+	if strict || mq.hasUserWorker(userId, canHandleType) {
+		connectionId = selectBackup()
+		if connectionId > 0 || strict {
+			return connectionId
+		}
+	}
+
+	connectionId = mq.selectLeastLoadedWorker(func(connectionId int, workerObject *worker.Worker) bool {
+		return canHandle(connectionId, workerObject) && !workerObject.IsBackup
+	})
+	if connectionId > 0 {
+		return connectionId
+	}
+
+	return selectBackup()
+}
+
+// 判断用户范围内是否有能处理消息的普通节点，不管是否可用
+func (mq *MQ) hasUserWorker(userId int64, filter func(connectionId int, workerObject *worker.Worker) bool) bool {
+	for connectionId, workerObject := range mq.workers {
+		if !workerObject.IsBackup && workerObject.ContainsUser(userId) && filter(connectionId, workerObject) {
+			return true
+		}
+	}
+	return false
+}
+
+// 在符合条件的可用worker中选择负载最低的一个
+func (mq *MQ) selectLeastLoadedWorker(filter func(connectionId int, workerObject *worker.Worker) bool) int {
+	selectedConnectionId := 0
+	for connectionId, workerObject := range mq.workers {
+		if !workerObject.IsAvailable || !filter(connectionId, workerObject) {
+			continue
+		}
+		if selectedConnectionId == 0 || workerObject.IsLessLoaded(mq.workers[selectedConnectionId]) {
+			selectedConnectionId = connectionId
+		}
+	}
+	return selectedConnectionId
+}
+
+// 将worker加入消息类型索引，调用者需持有mq.mutex
+func (mq *MQ) indexWorkerTypes(connectionId int, workerObject *worker.Worker) {
+	for _, messageType := range workerObject.Types {
+		connectionIds, found := mq.types[messageType]
+		if !found {
+			connectionIds = map[int]int{}
+			mq.types[messageType] = connectionIds
+			mq.metrics.setWorkerQueue(messageType, true)
+		}
+		connectionIds[connectionId] = 1
+	}
+}
+
+// 从消息类型索引中删除worker，调用者需持有mq.mutex
+func (mq *MQ) unindexWorkerTypes(connectionId int, workerObject *worker.Worker) {
+	for _, messageType := range workerObject.Types {
+		connectionIds, found := mq.types[messageType]
+		if !found {
+			continue
+		}
+		delete(connectionIds, connectionId)
+		if len(connectionIds) == 0 {
+			delete(mq.types, messageType)
+			mq.metrics.setWorkerQueue(messageType, false)
+		}
+	}
+}
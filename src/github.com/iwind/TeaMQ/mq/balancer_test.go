@@ -0,0 +1,182 @@
+package mq
+
+import (
+	"testing"
+	"github.com/iwind/TeaMQ/worker"
+	"github.com/iwind/TeaMQ/message"
+)
+
+func newTestWorker(min int64, max int64) *worker.Worker {
+	workerObject := worker.NewWorker()
+	workerObject.User.Min = min
+	workerObject.User.Max = max
+	workerObject.IsOnline = true
+	workerObject.IsAvailable = true
+	return workerObject
+}
+
+func TestMQ_SelectWorker(t *testing.T) {
+	mq := NewMQ()
+	mq.workers[1] = newTestWorker(1, 100)
+	mq.workers[2] = newTestWorker(101, 200)
+	backup := newTestWorker(1, 200)
+	backup.IsBackup = true
+	mq.workers[3] = backup
+
+	messageObject := &message.Message{Queue: "GET_USER_PROFILE"}
+	messageObject.SetFromUserId(50)
+	if id := mq.selectWorker(messageObject); id != 1 {
+		t.Fatalf("expected worker 1, got %d", id)
+	}
+
+	// 下线中的worker的范围由备用节点接管
+	mq.workers[1].IsDraining = true
+	mq.workers[1].IsAvailable = false
+	if id := mq.selectWorker(messageObject); id != 3 {
+		t.Fatalf("expected backup worker 3, got %d", id)
+	}
+
+	// 没有备用节点时转发到其他worker
+	delete(mq.workers, 3)
+	if id := mq.selectWorker(messageObject); id != 2 {
+		t.Fatalf("expected worker 2, got %d", id)
+	}
+
+	delete(mq.workers, 2)
+	if id := mq.selectWorker(messageObject); id != 0 {
+		t.Fatalf("expected no worker, got %d", id)
+	}
+}
+
+func TestMQ_SelectWorker_Service(t *testing.T) {
+	mq := NewMQ()
+	profile := newTestWorker(1, 100)
+	profile.Tags = []string{"profile"}
+	mq.workers[1] = profile
+	payment := newTestWorker(101, 200)
+	payment.Tags = []string{"payment"}
+	mq.workers[2] = payment
+
+	messageObject := &message.Message{Queue: "PAY", Service: "payment"}
+	messageObject.SetFromUserId(50)
+	if id := mq.selectWorker(messageObject); id != 2 {
+		t.Fatalf("expected payment worker 2, got %d", id)
+	}
+
+	messageObject.Service = "chat"
+	if id := mq.selectWorker(messageObject); id != 0 {
+		t.Fatalf("expected no worker for chat, got %d", id)
+	}
+}
+
+func TestMQ_SelectWorker_Type(t *testing.T) {
+	mq := NewMQ()
+	profile := newTestWorker(1, 100)
+	profile.Types = []string{"GET_USER_PROFILE"}
+	mq.workers[1] = profile
+	mq.indexWorkerTypes(1, profile)
+
+	messageObject := &message.Message{Queue: "GET_USER_PROFILE"}
+	messageObject.SetFromUserId(50)
+	if id := mq.selectWorker(messageObject); id != 1 {
+		t.Fatalf("expected worker 1, got %d", id)
+	}
+
+	messageObject.Queue = "PAY"
+	if id := mq.selectWorker(messageObject); id != 0 {
+		t.Fatalf("expected no worker for PAY, got %d", id)
+	}
+
+	// 没有声明类型的worker可以处理所有类型
+	mq.workers[2] = newTestWorker(1, 100)
+	if id := mq.selectWorker(messageObject); id != 2 {
+		t.Fatalf("expected worker 2, got %d", id)
+	}
+
+	mq.unindexWorkerTypes(1, profile)
+	if len(mq.types) != 0 {
+		t.Fatal("type index should be empty")
+	}
+}
+
+func TestMQ_SelectWorker_Strict(t *testing.T) {
+	mq := NewMQ()
+	mq.config.Workers.Strict = true
+	mq.workers[1] = newTestWorker(1, 100)
+
+	messageObject := &message.Message{Queue: "GET_USER_PROFILE"}
+	messageObject.SetFromUserId(500)
+	if id := mq.selectWorker(messageObject); id != 0 {
+		t.Fatalf("uncovered user should be rejected in strict mode, got %d", id)
+	}
+
+	mq.config.Workers.Strict = false
+	if id := mq.selectWorker(messageObject); id != 1 {
+		t.Fatalf("expected worker 1, got %d", id)
+	}
+}
+
+func TestMQ_SelectWorker_Backup(t *testing.T) {
+	mq := NewMQ()
+	mq.workers[1] = newTestWorker(1, 100)
+	mq.workers[2] = newTestWorker(101, 200)
+	backup := newTestWorker(1, 100)
+	backup.IsBackup = true
+	mq.workers[3] = backup
+
+	// 匿名消息和不在任何普通节点范围内的消息优先转发到其他普通节点
+	messageObject := &message.Message{Queue: "GET_USER_PROFILE"}
+	if id := mq.selectWorker(messageObject); id != 1 && id != 2 {
+		t.Fatalf("anonymous message should go to a normal worker, got %d", id)
+	}
+	messageObject.SetFromUserId(500)
+	if id := mq.selectWorker(messageObject); id != 1 && id != 2 {
+		t.Fatalf("uncovered user should go to a normal worker, got %d", id)
+	}
+
+	// 备用节点不处理其用户范围外的消息
+	mq.workers[2].IsAvailable = false
+	messageObject.SetFromUserId(150)
+	if id := mq.selectWorker(messageObject); id != 1 {
+		t.Fatalf("expected worker 1, got %d", id)
+	}
+
+	// 用户范围内的普通节点不可用时由备用节点接替
+	messageObject.SetFromUserId(50)
+	mq.workers[1].IsAvailable = false
+	if id := mq.selectWorker(messageObject); id != 3 {
+		t.Fatalf("expected backup worker 3, got %d", id)
+	}
+
+	// 没有其他普通节点时，备用节点也处理其范围内的用户
+	delete(mq.workers, 1)
+	if id := mq.selectWorker(messageObject); id != 3 {
+		t.Fatalf("expected backup worker 3, got %d", id)
+	}
+	messageObject.SetFromUserId(150)
+	if id := mq.selectWorker(messageObject); id != 0 {
+		t.Fatalf("backup should not handle users out of its range, got %d", id)
+	}
+}
+
+func TestMQ_DispatchToWorker_InFlight(t *testing.T) {
+	mq := NewMQ()
+	for connectionId := 1; connectionId <= 2; connectionId ++ {
+		mq.connections[connectionId] = NewConnection(nil)
+		mq.workers[connectionId] = newTestWorker(1, 100)
+		mq.workers[connectionId].AddState(worker.State{QueueDepth: 5})
+	}
+
+	// 两次心跳之间的消息分散到不同的worker
+	for i := 0; i < 4; i ++ {
+		messageObject := &message.Message{Queue: "GET_USER_PROFILE"}
+		messageObject.SetFromUserId(50)
+		mq.dispatchToWorker(messageObject)
+	}
+	if mq.workers[1].InFlight != 2 || mq.workers[2].InFlight != 2 {
+		t.Fatal("messages should be balanced between heartbeats:", mq.workers[1].InFlight, mq.workers[2].InFlight)
+	}
+	if mq.connections[1].OutboundLen() != 2 || mq.connections[2].OutboundLen() != 2 {
+		t.Fatal("messages should be written to both workers")
+	}
+}
@@ -0,0 +1,758 @@
+package mq
+
+import (
+	"github.com/iwind/TeaMQ/message"
+	"github.com/iwind/TeaMQ/nets"
+	"github.com/iwind/TeaMQ/utils/string"
+	"crypto/subtle"
+	"errors"
+	"github.com/iwind/TeaMQ/logs"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	defaultGossipInterval = 1 * time.Second // 默认同步状态的间隔
+	nodeTimeoutIntervals  = 3               // 超过多少个同步间隔没有收到状态后认为节点已离开
+	maxPeerOutboundSize   = 4096            // 发往每个节点的数据最多缓存的条数
+)
+
+// 集群中其他节点的状态，由节点定期同步过来
+type NodeState struct {
+	Id        string
+	Users     map[int64]bool  // 连接在该节点上的用户
+	Queues    map[string]bool // 该节点上有订阅者的queue
+	Types     map[string]bool // 该节点上的worker能处理的消息类型
+	AllTypes  bool            // 该节点上是否有能处理所有消息类型的worker
+	UpdatedAt time.Time
+}
+
+// 判断节点上是否有能处理某个消息类型的worker
+func (state *NodeState) CanHandle(messageType string) bool {
+	return state.AllTypes || state.Types[messageType]
+}
+
+// 到其他节点的连接，只用来发送数据，接收数据使用对方连接过来的连接
+type peerLink struct {
+	address  string
+	nodeId   string // 收到对方的hello后才有值
+	client   *nets.Client
+	outbound chan []byte
+}
+
+// 集群，节点之间通过静态配置的地址互相连接，定期同步用户、订阅和worker信息，并转发消息
+type Cluster struct {
+	mq       *MQ
+	id       string
+	key      string
+	interval time.Duration
+	server   *nets.Server
+
+	peers   map[string]*peerLink  // { Address: Link, ... }
+	nodes   map[string]*NodeState // { NodeId: State, ... }
+	inbound map[int]string        // { ClientId: NodeId, ... } 已认证的连接
+
+	remoteConnections    map[string]int          // { NodeId:ConnectionId: LocalConnectionId, ... }
+	forwardedConnections map[int]map[string]bool // { LocalConnectionId: { NodeId: true, ... }, ... }
+	nextNode             int
+
+	done      chan bool // 关闭后停止同步和重连
+	isStopped bool
+
+	mutex *sync.Mutex
+}
+
+func NewCluster(mq *MQ, config *Config) *Cluster {
+	id := config.Cluster.Id
+	if len(id) == 0 {
+		id = stringutil.Rand(16)
+	}
+	interval := time.Duration(config.Cluster.GossipInterval) * time.Millisecond
+	if interval <= 0 {
+		interval = defaultGossipInterval
+	}
+	return &Cluster{
+		mq:                   mq,
+		id:                   id,
+		key:                  config.Cluster.Key,
+		interval:             interval,
+		server:               nets.NewServer("tcp", config.Cluster.Bind),
+		peers:                map[string]*peerLink{},
+		nodes:                map[string]*NodeState{},
+		inbound:              map[int]string{},
+		remoteConnections:    map[string]int{},
+		forwardedConnections: map[int]map[string]bool{},
+		done:                 make(chan bool),
+		mutex:                &sync.Mutex{},
+	}
+}
+
+// 当前节点ID
+func (cluster *Cluster) Id() string {
+	return cluster.id
+}
+
+// 实际监听的地址
+func (cluster *Cluster) Addr() string {
+	addr := cluster.server.Addr()
+	if addr == nil {
+		return ""
+	}
+	return addr.String()
+}
+
+// 开始监听并连接其他节点
+func (cluster *Cluster) Start(peers []string) error {
+	cluster.server.SetMaxFrameSize(cluster.mq.maxFrameSize() * 2)
+	cluster.server.ReceiveClient(cluster.receive)
+	cluster.server.CloseClient(func(client *nets.Client) {
+		cluster.mutex.Lock()
+		delete(cluster.inbound, client.Id())
+		cluster.mutex.Unlock()
+	})
+	err := cluster.server.Bind()
+	if err != nil {
+		return err
+	}
+	go cluster.server.Listen()
+
+	for _, address := range peers {
+		cluster.AddPeer(address)
+	}
+
+	go cluster.gossip()
+
+	logs.Info("cluster node listen", "node", cluster.id, "addr", cluster.Addr())
+	return nil
+}
+
+// 停止监听，断开和其他节点的连接
+func (cluster *Cluster) Stop() {
+	cluster.mutex.Lock()
+	if cluster.isStopped {
+		cluster.mutex.Unlock()
+		return
+	}
+	cluster.isStopped = true
+	close(cluster.done)
+	for _, link := range cluster.peers {
+		if link.client != nil {
+			link.client.Close()
+		}
+	}
+	cluster.mutex.Unlock()
+
+	cluster.server.Close()
+	cluster.server.CloseClients()
+}
+
+// 等待一个同步间隔，返回false表示已停止
+func (cluster *Cluster) sleep() bool {
+	select {
+	case <-cluster.done:
+		return false
+	case <-time.After(cluster.interval):
+		return true
+	}
+}
+
+// 添加其他节点，断开后会自动重连
+func (cluster *Cluster) AddPeer(address string) {
+	cluster.mutex.Lock()
+	if _, found := cluster.peers[address]; found {
+		cluster.mutex.Unlock()
+		return
+	}
+	link := &peerLink{
+		address:  address,
+		outbound: make(chan []byte, maxPeerOutboundSize),
+	}
+	cluster.peers[address] = link
+	cluster.mutex.Unlock()
+
+	go cluster.connect(link)
+	go cluster.write(link)
+}
+
+// 判断是否已经有到某个节点的连接
+func (cluster *Cluster) hasPeer(nodeId string, address string) bool {
+	cluster.mutex.Lock()
+	defer cluster.mutex.Unlock()
+
+	for _, link := range cluster.peers {
+		if link.address == address || link.nodeId == nodeId {
+			return true
+		}
+	}
+	return false
+}
+
+// 取得节点公布的地址，监听所有网卡时使用连接的来源IP
+func peerAddress(advertisedAddress string, remoteAddr net.Addr) string {
+	host, port, err := net.SplitHostPort(advertisedAddress)
+	if err != nil {
+		return ""
+	}
+	ip := net.ParseIP(host)
+	if len(host) == 0 || (ip != nil && ip.IsUnspecified()) {
+		if remoteAddr == nil {
+			return ""
+		}
+		host, _, err = net.SplitHostPort(remoteAddr.String())
+		if err != nil {
+			return ""
+		}
+	}
+	return net.JoinHostPort(host, port)
+}
+
+// 取得所有节点的状态
+func (cluster *Cluster) Nodes() []*NodeState {
+	cluster.mutex.Lock()
+	defer cluster.mutex.Unlock()
+
+	nodes := []*NodeState{}
+	for _, state := range cluster.nodes {
+		nodes = append(nodes, state)
+	}
+	sort.Slice(nodes, func(i, j int) bool {
+		return nodes[i].Id < nodes[j].Id
+	})
+	return nodes
+}
+
+// 连接到其他节点，断开后重连
+func (cluster *Cluster) connect(link *peerLink) {
+	for {
+		client := &nets.Client{}
+		err := client.Connect("tcp", link.address)
+		if err != nil {
+			if !cluster.sleep() {
+				return
+			}
+			continue
+		}
+		client.SetMaxFrameSize(cluster.mq.maxFrameSize() * 2)
+
+		data, err := clusterFrame("$tea.cluster.hello", map[string]interface{}{
+			"node": cluster.id,
+			"key":  cluster.key,
+			"addr": cluster.Addr(),
+		})
+		if err == nil {
+			_, err = client.WriteBytes(data)
+		}
+		if err != nil {
+			client.Close()
+			if !cluster.sleep() {
+				return
+			}
+			continue
+		}
+
+		cluster.mutex.Lock()
+		if cluster.isStopped {
+			cluster.mutex.Unlock()
+			client.Close()
+			return
+		}
+		link.client = client
+		cluster.mutex.Unlock()
+
+		// 对方回复hello后才开始发送数据
+		client.Receive(func(data string) {
+			messageObject, err := message.Unmarshal([]byte(data))
+			if err != nil || messageObject.Queue != "$tea.cluster.hello" {
+				return
+			}
+			nodeId := messageObject.StringForKeyDefault("node", "")
+			cluster.mutex.Lock()
+			link.nodeId = nodeId
+			cluster.mutex.Unlock()
+			logs.Info("connected to cluster node", "node", nodeId, "addr", link.address)
+		})
+
+		cluster.mutex.Lock()
+		link.client = nil
+		link.nodeId = ""
+		cluster.mutex.Unlock()
+		client.Close()
+
+		logs.Warn("disconnected from cluster node", "addr", link.address)
+		if !cluster.sleep() {
+			return
+		}
+	}
+}
+
+// 将缓存的数据发送给节点，没有连接时丢弃
+func (cluster *Cluster) write(link *peerLink) {
+	for {
+		var data []byte
+		select {
+		case <-cluster.done:
+			return
+		case data = <-link.outbound:
+		}
+
+		cluster.mutex.Lock()
+		client := link.client
+		isReady := len(link.nodeId) > 0
+		cluster.mutex.Unlock()
+		if client == nil || !isReady {
+			continue
+		}
+
+		_, err := client.WriteBytes(data)
+		if err != nil {
+			logs.Error("write to cluster node failed", "addr", link.address, logs.KeyError, err)
+			client.Close()
+		}
+	}
+}
+
+// 发送数据给某个节点
+func (cluster *Cluster) send(nodeId string, queue string, body map[string]interface{}) error {
+	data, err := clusterFrame(queue, body)
+	if err != nil {
+		return err
+	}
+
+	cluster.mutex.Lock()
+	defer cluster.mutex.Unlock()
+
+	for _, link := range cluster.peers {
+		if link.nodeId != nodeId {
+			continue
+		}
+		select {
+		case link.outbound <- data:
+			return nil
+		default:
+			return errors.New("the outbound queue of cluster node '" + nodeId + "' is full")
+		}
+	}
+	return errors.New("cluster node '" + nodeId + "' is not connected")
+}
+
+// 定期向所有节点同步本节点的状态，并移除长时间没有同步状态的节点
+func (cluster *Cluster) gossip() {
+	ticker := time.NewTicker(cluster.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-cluster.done:
+			return
+		case <-ticker.C:
+		}
+
+		body := cluster.mq.clusterState()
+		body["node"] = cluster.id
+		data, err := clusterFrame("$tea.cluster.state", body)
+		if err != nil {
+			logs.Error("encode cluster state failed", logs.KeyError, err)
+			continue
+		}
+
+		expiredNodes := []string{}
+		cluster.mutex.Lock()
+		for _, link := range cluster.peers {
+			select {
+			case link.outbound <- data:
+			default:
+			}
+		}
+		deadline := time.Now().Add(-cluster.interval * nodeTimeoutIntervals)
+		for nodeId, state := range cluster.nodes {
+			if state.UpdatedAt.Before(deadline) {
+				delete(cluster.nodes, nodeId)
+				expiredNodes = append(expiredNodes, nodeId)
+			}
+		}
+		cluster.mutex.Unlock()
+
+		for _, nodeId := range expiredNodes {
+			logs.Warn("cluster node left", "node", nodeId)
+			cluster.mq.removeRemoteConnections(nodeId)
+		}
+	}
+}
+
+// 处理其他节点发来的数据
+func (cluster *Cluster) receive(client *nets.Client, data []byte) {
+	messageObject, err := message.Unmarshal(data)
+	if err != nil {
+		logs.Error("decode cluster message failed", logs.KeyError, err)
+		return
+	}
+
+	// 第一条数据必须是hello
+	if messageObject.Queue == "$tea.cluster.hello" {
+		key := messageObject.StringForKeyDefault("key", "")
+		if subtle.ConstantTimeCompare([]byte(key), []byte(cluster.key)) != 1 {
+			logs.Warn("cluster node key is invalid", "addr", client.RemoteAddr().String())
+			client.Close()
+			return
+		}
+		nodeId := messageObject.StringForKeyDefault("node", "")
+		cluster.mutex.Lock()
+		cluster.inbound[client.Id()] = nodeId
+		cluster.mutex.Unlock()
+
+		reply, err := clusterFrame("$tea.cluster.hello", map[string]interface{}{
+			"node": cluster.id,
+		})
+		if err == nil {
+			client.WriteBytes(reply)
+		}
+
+		// 发送数据只使用连接到其他节点的连接，对方不在本节点的peers中时，通过其公布的地址连接过去
+		address := peerAddress(messageObject.StringForKeyDefault("addr", ""), client.RemoteAddr())
+		if len(address) > 0 && !cluster.hasPeer(nodeId, address) {
+			logs.Info("add cluster peer from hello", "node", nodeId, "addr", address)
+			cluster.AddPeer(address)
+		}
+		return
+	}
+
+	cluster.mutex.Lock()
+	nodeId, found := cluster.inbound[client.Id()]
+	cluster.mutex.Unlock()
+	if !found {
+		client.Close()
+		return
+	}
+
+	switch messageObject.Queue {
+	case "$tea.cluster.state":
+		cluster.updateNode(nodeId, messageObject)
+	case "$tea.cluster.publish":
+		forwarded, err := forwardedMessage(messageObject)
+		if err == nil {
+			cluster.mq.publishLocal(forwarded)
+		}
+	case "$tea.cluster.user":
+		forwarded, err := forwardedMessage(messageObject)
+		if err == nil {
+			cluster.mq.mutex.Lock()
+			cluster.mq.sendToLocalUser(forwarded)
+			cluster.mq.mutex.Unlock()
+		}
+	case "$tea.cluster.dispatch":
+		forwarded, err := forwardedMessage(messageObject)
+		if err == nil {
+			connectionId, _ := messageObject.ValueForKey("connectionId").(float64)
+			userId, _ := messageObject.ValueForKey("userId").(float64)
+			cluster.mq.dispatchFromNode(nodeId, int(connectionId), int64(userId), forwarded)
+		}
+	case "$tea.cluster.deliver":
+		connectionId, _ := messageObject.ValueForKey("connectionId").(float64)
+		deliverData := messageObject.StringForKeyDefault("data", "")
+		cluster.mq.deliverFromNode(int(connectionId), []byte(deliverData))
+	case "$tea.cluster.close":
+		connectionId, _ := messageObject.ValueForKey("connectionId").(float64)
+		cluster.mq.removeRemoteConnection(nodeId, int(connectionId))
+	default:
+		logs.Warn("unknown cluster message", "node", nodeId, logs.KeyQueue, messageObject.Queue)
+	}
+}
+
+// 更新节点状态
+func (cluster *Cluster) updateNode(nodeId string, messageObject *message.Message) {
+	state := &NodeState{
+		Id:        nodeId,
+		Users:     map[int64]bool{},
+		Queues:    map[string]bool{},
+		Types:     map[string]bool{},
+		UpdatedAt: time.Now(),
+	}
+	userIds, _ := messageObject.ValueForKey("users").([]interface{})
+	for _, userId := range userIds {
+		if userIdFloat, ok := userId.(float64); ok {
+			state.Users[int64(userIdFloat)] = true
+		}
+	}
+	queues, _ := messageObject.StringsForKey("queues")
+	for _, queue := range queues {
+		state.Queues[queue] = true
+	}
+	types, _ := messageObject.StringsForKey("types")
+	for _, messageType := range types {
+		state.Types[messageType] = true
+	}
+	state.AllTypes, _ = messageObject.ValueForKey("allTypes").(bool)
+
+	cluster.mutex.Lock()
+	if _, found := cluster.nodes[nodeId]; !found {
+		logs.Info("cluster node joined", "node", nodeId)
+	}
+	cluster.nodes[nodeId] = state
+	cluster.mutex.Unlock()
+}
+
+// 转发消息给有订阅者的节点
+func (cluster *Cluster) publish(messageObject *message.Message) {
+	cluster.forward(messageObject, "$tea.cluster.publish", func(state *NodeState) bool {
+		return state.Queues[messageObject.Queue]
+	})
+}
+
+// 转发消息给目标用户连接所在的节点，返回是否有这样的节点
+func (cluster *Cluster) sendToUser(messageObject *message.Message) bool {
+	return cluster.forward(messageObject, "$tea.cluster.user", func(state *NodeState) bool {
+		return state.Users[messageObject.ToUserId()]
+	}) > 0
+}
+
+// 转发消息给有worker能处理它的节点，多个节点时轮流选择，返回是否转发成功
+func (cluster *Cluster) dispatch(messageObject *message.Message) bool {
+	cluster.mutex.Lock()
+	nodeIds := []string{}
+	for nodeId, state := range cluster.nodes {
+		if state.CanHandle(messageObject.Queue) {
+			nodeIds = append(nodeIds, nodeId)
+		}
+	}
+	if len(nodeIds) == 0 {
+		cluster.mutex.Unlock()
+		return false
+	}
+	sort.Strings(nodeIds)
+	nodeId := nodeIds[cluster.nextNode%len(nodeIds)]
+	cluster.nextNode ++
+
+	// 记录转发过的连接，连接关闭时通知对方节点
+	connectionId := messageObject.FromConnectionId()
+	if connectionId > 0 {
+		nodes, found := cluster.forwardedConnections[connectionId]
+		if !found {
+			nodes = map[string]bool{}
+			cluster.forwardedConnections[connectionId] = nodes
+		}
+		nodes[nodeId] = true
+	}
+	cluster.mutex.Unlock()
+
+	data, err := messageObject.Encode()
+	if err != nil {
+		logs.Error("encode message failed", logs.KeyQueue, messageObject.Queue, logs.KeyError, err)
+		return false
+	}
+	err = cluster.send(nodeId, "$tea.cluster.dispatch", map[string]interface{}{
+		"connectionId": connectionId,
+		"userId":       messageObject.FromUserId(),
+		"message":      string(data),
+	})
+	if err != nil {
+		logs.Error("dispatch message to cluster node failed", "node", nodeId, logs.KeyQueue, messageObject.Queue, logs.KeyError, err)
+		return false
+	}
+	return true
+}
+
+// 将数据发送给其他节点上的连接
+func (cluster *Cluster) deliver(nodeId string, connectionId int, data []byte) error {
+	return cluster.send(nodeId, "$tea.cluster.deliver", map[string]interface{}{
+		"connectionId": connectionId,
+		"data":         string(data),
+	})
+}
+
+// 本节点上的连接关闭后，通知为它创建过代理的节点
+func (cluster *Cluster) connectionClosed(connectionId int) {
+	cluster.mutex.Lock()
+	nodes := cluster.forwardedConnections[connectionId]
+	delete(cluster.forwardedConnections, connectionId)
+	cluster.mutex.Unlock()
+
+	for nodeId := range nodes {
+		cluster.send(nodeId, "$tea.cluster.close", map[string]interface{}{
+			"connectionId": connectionId,
+		})
+	}
+}
+
+// 转发消息给符合条件的节点，返回转发的节点数
+func (cluster *Cluster) forward(messageObject *message.Message, queue string, filter func(state *NodeState) bool) int {
+	cluster.mutex.Lock()
+	nodeIds := []string{}
+	for nodeId, state := range cluster.nodes {
+		if filter(state) {
+			nodeIds = append(nodeIds, nodeId)
+		}
+	}
+	cluster.mutex.Unlock()
+	if len(nodeIds) == 0 {
+		return 0
+	}
+
+	data, err := messageObject.Encode()
+	if err != nil {
+		logs.Error("encode message failed", logs.KeyQueue, messageObject.Queue, logs.KeyError, err)
+		return 0
+	}
+
+	count := 0
+	for _, nodeId := range nodeIds {
+		err := cluster.send(nodeId, queue, map[string]interface{}{
+			"message": string(data),
+		})
+		if err != nil {
+			logs.Error("forward message to cluster node failed", "node", nodeId, logs.KeyQueue, messageObject.Queue, logs.KeyError, err)
+			continue
+		}
+		count ++
+	}
+	return count
+}
+
+// 生成节点之间传输的数据
+func clusterFrame(queue string, body map[string]interface{}) ([]byte, error) {
+	messageObject := &message.Message{
+		Queue: queue,
+		Body:  body,
+	}
+	return messageObject.Encode()
+}
+
+// 解析转发的消息
+func forwardedMessage(messageObject *message.Message) (*message.Message, error) {
+	data := messageObject.StringForKeyDefault("message", "")
+	forwarded, err := message.Unmarshal([]byte(data))
+	if err != nil {
+		logs.Error("decode forwarded message failed", logs.KeyError, err)
+		return nil, err
+	}
+	forwarded.Pattern = forwarded.Queue
+	return forwarded, nil
+}
+
+func remoteConnectionKey(nodeId string, connectionId int) string {
+	return nodeId + ":" + strconv.Itoa(connectionId)
+}
+
+// 本节点的状态，用来同步给其他节点
+func (mq *MQ) clusterState() map[string]interface{} {
+	mq.mutex.Lock()
+	defer mq.mutex.Unlock()
+
+	users := []int64{}
+	for userId := range mq.users {
+		users = append(users, userId)
+	}
+
+	queues := []string{}
+	for queue, connectionIds := range mq.subscriberQueues {
+		if len(connectionIds) > 0 {
+			queues = append(queues, queue)
+		}
+	}
+
+	typeMap := map[string]bool{}
+	allTypes := false
+	for _, workerObject := range mq.workers {
+		if !workerObject.IsAvailable || workerObject.IsDraining {
+			continue
+		}
+		if len(workerObject.Types) == 0 {
+			allTypes = true
+		}
+		for _, messageType := range workerObject.Types {
+			typeMap[messageType] = true
+		}
+	}
+	types := []string{}
+	for messageType := range typeMap {
+		types = append(types, messageType)
+	}
+
+	return map[string]interface{}{
+		"users":    users,
+		"queues":   queues,
+		"types":    types,
+		"allTypes": allTypes,
+	}
+}
+
+// 处理其他节点转发过来的用户端消息，为发送者创建代理连接后转发给本节点的worker
+func (mq *MQ) dispatchFromNode(nodeId string, connectionId int, userId int64, messageObject *message.Message) {
+	mq.mutex.Lock()
+	key := remoteConnectionKey(nodeId, connectionId)
+	localConnectionId, found := mq.cluster.remoteConnections[key]
+	if !found {
+		mq.idIndex ++
+		localConnectionId = mq.idIndex
+
+		cluster := mq.cluster
+		connection := NewRemoteConnection(localConnectionId, nodeId, connectionId, userId, func(data []byte) error {
+			return cluster.deliver(nodeId, connectionId, data)
+		})
+		connection.OnExpire(mq.expireOutbound)
+		connection.OnWrite(mq.countOutbound)
+		mq.connections[localConnectionId] = connection
+		go connection.StartWriting()
+
+		cluster.mutex.Lock()
+		cluster.remoteConnections[key] = localConnectionId
+		cluster.mutex.Unlock()
+	}
+	mq.mutex.Unlock()
+
+	messageObject.SetFromConnectionId(localConnectionId)
+	messageObject.SetFromUserId(userId)
+	mq.dispatchToWorker(messageObject)
+}
+
+// 将其他节点上的worker的回复写入本节点上的连接
+func (mq *MQ) deliverFromNode(connectionId int, data []byte) {
+	mq.mutex.Lock()
+	connection, found := mq.connections[connectionId]
+	mq.mutex.Unlock()
+	if !found || connection.IsRemote() {
+		return
+	}
+	_, err := connection.Write(data)
+	if err != nil {
+		logs.Error("deliver message from cluster node failed", logs.KeyConnectionId, connectionId, logs.KeyError, err)
+	}
+}
+
+// 删除其他节点上的连接的代理
+func (mq *MQ) removeRemoteConnection(nodeId string, connectionId int) {
+	mq.mutex.Lock()
+	defer mq.mutex.Unlock()
+
+	key := remoteConnectionKey(nodeId, connectionId)
+	mq.cluster.mutex.Lock()
+	localConnectionId, found := mq.cluster.remoteConnections[key]
+	delete(mq.cluster.remoteConnections, key)
+	mq.cluster.mutex.Unlock()
+	if !found {
+		return
+	}
+
+	if connection, found := mq.connections[localConnectionId]; found {
+		delete(mq.connections, localConnectionId)
+		connection.Close()
+	}
+}
+
+// 删除某个节点上所有连接的代理
+func (mq *MQ) removeRemoteConnections(nodeId string) {
+	mq.mutex.Lock()
+	defer mq.mutex.Unlock()
+
+	for connectionId, connection := range mq.connections {
+		if connection.IsRemote() && connection.remoteNode == nodeId {
+			delete(mq.connections, connectionId)
+			connection.Close()
+
+			mq.cluster.mutex.Lock()
+			delete(mq.cluster.remoteConnections, remoteConnectionKey(nodeId, connection.remoteConnectionId))
+			mq.cluster.mutex.Unlock()
+		}
+	}
+}
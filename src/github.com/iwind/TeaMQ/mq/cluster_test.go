@@ -0,0 +1,270 @@
+package mq
+
+import (
+	"testing"
+	"net"
+	"bufio"
+	"encoding/json"
+	"time"
+	"context"
+)
+
+// 在本机启动一个集群节点
+func startTestNode(t *testing.T, id string) *MQ {
+	config := &Config{
+		Bind: "127.0.0.1",
+		Keys: []string{"k1"},
+	}
+	config.Cluster.Id = id
+	config.Cluster.Bind = "127.0.0.1:0"
+	config.Cluster.Key = "secret"
+	config.Cluster.GossipInterval = 50
+
+	mq := startTestMQ(t, config)
+	return mq
+}
+
+type testClient struct {
+	t       *testing.T
+	conn    net.Conn
+	scanner *bufio.Scanner
+}
+
+// 启动MQ，没有设置端口时自动分配，测试结束后关闭
+func startTestMQ(t *testing.T, config *Config) *MQ {
+	mq := NewMQWithConfig(config)
+	err := mq.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		mq.Shutdown(ctx)
+	})
+	return mq
+}
+
+func dialTestNode(t *testing.T, mq *MQ) *testClient {
+	conn, err := net.Dial("tcp", mq.server.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testClient{
+		t:       t,
+		conn:    conn,
+		scanner: bufio.NewScanner(conn),
+	}
+}
+
+func (client *testClient) send(frame map[string]interface{}) {
+	data, err := json.Marshal(frame)
+	if err != nil {
+		client.t.Fatal(err)
+	}
+	_, err = client.conn.Write(append(data, '\n'))
+	if err != nil {
+		client.t.Fatal(err)
+	}
+}
+
+func (client *testClient) read() map[string]interface{} {
+	client.conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	if !client.scanner.Scan() {
+		client.t.Fatal("read failed:", client.scanner.Err())
+	}
+	frame := map[string]interface{}{}
+	err := json.Unmarshal(client.scanner.Bytes(), &frame)
+	if err != nil {
+		client.t.Fatal(err)
+	}
+	return frame
+}
+
+func waitForCluster(t *testing.T, condition func() bool) {
+	deadline := time.Now().Add(3 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatal("timeout waiting for cluster state")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func findNode(mq *MQ, nodeId string) *NodeState {
+	for _, state := range mq.cluster.Nodes() {
+		if state.Id == nodeId {
+			return state
+		}
+	}
+	return nil
+}
+
+func TestCluster_Forward(t *testing.T) {
+	a := startTestNode(t, "a")
+	b := startTestNode(t, "b")
+	a.cluster.AddPeer(b.cluster.Addr())
+	b.cluster.AddPeer(a.cluster.Addr())
+
+	// worker在b上，客户端在a上
+	workerClient := dialTestNode(t, b)
+	workerClient.send(map[string]interface{}{
+		"queue": "$tea.worker.register",
+		"body": map[string]interface{}{
+			"key":   "k1",
+			"id":    "w1",
+			"types": []string{"hello"},
+			"user": map[string]interface{}{
+				"min": 1,
+				"max": 100,
+			},
+		},
+	})
+	if code := workerClient.read()["code"]; code != float64(200) {
+		t.Fatal("register failed:", code)
+	}
+
+	client := dialTestNode(t, a)
+	client.send(map[string]interface{}{
+		"queue": "$tea.subscribe.queue",
+		"body": map[string]interface{}{
+			"queue": "news",
+		},
+	})
+	if code := client.read()["code"]; code != float64(200) {
+		t.Fatal("subscribe failed:", code)
+	}
+
+	// 模拟已认证的用户
+	a.mutex.Lock()
+	for connectionId, connection := range a.connections {
+		connection.setUserId(5)
+		a.users[5] = map[int]int{connectionId: 1}
+	}
+	a.mutex.Unlock()
+
+	waitForCluster(t, func() bool {
+		nodeB := findNode(a, "b")
+		nodeA := findNode(b, "a")
+		return nodeB != nil && nodeB.CanHandle("hello") && nodeA != nil && nodeA.Queues["news"] && nodeA.Users[5]
+	})
+
+	// a上没有worker，转发给b上的worker处理，回复再转发回a
+	client.send(map[string]interface{}{
+		"queue": "hello",
+		"id":    "m1",
+		"body": map[string]interface{}{
+			"name": "Lu",
+		},
+	})
+	dispatched := workerClient.read()
+	if dispatched["queue"] != "hello" || dispatched["id"] != "m1" || dispatched["fromUserId"] != float64(5) {
+		t.Fatal("unexpected dispatched message:", dispatched)
+	}
+	workerClient.send(map[string]interface{}{
+		"queue":          "hello",
+		"toConnectionId": dispatched["fromConnectionId"],
+		"body": map[string]interface{}{
+			"greeting": "Hello, Lu",
+		},
+	})
+	reply := client.read()
+	if body, _ := reply["body"].(map[string]interface{}); body["greeting"] != "Hello, Lu" {
+		t.Fatal("unexpected reply:", reply)
+	}
+
+	// 发布到a上的订阅者
+	workerClient.send(map[string]interface{}{
+		"queue": "news",
+		"body": map[string]interface{}{
+			"title": "cluster",
+		},
+	})
+	if published := client.read(); published["queue"] != "news" {
+		t.Fatal("unexpected published message:", published)
+	}
+
+	// 发送给a上的用户
+	workerClient.send(map[string]interface{}{
+		"queue":    "notice",
+		"toUserId": 5,
+	})
+	if notice := client.read(); notice["queue"] != "notice" {
+		t.Fatal("unexpected user message:", notice)
+	}
+
+	// 客户端断开后，b上的代理连接也被删除
+	client.conn.Close()
+	waitForCluster(t, func() bool {
+		b.mutex.Lock()
+		defer b.mutex.Unlock()
+		for _, connection := range b.connections {
+			if connection.IsRemote() {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+func TestCluster_InvalidKey(t *testing.T) {
+	a := startTestNode(t, "a")
+	b := startTestNode(t, "b")
+	b.cluster.key = "other"
+	a.cluster.AddPeer(b.cluster.Addr())
+
+	time.Sleep(200 * time.Millisecond)
+	if findNode(b, "a") != nil {
+		t.Fatal("node with invalid key should not join")
+	}
+}
+
+func TestCluster_AsymmetricPeers(t *testing.T) {
+	a := startTestNode(t, "a")
+	b := startTestNode(t, "b")
+
+	// 只有a配置了b，b通过a的hello连接回a
+	a.cluster.AddPeer(b.cluster.Addr())
+
+	workerClient := dialTestNode(t, b)
+	workerClient.send(map[string]interface{}{
+		"queue": "$tea.worker.register",
+		"body": map[string]interface{}{
+			"key":   "k1",
+			"id":    "w1",
+			"types": []string{"hello"},
+			"user": map[string]interface{}{
+				"min": 1,
+				"max": 100,
+			},
+		},
+	})
+	if code := workerClient.read()["code"]; code != float64(200) {
+		t.Fatal("register failed:", code)
+	}
+
+	client := dialTestNode(t, a)
+	waitForCluster(t, func() bool {
+		nodeB := findNode(a, "b")
+		return nodeB != nil && nodeB.CanHandle("hello") && findNode(b, "a") != nil
+	})
+
+	client.send(map[string]interface{}{
+		"queue": "hello",
+		"id":    "m1",
+	})
+	dispatched := workerClient.read()
+	if dispatched["id"] != "m1" {
+		t.Fatal("unexpected dispatched message:", dispatched)
+	}
+	workerClient.send(map[string]interface{}{
+		"queue":          "hello",
+		"toConnectionId": dispatched["fromConnectionId"],
+		"body": map[string]interface{}{
+			"greeting": "Hello",
+		},
+	})
+	if reply := client.read(); reply["queue"] != "hello" {
+		t.Fatal("unexpected reply:", reply)
+	}
+}
@@ -0,0 +1,292 @@
+package mq
+
+import (
+	"fmt"
+	"github.com/go-yaml/yaml"
+	"github.com/iwind/TeaMQ/logs"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// 默认的监听地址和端口
+const (
+	DefaultBind = "127.0.0.1"
+	DefaultPort = 7777
+)
+
+// 覆盖配置的环境变量前缀，如 TEAMQ_PORT
+const EnvPrefix = "TEAMQ_"
+
+// 字段错误
+type ConfigFieldError struct {
+	Field   string
+	Message string
+}
+
+// 配置错误，包含所有不合法的字段
+type ConfigError struct {
+	Fields []*ConfigFieldError
+}
+
+func (err *ConfigError) Error() string {
+	messages := []string{}
+	for _, field := range err.Fields {
+		messages = append(messages, "'"+field.Field+"' "+field.Message)
+	}
+	return "invalid config: " + strings.Join(messages, ", ")
+}
+
+func (err *ConfigError) add(field string, message string) {
+	err.Fields = append(err.Fields, &ConfigFieldError{
+		Field:   field,
+		Message: message,
+	})
+}
+
+// 没有错误时返回nil
+func (err *ConfigError) orNil() error {
+	if len(err.Fields) == 0 {
+		return nil
+	}
+	return err
+}
+
+// 默认配置，配置文件中没有的字段使用此处的值
+func DefaultConfig() *Config {
+	return &Config{
+		Bind: DefaultBind,
+		Port: DefaultPort,
+	}
+}
+
+// 从文件中读取配置，并使用环境变量覆盖，读取后需要调用Validate()校验
+func LoadConfig(configFile string) (*Config, error) {
+	configBytes, err := ioutil.ReadFile(configFile)
+	if err != nil {
+		return nil, err
+	}
+
+	config := DefaultConfig()
+	err = yaml.Unmarshal(configBytes, config)
+	if err != nil {
+		return nil, fmt.Errorf("parse config file '%s' failed: %s", configFile, err.Error())
+	}
+
+	err = config.ApplyEnv(os.LookupEnv)
+	if err != nil {
+		return nil, err
+	}
+	err = ValidatePort(config.Port)
+	if err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// 校验配置文件、环境变量或命令行参数中的端口，端口0只用于嵌入时自动分配端口
+func ValidatePort(port int) error {
+	configErr := &ConfigError{}
+	if port <= 0 || port > 65535 {
+		configErr.add("port", fmt.Sprintf("must be between 1 and 65535, got %d", port))
+	}
+	return configErr.orNil()
+}
+
+// 使用环境变量覆盖配置，lookup通常为os.LookupEnv
+//
+// TEAMQ_BIND, TEAMQ_PORT, TEAMQ_KEYS（逗号分隔）,
+// TEAMQ_AUTH_ON, TEAMQ_AUTH_API,
+// TEAMQ_LOG_LEVEL, TEAMQ_LOG_FORMAT,
+// TEAMQ_ADMIN_BIND, TEAMQ_ADMIN_TOKEN, TEAMQ_METRICS_BIND,
+// TEAMQ_CLUSTER_ID, TEAMQ_CLUSTER_BIND, TEAMQ_CLUSTER_PEERS（逗号分隔）, TEAMQ_CLUSTER_KEY,
+// TEAMQ_SCHEDULER_STORE
+func (config *Config) ApplyEnv(lookup func(key string) (string, bool)) error {
+	configErr := &ConfigError{}
+	env := &envReader{
+		prefix: EnvPrefix,
+		lookup: lookup,
+		err:    configErr,
+	}
+
+	env.String("BIND", &config.Bind)
+	env.Int("PORT", &config.Port)
+	env.Strings("KEYS", &config.Keys)
+	env.Bool("AUTH_ON", &config.Auth.On)
+	env.String("AUTH_API", &config.Auth.API)
+	env.String("LOG_LEVEL", &config.Log.Level)
+	env.String("LOG_FORMAT", &config.Log.Format)
+	env.String("ADMIN_BIND", &config.Admin.Bind)
+	env.String("ADMIN_TOKEN", &config.Admin.Token)
+	env.String("METRICS_BIND", &config.Metrics.Bind)
+	env.String("CLUSTER_ID", &config.Cluster.Id)
+	env.String("CLUSTER_BIND", &config.Cluster.Bind)
+	env.Strings("CLUSTER_PEERS", &config.Cluster.Peers)
+	env.String("CLUSTER_KEY", &config.Cluster.Key)
+	env.String("SCHEDULER_STORE", &config.Scheduler.Store)
+
+	return configErr.orNil()
+}
+
+// 校验配置，返回的错误中包含所有不合法的字段
+func (config *Config) Validate() error {
+	configErr := &ConfigError{}
+
+	if config.Port < 0 || config.Port > 65535 {
+		configErr.add("port", fmt.Sprintf("must be between 0 and 65535, got %d", config.Port))
+	}
+
+	config.validateKeys(configErr)
+
+	if config.Auth.On {
+		if len(config.Auth.API) == 0 {
+			configErr.add("auth.api", "must be set when 'auth.on' is true")
+		} else if apiURL, err := url.Parse(config.Auth.API); err != nil || (apiURL.Scheme != "http" && apiURL.Scheme != "https") || len(apiURL.Host) == 0 {
+			configErr.add("auth.api", "must be an http or https URL, got '"+config.Auth.API+"'")
+		}
+	}
+
+	validateNotNegative(configErr, "heartbeat.interval", config.Heartbeat.Interval)
+	validateNotNegative(configErr, "heartbeat.maxMisses", config.Heartbeat.MaxMisses)
+
+	validateNotNegative(configErr, "scheduler.maxPending", config.Scheduler.MaxPending)
+	validateNotNegative(configErr, "scheduler.maxPendingPerSender", config.Scheduler.MaxPendingPerSender)
+
+	validateOneOf(configErr, "workers.overlap", config.Workers.Overlap, OverlapReject, OverlapReplica)
+	validateNotNegative(configErr, "workers.maxPending", config.Workers.MaxPending)
+	validateNotNegative(configErr, "workers.pendingTimeout", config.Workers.PendingTimeout)
+
+	validateNotNegative(configErr, "deadLetters.maxSize", config.DeadLetters.MaxSize)
+
+	validateOneOf(configErr, "ttl.action", config.TTL.Action, TTLActionDrop, TTLActionDeadLetter)
+	for pattern, seconds := range config.TTL.Queues {
+		validatePattern(configErr, "ttl.queues", pattern)
+		if seconds < 0 {
+			configErr.add("ttl.queues."+pattern, fmt.Sprintf("must not be negative, got %g", seconds))
+		}
+	}
+
+	validateOneOf(configErr, "rateLimit.action", config.RateLimit.Action, RateLimitActionReject, RateLimitActionDelay, RateLimitActionDisconnect)
+	validateNotNegative(configErr, "rateLimit.maxDelay", config.RateLimit.MaxDelay)
+	validateRateLimitRule(configErr, "rateLimit.user", config.RateLimit.User)
+	validateRateLimitRule(configErr, "rateLimit.connection", config.RateLimit.Connection)
+	for pattern, rule := range config.RateLimit.Queues {
+		validatePattern(configErr, "rateLimit.queues", pattern)
+		validateRateLimitRule(configErr, "rateLimit.queues."+pattern, rule)
+	}
+
+	validateNotNegative(configErr, "limits.maxFrameSize", config.Limits.MaxFrameSize)
+	validateNotNegative(configErr, "limits.maxBodyDepth", config.Limits.MaxBodyDepth)
+	validateNotNegative(configErr, "limits.maxBodyKeys", config.Limits.MaxBodyKeys)
+	validateNotNegative(configErr, "limits.maxQueueLength", config.Limits.MaxQueueLength)
+
+	if len(config.Cluster.Bind) > 0 && len(config.Cluster.Key) == 0 {
+		configErr.add("cluster.key", "must be set when 'cluster.bind' is set")
+	}
+	for index, peer := range config.Cluster.Peers {
+		if len(strings.TrimSpace(peer)) == 0 {
+			configErr.add(fmt.Sprintf("cluster.peers[%d]", index), "must not be empty")
+		}
+	}
+	validateNotNegative(configErr, "cluster.gossipInterval", config.Cluster.GossipInterval)
+
+	if len(config.Admin.Bind) > 0 && len(config.Admin.Token) == 0 {
+		configErr.add("admin.token", "must be set when 'admin.bind' is set")
+	}
+
+	if _, err := logs.New(ioutil.Discard, config.Log); err != nil {
+		configErr.add("log", err.Error())
+	}
+
+	return configErr.orNil()
+}
+
+func validateNotNegative(configErr *ConfigError, field string, value int) {
+	if value < 0 {
+		configErr.add(field, fmt.Sprintf("must not be negative, got %d", value))
+	}
+}
+
+// 校验可选值，为空时使用默认值
+func validateOneOf(configErr *ConfigError, field string, value string, options ...string) {
+	if len(value) == 0 {
+		return
+	}
+	for _, option := range options {
+		if value == option {
+			return
+		}
+	}
+	configErr.add(field, "should be one of "+strings.Join(options, ", ")+", got '"+value+"'")
+}
+
+func validatePattern(configErr *ConfigError, field string, pattern string) {
+	if _, err := path.Match(pattern, ""); err != nil {
+		configErr.add(field, "contains an invalid pattern '"+pattern+"'")
+	}
+}
+
+func validateRateLimitRule(configErr *ConfigError, field string, rule RateLimitRule) {
+	if rule.Rate < 0 {
+		configErr.add(field+".rate", fmt.Sprintf("must not be negative, got %g", rule.Rate))
+	}
+	validateNotNegative(configErr, field+".burst", rule.Burst)
+}
+
+// 读取环境变量，格式错误时记录到err中
+type envReader struct {
+	prefix string
+	lookup func(key string) (string, bool)
+	err    *ConfigError
+}
+
+func (env *envReader) String(name string, target *string) {
+	if value, found := env.lookup(env.prefix + name); found {
+		*target = value
+	}
+}
+
+func (env *envReader) Int(name string, target *int) {
+	value, found := env.lookup(env.prefix + name)
+	if !found {
+		return
+	}
+	intValue, err := strconv.Atoi(strings.TrimSpace(value))
+	if err != nil {
+		env.err.add(env.prefix+name, "must be an integer, got '"+value+"'")
+		return
+	}
+	*target = intValue
+}
+
+func (env *envReader) Bool(name string, target *bool) {
+	value, found := env.lookup(env.prefix + name)
+	if !found {
+		return
+	}
+	boolValue, err := strconv.ParseBool(strings.TrimSpace(value))
+	if err != nil {
+		env.err.add(env.prefix+name, "must be true or false, got '"+value+"'")
+		return
+	}
+	*target = boolValue
+}
+
+// 逗号分隔的列表，忽略空的项
+func (env *envReader) Strings(name string, target *[]string) {
+	value, found := env.lookup(env.prefix + name)
+	if !found {
+		return
+	}
+	items := []string{}
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if len(item) > 0 {
+			items = append(items, item)
+		}
+	}
+	*target = items
+}
@@ -0,0 +1,86 @@
+package mq
+
+import (
+	"testing"
+	"strings"
+)
+
+func TestConfig_Validate(t *testing.T) {
+	config := DefaultConfig()
+	config.Keys = []string{"k1"}
+	err := config.Validate()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config.Port = 70000
+	config.Keys = []string{"k1", "", "k1"}
+	config.Auth.On = true
+	config.Auth.API = "ftp://example.com/auth"
+	config.Workers.Overlap = "share"
+	config.TTL.Queues = map[string]float64{"[": 10}
+	config.RateLimit.User.Rate = -1
+	config.Cluster.Bind = "127.0.0.1:7778"
+	config.Admin.Bind = "127.0.0.1:7779"
+	config.Log.Level = "verbose"
+	err = config.Validate()
+	configErr, ok := err.(*ConfigError)
+	if !ok {
+		t.Fatal("should return *ConfigError:", err)
+	}
+
+	fields := []string{}
+	for _, field := range configErr.Fields {
+		fields = append(fields, field.Field)
+	}
+	expected := []string{"port", "keys[1]", "keys[2]", "auth.api", "workers.overlap", "ttl.queues", "rateLimit.user.rate", "cluster.key", "admin.token", "log"}
+	if strings.Join(fields, ",") != strings.Join(expected, ",") {
+		t.Fatal("unexpected fields:", fields)
+	}
+	t.Log(err)
+}
+
+func TestConfig_ApplyEnv(t *testing.T) {
+	env := map[string]string{
+		"TEAMQ_BIND":          "0.0.0.0",
+		"TEAMQ_PORT":          "8888",
+		"TEAMQ_KEYS":          "k1, k2,",
+		"TEAMQ_AUTH_ON":       "true",
+		"TEAMQ_CLUSTER_PEERS": "127.0.0.1:7778",
+	}
+	lookup := func(key string) (string, bool) {
+		value, found := env[key]
+		return value, found
+	}
+
+	config := DefaultConfig()
+	config.Keys = []string{"k0"}
+	err := config.ApplyEnv(lookup)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Bind != "0.0.0.0" || config.Port != 8888 || !config.Auth.On {
+		t.Fatal("env should override config:", config.Bind, config.Port, config.Auth.On)
+	}
+	if strings.Join(config.Keys, ",") != "k1,k2" || len(config.Cluster.Peers) != 1 {
+		t.Fatal("lists should be split by comma:", config.Keys, config.Cluster.Peers)
+	}
+
+	env["TEAMQ_PORT"] = "abc"
+	env["TEAMQ_AUTH_ON"] = "yes"
+	err = DefaultConfig().ApplyEnv(lookup)
+	configErr, ok := err.(*ConfigError)
+	if !ok || len(configErr.Fields) != 2 || configErr.Fields[0].Field != "TEAMQ_PORT" || configErr.Fields[1].Field != "TEAMQ_AUTH_ON" {
+		t.Fatal("invalid env values should be reported:", err)
+	}
+}
+
+func TestMQ_StartInvalidConfig(t *testing.T) {
+	config := DefaultConfig()
+	config.Port = -1
+	mq := NewMQWithConfig(config)
+	err := mq.Start()
+	if _, ok := err.(*ConfigError); !ok {
+		t.Fatal("invalid config should be rejected:", err)
+	}
+}
@@ -4,29 +4,257 @@ import (
 	"github.com/iwind/TeaMQ/nets"
 	"sync"
 	"strings"
-	"encoding/json"
+	"github.com/iwind/TeaMQ/logs"
+	"github.com/iwind/TeaMQ/message"
+	"time"
+	"errors"
+	"sync/atomic"
+	"strconv"
 )
 
+// 发送队列的最大长度
+const maxOutboundSize = 1024
+
 type Connection struct {
+	bytesIn  int64 // 收到的字节数，放在最前面以保证原子操作时64位对齐
+	bytesOut int64 // 发送的字节数
+
+	id       int
 	userId   int64
 	queues   map[string]int
 	client   *nets.Client
 	isWorker bool
 
+	connectedAt time.Time
+
+	// 集群中其他节点上的连接，发送的数据会转发给该节点
+	remoteNode         string
+	remoteConnectionId int
+	remoteSender       func(data []byte) error
+
+	outbound chan *outboundData // 发送队列，由单独的goroutine写入连接
+	done     chan bool
+	isClosed bool
+	onExpire func(messageObject *message.Message)
+	onWrite  func(messageObject *message.Message)
+
+	// 延迟处理的任务，由单独的goroutine按加入的顺序执行
+	delayed        chan *delayedTask
+	delayedCount   int
+	delayedStarted bool
+
 	mutex *sync.Mutex
 }
 
+// 延迟处理的任务
+type delayedTask struct {
+	runAt    time.Time
+	callback func()
+}
+
+// 等待发送的数据
+type outboundData struct {
+	data      []byte
+	message   *message.Message // 可能为nil
+	expiresAt time.Time        // 为零值时不过期
+	closes    bool             // 发送完之前的数据后关闭连接
+	flushed   chan bool        // 发送完之前的数据后关闭此通道
+}
+
 func NewConnection(client *nets.Client) *Connection {
 	var connection = &Connection{
-		queues: map[string]int{},
-		client: client,
-		mutex:  &sync.Mutex{},
+		queues:      map[string]int{},
+		client:      client,
+		outbound:    make(chan *outboundData, maxOutboundSize),
+		delayed:     make(chan *delayedTask, maxOutboundSize),
+		done:        make(chan bool),
+		connectedAt: time.Now(),
+		mutex:       &sync.Mutex{},
 	}
 	return connection
 }
 
+// 创建代表其他节点上的连接的代理，发送给它的数据通过sender转发
+func NewRemoteConnection(id int, node string, remoteConnectionId int, userId int64, sender func(data []byte) error) *Connection {
+	connection := NewConnection(nil)
+	connection.id = id
+	connection.userId = userId
+	connection.remoteNode = node
+	connection.remoteConnectionId = remoteConnectionId
+	connection.remoteSender = sender
+	return connection
+}
+
+// 是否为其他节点上的连接的代理
+func (connection *Connection) IsRemote() bool {
+	return connection.remoteSender != nil
+}
+
+// 设置消息在发送队列中过期时的回调
+func (connection *Connection) OnExpire(callback func(messageObject *message.Message)) {
+	connection.onExpire = callback
+}
+
+// 设置消息写入连接后的回调
+func (connection *Connection) OnWrite(callback func(messageObject *message.Message)) {
+	connection.onWrite = callback
+}
+
+// 开始发送队列中的数据，直到连接关闭
+func (connection *Connection) StartWriting() {
+	for {
+		select {
+		case <-connection.done:
+			return
+		case outbound := <-connection.outbound:
+			if outbound.closes {
+				connection.Close()
+				return
+			}
+			if outbound.flushed != nil {
+				close(outbound.flushed)
+				continue
+			}
+
+			// 跳过已过期的消息
+			if !outbound.expiresAt.IsZero() && time.Now().After(outbound.expiresAt) {
+				if outbound.message != nil && connection.onExpire != nil {
+					connection.onExpire(outbound.message)
+				}
+				continue
+			}
+
+			err := connection.writeBytes(outbound.data)
+			if err != nil {
+				connection.Close()
+				return
+			}
+			if outbound.message != nil && connection.onWrite != nil {
+				connection.onWrite(outbound.message)
+			}
+		}
+	}
+}
+
+// 延迟执行callback，同一连接的任务按加入的顺序依次执行，连接关闭后未执行的任务被丢弃
+func (connection *Connection) Delay(wait time.Duration, callback func()) error {
+	connection.mutex.Lock()
+	defer connection.mutex.Unlock()
+
+	if connection.isClosed {
+		return errors.New("the connection is closed")
+	}
+
+	select {
+	case connection.delayed <- &delayedTask{
+		runAt:    time.Now().Add(wait),
+		callback: callback,
+	}:
+	default:
+		return errors.New("the delayed queue of the connection is full")
+	}
+
+	connection.delayedCount ++
+	if !connection.delayedStarted {
+		connection.delayedStarted = true
+		go connection.runDelayed()
+	}
+	return nil
+}
+
+// 是否有未执行的延迟任务，有的话后续的消息也需要排在后面，以保证顺序
+func (connection *Connection) HasDelayed() bool {
+	connection.mutex.Lock()
+	defer connection.mutex.Unlock()
+	return connection.delayedCount > 0
+}
+
+// 依次执行延迟任务，直到连接关闭
+func (connection *Connection) runDelayed() {
+	for {
+		select {
+		case <-connection.done:
+			return
+		case task := <-connection.delayed:
+			wait := task.runAt.Sub(time.Now())
+			if wait > 0 {
+				timer := time.NewTimer(wait)
+				select {
+				case <-connection.done:
+					timer.Stop()
+					return
+				case <-timer.C:
+				}
+			}
+
+			task.callback()
+
+			connection.mutex.Lock()
+			connection.delayedCount --
+			connection.mutex.Unlock()
+		}
+	}
+}
+
+func (connection *Connection) writeBytes(data []byte) error {
+	var err error
+	if connection.remoteSender != nil {
+		err = connection.remoteSender(data)
+	} else {
+		_, err = connection.client.WriteBytes(data)
+	}
+	if err == nil {
+		atomic.AddInt64(&connection.bytesOut, int64(len(data)))
+	}
+	return err
+}
+
+// 记录收到的字节数
+func (connection *Connection) addBytesIn(size int) {
+	atomic.AddInt64(&connection.bytesIn, int64(size))
+}
+
+// 收到的字节数
+func (connection *Connection) BytesIn() int64 {
+	return atomic.LoadInt64(&connection.bytesIn)
+}
+
+// 发送的字节数
+func (connection *Connection) BytesOut() int64 {
+	return atomic.LoadInt64(&connection.bytesOut)
+}
+
+// 远程地址，其他节点上的连接返回 节点ID/连接ID
+func (connection *Connection) RemoteAddr() string {
+	if connection.IsRemote() {
+		return connection.remoteNode + "/" + strconv.Itoa(connection.remoteConnectionId)
+	}
+	if connection.client == nil {
+		return ""
+	}
+	return connection.client.RemoteAddr().String()
+}
+
+// 连接时间
+func (connection *Connection) ConnectedAt() time.Time {
+	return connection.connectedAt
+}
+
+// 用户ID，未认证时为0
+func (connection *Connection) UserId() int64 {
+	return connection.userId
+}
+
+// 发送队列中等待发送的数据数量
+func (connection *Connection) OutboundLen() int {
+	return len(connection.outbound)
+}
+
 func (connection *Connection) Id() int {
-	return connection.client.Id()
+	if connection.client != nil {
+		return connection.client.Id()
+	}
+	return connection.id
 }
 
 func (connection *Connection) IsAuthenticated() bool {
@@ -62,6 +290,9 @@ func (connection *Connection) UnsubscribeQueue(queue string) {
 }
 
 func (connection *Connection) Queues() []string {
+	connection.mutex.Lock()
+	defer connection.mutex.Unlock()
+
 	var queues []string
 	for queue := range connection.queues {
 		queues = append(queues, queue)
@@ -70,40 +301,122 @@ func (connection *Connection) Queues() []string {
 }
 
 func (connection *Connection) IsSubscribedQueue(queue string) bool {
+	connection.mutex.Lock()
+	defer connection.mutex.Unlock()
+
 	_, found := connection.queues[queue]
 	return found
 }
 
+// 将数据放入发送队列
 func (connection *Connection) Write(data []byte) (int, error) {
-	return connection.client.WriteBytes(data)
+	err := connection.enqueue(&outboundData{
+		data: data,
+	})
+	if err != nil {
+		return 0, err
+	}
+	return len(data), nil
 }
 
 func (connection *Connection) WriteString(dataString string) (int, error) {
-	return connection.client.WriteBytes([]byte(dataString))
+	return connection.Write([]byte(dataString))
 }
 
-func (connection *Connection) ResponseError(err string) {
-	data, _ := json.Marshal(map[string]interface{}{
-		"code":    10000,
-		"message": err,
-		"data":    nil,
+// 将消息放入发送队列，超过expiresAt仍未发送的消息会被丢弃
+func (connection *Connection) WriteMessage(messageObject *message.Message, expiresAt time.Time) error {
+	data, err := messageObject.Encode()
+	if err != nil {
+		return err
+	}
+	return connection.enqueue(&outboundData{
+		data:      data,
+		message:   messageObject,
+		expiresAt: expiresAt,
 	})
-	data = append(data, []byte("\n") ...)
-	connection.client.WriteBytes(data)
 }
 
-func (connection *Connection) ResponseSuccess(message string) {
-	data, _ := json.Marshal(map[string]interface{}{
-		"code":    200,
-		"message": message,
-		"data":    nil,
-	})
-	data = append(data, []byte("\n") ...)
-	connection.client.WriteBytes(data)
+func (connection *Connection) enqueue(outbound *outboundData) error {
+	connection.mutex.Lock()
+	defer connection.mutex.Unlock()
+
+	if connection.isClosed {
+		return errors.New("the connection is closed")
+	}
+
+	select {
+	case connection.outbound <- outbound:
+		return nil
+	default:
+		return errors.New("the outbound queue of the connection is full")
+	}
+}
+
+// 发送消息到连接
+func (connection *Connection) SendMessage(queue string, body map[string]interface{}) error {
+	messageObject := &message.Message{
+		Queue: queue,
+		Body:  body,
+	}
+	data, err := messageObject.Encode()
+	if err != nil {
+		return err
+	}
+	_, err = connection.Write(data)
+	return err
+}
+
+// 响应错误，err为*Error时使用其中的错误代码，request不为nil时回显其消息ID和queue
+func (connection *Connection) ResponseError(request *message.Message, err error) {
+	connection.Write(responseData(request, ErrorCode(err), err.Error(), nil))
+}
+
+// 响应成功，data可以为nil，request不为nil时回显其消息ID和queue
+func (connection *Connection) ResponseSuccess(request *message.Message, successMessage string, data interface{}) {
+	connection.Write(responseData(request, message.ResponseCodeSuccess, successMessage, data))
 }
 
 func (connection *Connection) Close() {
-	connection.client.Close()
+	connection.mutex.Lock()
+	if !connection.isClosed {
+		connection.isClosed = true
+		close(connection.done)
+	}
+	connection.mutex.Unlock()
+
+	if connection.client != nil {
+		connection.client.Close()
+	}
+}
+
+// 等待队列中已有的数据发送完，超时或连接已关闭时返回false
+func (connection *Connection) Flush(timeout time.Duration) bool {
+	flushed := make(chan bool)
+	err := connection.enqueue(&outboundData{
+		flushed: flushed,
+	})
+	if err != nil {
+		return false
+	}
+
+	select {
+	case <-flushed:
+		return true
+	case <-connection.done:
+		return false
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// 发送完队列中的数据后再关闭连接
+func (connection *Connection) CloseAfterWriting() {
+	err := connection.enqueue(&outboundData{
+		closes: true,
+	})
+	if err != nil {
+		connection.Close()
+	}
 }
 
 func (connection *Connection) SetWorker(isWorker bool) {
@@ -113,3 +426,13 @@ func (connection *Connection) SetWorker(isWorker bool) {
 func (connection *Connection) IsWorker() bool {
 	return connection.isWorker
 }
+
+// 生成响应数据
+func responseData(request *message.Message, code int, responseMessage string, data interface{}) []byte {
+	responseBytes, err := message.NewResponse(request, code, responseMessage, data).Encode()
+	if err != nil {
+		logs.Error("encode response failed", logs.KeyError, err)
+		responseBytes, _ = message.NewResponse(request, ErrorCodeDefault, err.Error(), nil).Encode()
+	}
+	return responseBytes
+}
@@ -1,6 +1,12 @@
 package mq
 
-import "testing"
+import (
+	"testing"
+	"encoding/json"
+	"errors"
+	"github.com/iwind/TeaMQ/message"
+	"time"
+)
 
 func TestConnection_Keys(t *testing.T) {
 	var connection = NewConnection(nil)
@@ -16,3 +22,68 @@ func TestConnection_Keys(t *testing.T) {
 	t.Log(connection.Queues())
 }
 
+
+func TestConnection_ResponseError(t *testing.T) {
+	var connection = NewConnection(nil)
+	request := &message.Message{Queue: "$tea.message.cancel"}
+	request.SetId("abc")
+
+	connection.ResponseError(request, NewError(ErrorCodeNotFound, "not found"))
+	connection.ResponseError(nil, errors.New("other error"))
+	connection.ResponseSuccess(request, "ok", map[string]interface{}{"queues": []string{"user.1"}})
+
+	for _, expected := range []map[string]interface{}{
+		{"code": float64(ErrorCodeNotFound), "id": "abc", "queue": "$tea.message.cancel"},
+		{"code": float64(ErrorCodeDefault), "id": nil, "queue": nil},
+		{"code": float64(200), "id": "abc", "queue": "$tea.message.cancel"},
+	} {
+		response := map[string]interface{}{}
+		err := json.Unmarshal((<-connection.outbound).data, &response)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if response["code"] != expected["code"] || response["id"] != expected["id"] || response["queue"] != expected["queue"] {
+			t.Fatal("wrong response:", response)
+		}
+	}
+}
+
+func TestConnection_Delay(t *testing.T) {
+	var connection = NewConnection(nil)
+
+	// 等待时间短的任务也排在之前的任务后面
+	result := make(chan int, 3)
+	connection.Delay(50*time.Millisecond, func() {
+		result <- 1
+	})
+	connection.Delay(0, func() {
+		result <- 2
+	})
+	if !connection.HasDelayed() {
+		t.Fatal("connection should have delayed tasks")
+	}
+	for _, expected := range []int{1, 2} {
+		select {
+		case value := <-result:
+			if value != expected {
+				t.Fatal("delayed tasks should run in order, expected", expected, "got", value)
+			}
+		case <-time.After(3 * time.Second):
+			t.Fatal("delayed task should run")
+		}
+	}
+
+	// 连接关闭后丢弃未执行的任务
+	connection.Delay(100*time.Millisecond, func() {
+		result <- 3
+	})
+	connection.Close()
+	if connection.Delay(0, func() {}) == nil {
+		t.Fatal("closed connection should reject delayed tasks")
+	}
+	select {
+	case <-result:
+		t.Fatal("delayed task should be dropped after closed")
+	case <-time.After(200 * time.Millisecond):
+	}
+}
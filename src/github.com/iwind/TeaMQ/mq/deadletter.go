@@ -0,0 +1,186 @@
+package mq
+
+import (
+	"github.com/iwind/TeaMQ/message"
+	"sync"
+	"time"
+	"github.com/iwind/TeaMQ/logs"
+)
+
+const defaultDeadLetterQueueSize = 1000
+
+// 死信原因
+const (
+	DeadLetterReasonNoWorker         = "no_worker"         // 没有可用的worker
+	DeadLetterReasonConnectionClosed = "connection_closed" // 目标连接已关闭
+	DeadLetterReasonEncodeFailed     = "encode_failed"     // 消息编码失败
+	DeadLetterReasonExpired          = "expired"           // 消息已过期
+	DeadLetterReasonNotAcked         = "not_acked"         // worker没有及时确认
+)
+
+// 无法投递的消息
+type DeadLetter struct {
+	Id        int64
+	Reason    string
+	Message   *message.Message
+	CreatedAt time.Time
+}
+
+// 转换为可以输出给管理端的格式
+func (deadLetter *DeadLetter) Map() map[string]interface{} {
+	return map[string]interface{}{
+		"id":               deadLetter.Id,
+		"reason":           deadLetter.Reason,
+		"messageId":        deadLetter.Message.Id(),
+		"queue":            deadLetter.Message.Queue,
+		"service":          deadLetter.Message.Service,
+		"body":             deadLetter.Message.Body,
+		"fromUserId":       deadLetter.Message.FromUserId(),
+		"fromConnectionId": deadLetter.Message.FromConnectionId(),
+		"toConnectionId":   deadLetter.Message.ToConnectionId(),
+		"createdAt":        float64(deadLetter.CreatedAt.UnixNano()) / 1000000000,
+	}
+}
+
+// 死信队列，保存最近无法投递的消息，以便检查和重新投递
+type DeadLetterQueue struct {
+	letters []*DeadLetter
+	maxSize int
+	lastId  int64
+
+	mutex *sync.Mutex
+}
+
+func NewDeadLetterQueue(maxSize int) *DeadLetterQueue {
+	return &DeadLetterQueue{
+		maxSize: maxSize,
+		mutex:   &sync.Mutex{},
+	}
+}
+
+func (queue *DeadLetterQueue) SetMaxSize(maxSize int) {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+
+	queue.maxSize = maxSize
+	queue.trim()
+}
+
+// 添加无法投递的消息
+func (queue *DeadLetterQueue) Add(reason string, messageObject *message.Message) *DeadLetter {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+
+	queue.lastId ++
+	deadLetter := &DeadLetter{
+		Id:        queue.lastId,
+		Reason:    reason,
+		Message:   messageObject,
+		CreatedAt: time.Now(),
+	}
+	queue.letters = append(queue.letters, deadLetter)
+	queue.trim()
+
+	logs.Warn("dead letter", "id", deadLetter.Id, "reason", reason, logs.KeyQueue, messageObject.Queue, logs.KeyConnectionId, messageObject.FromConnectionId())
+
+	return deadLetter
+}
+
+// 取得所有消息
+func (queue *DeadLetterQueue) List() []*DeadLetter {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+
+	return append([]*DeadLetter{}, queue.letters...)
+}
+
+func (queue *DeadLetterQueue) Len() int {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+
+	return len(queue.letters)
+}
+
+// 取出指定ID的消息，ids为空时取出所有消息
+func (queue *DeadLetterQueue) Take(ids []int64) []*DeadLetter {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+
+	if len(ids) == 0 {
+		letters := queue.letters
+		queue.letters = nil
+		return letters
+	}
+
+	idMap := map[int64]bool{}
+	for _, id := range ids {
+		idMap[id] = true
+	}
+
+	taken := []*DeadLetter{}
+	left := []*DeadLetter{}
+	for _, deadLetter := range queue.letters {
+		if idMap[deadLetter.Id] {
+			taken = append(taken, deadLetter)
+		} else {
+			left = append(left, deadLetter)
+		}
+	}
+	queue.letters = left
+	return taken
+}
+
+func (queue *DeadLetterQueue) trim() {
+	if queue.maxSize > 0 && len(queue.letters) > queue.maxSize {
+		queue.letters = queue.letters[len(queue.letters)-queue.maxSize:]
+	}
+}
+
+// 列出死信，只允许worker访问
+func (mq *MQ) handleListDeadLetters(message *message.Message, connection *Connection) {
+	if !connection.IsWorker() {
+		connection.ResponseError(message, NewError(ErrorCodeForbidden, "Permission denied, only workers can access dead letters"))
+		return
+	}
+
+	letters := []map[string]interface{}{}
+	for _, deadLetter := range mq.deadLetters.List() {
+		letters = append(letters, deadLetter.Map())
+	}
+	connection.ResponseSuccess(message, "ok", map[string]interface{}{
+		"deadLetters": letters,
+	})
+}
+
+// 重新投递死信，body.ids为空时投递所有消息，只允许worker访问
+func (mq *MQ) handleReplayDeadLetters(message *message.Message, connection *Connection) {
+	if !connection.IsWorker() {
+		connection.ResponseError(message, NewError(ErrorCodeForbidden, "Permission denied, only workers can replay dead letters"))
+		return
+	}
+
+	ids := []int64{}
+	idValues, _ := message.ValueForKey("ids").([]interface{})
+	for _, idValue := range idValues {
+		if idFloat, ok := idValue.(float64); ok {
+			ids = append(ids, int64(idFloat))
+		}
+	}
+
+	letters := mq.deadLetters.Take(ids)
+	for _, deadLetter := range letters {
+		mq.replayDeadLetter(deadLetter)
+	}
+	connection.ResponseSuccess(message, "ok", nil)
+}
+
+// 按原来的路径重新投递，仍然失败的消息会重新进入死信队列
+func (mq *MQ) replayDeadLetter(deadLetter *DeadLetter) {
+	if deadLetter.Message.ToConnectionId() > 0 {
+		mq.replyToConnection(deadLetter.Message)
+	} else if deadLetter.Message.ToUserId() > 0 {
+		mq.sendToUser(deadLetter.Message)
+	} else {
+		mq.dispatchToWorker(deadLetter.Message)
+	}
+}
@@ -0,0 +1,102 @@
+package mq
+
+import (
+	"testing"
+	"time"
+	"github.com/iwind/TeaMQ/message"
+)
+
+func TestDeadLetterQueue(t *testing.T) {
+	queue := NewDeadLetterQueue(2)
+	for _, queueName := range []string{"A", "B", "C"} {
+		queue.Add(DeadLetterReasonNoWorker, &message.Message{Queue: queueName})
+	}
+	letters := queue.List()
+	if len(letters) != 2 || letters[0].Message.Queue != "B" || letters[1].Message.Queue != "C" {
+		t.Fatal("queue should keep the latest 2 letters")
+	}
+	t.Log(letters[0].Map())
+
+	taken := queue.Take([]int64{letters[1].Id})
+	if len(taken) != 1 || taken[0].Message.Queue != "C" || queue.Len() != 1 {
+		t.Fatal("take by id failed")
+	}
+
+	taken = queue.Take(nil)
+	if len(taken) != 1 || queue.Len() != 0 {
+		t.Fatal("take all failed")
+	}
+}
+
+func TestMQ_DispatchToWorker_DeadLetter(t *testing.T) {
+	mq := NewMQ()
+	messageObject := &message.Message{Queue: "GET_USER_PROFILE"}
+	mq.dispatchToWorker(messageObject)
+
+	letters := mq.deadLetters.List()
+	if len(letters) != 1 || letters[0].Reason != DeadLetterReasonNoWorker {
+		t.Fatal("message without worker should be dead lettered")
+	}
+}
+
+func TestMQ_DeadLetter_ClientTarget(t *testing.T) {
+	mq := startTestMQ(t, &Config{Bind: "127.0.0.1"})
+
+	// 客户端伪造的目标不能在重新投递时生效
+	client := dialTestNode(t, mq)
+	client.send(map[string]interface{}{
+		"queue":          "GET_USER_PROFILE",
+		"toConnectionId": 1,
+		"toUserId":       1,
+	})
+	deadline := time.Now().Add(3 * time.Second)
+	for mq.deadLetters.Len() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("message without worker should be dead lettered")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	letter := mq.deadLetters.List()[0]
+	if letter.Message.ToConnectionId() != 0 || letter.Message.ToUserId() != 0 {
+		t.Fatal("target of client message should be cleared")
+	}
+}
+
+func TestMQ_AdminResponses(t *testing.T) {
+	mq := startTestMQ(t, &Config{Bind: "127.0.0.1", Keys: []string{"k1"}})
+
+	workerClient := dialTestNode(t, mq)
+	workerClient.send(map[string]interface{}{
+		"queue": "$tea.worker.register",
+		"body": map[string]interface{}{
+			"key": "k1",
+			"id":  "w1",
+			"user": map[string]interface{}{
+				"min": 1,
+				"max": 100,
+			},
+		},
+	})
+	if code := workerClient.read()["code"]; code != float64(200) {
+		t.Fatal("register failed:", code)
+	}
+
+	// 响应使用统一的格式并回显请求ID
+	for queue, field := range map[string]string{
+		"$tea.admin.deadletters": "deadLetters",
+		"$tea.admin.ratelimits":  "rateLimits",
+	} {
+		workerClient.send(map[string]interface{}{
+			"queue": queue,
+			"id":    "r1",
+		})
+		response := workerClient.read()
+		data, _ := response["data"].(map[string]interface{})
+		if response["code"] != float64(200) || response["id"] != "r1" || response["queue"] != queue {
+			t.Fatal("unexpected response:", response)
+		}
+		if _, found := data[field]; !found {
+			t.Fatal("response should contain '"+field+"':", response)
+		}
+	}
+}
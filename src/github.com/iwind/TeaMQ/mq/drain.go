@@ -0,0 +1,26 @@
+package mq
+
+import (
+	"github.com/iwind/TeaMQ/message"
+	"github.com/iwind/TeaMQ/logs"
+)
+
+// worker准备下线，不再给它转发新的消息，它的用户范围会由其他worker或备用节点接管
+// worker处理完已接收的消息后会自行断开连接
+func (mq *MQ) handleWorkerDrain(message *message.Message, connection *Connection) {
+	mq.mutex.Lock()
+	defer mq.mutex.Unlock()
+
+	workerObject, found := mq.workers[connection.Id()]
+	if !found {
+		connection.ResponseError(message, ErrNotWorker)
+		return
+	}
+
+	logs.Info("drain worker", logs.KeyWorkerId, workerObject.Id, logs.KeyConnectionId, connection.Id())
+	workerObject.IsDraining = true
+	workerObject.IsAvailable = false
+
+	// 在持有锁的时候响应，保证在此之前转发的消息都先于响应到达worker
+	connection.ResponseSuccess(message, "ok", nil)
+}
@@ -0,0 +1,57 @@
+package mq
+
+import "fmt"
+
+// 响应中的错误代码
+const (
+	ErrorCodeDefault          = 10000 // 其他错误
+	ErrorCodeInvalidMessage   = 10400 // 消息格式错误
+	ErrorCodeAuthRequired     = 10401 // 需要认证
+	ErrorCodeAuthFailed       = 10402 // 认证失败
+	ErrorCodeForbidden        = 10403 // 没有权限
+	ErrorCodeNotFound         = 10404 // 要操作的对象不存在
+	ErrorCodeInvalidQueue     = 10410 // 队列名称不合法
+	ErrorCodeReservedQueue    = 10411 // 使用了不存在的内置队列
+	ErrorCodeFrameTooLarge    = 10413 // 单条消息超出最大长度
+	ErrorCodeBodyTooDeep      = 10420 // 消息体嵌套过深
+	ErrorCodeTooManyKeys      = 10421 // 消息体中的键过多
+	ErrorCodeRateLimited      = 10429 // 超出限速
+	ErrorCodeTooManyScheduled = 10430 // 等待投递的定时消息过多
+	ErrorCodeNoWorker         = 10503 // 没有可以处理消息的worker
+)
+
+// 带错误代码的错误，响应时使用其中的代码
+type Error struct {
+	Code    int
+	Message string
+}
+
+func NewError(code int, message string) *Error {
+	return &Error{
+		Code:    code,
+		Message: message,
+	}
+}
+
+func NewErrorf(code int, format string, args ...interface{}) *Error {
+	return NewError(code, fmt.Sprintf(format, args...))
+}
+
+func (err *Error) Error() string {
+	return err.Message
+}
+
+// 取得错误代码，不是*Error时返回ErrorCodeDefault
+func ErrorCode(err error) int {
+	if codeErr, ok := err.(*Error); ok {
+		return codeErr.Code
+	}
+	return ErrorCodeDefault
+}
+
+// 常用的错误
+var (
+	ErrAuthRequired = NewError(ErrorCodeAuthRequired, "The connection need authenticate")
+	ErrAuthFailed   = NewError(ErrorCodeAuthFailed, "there has a error on authentication server")
+	ErrNotWorker    = NewError(ErrorCodeForbidden, "The connection is not a worker")
+)
@@ -0,0 +1,129 @@
+package mq
+
+import (
+	"github.com/iwind/TeaMQ/message"
+	"github.com/iwind/TeaMQ/worker"
+	"time"
+	"github.com/iwind/TeaMQ/logs"
+)
+
+const defaultHeartbeatMaxMisses = 3
+
+// 处理worker心跳，更新worker的延迟和健康度
+func (mq *MQ) handleWorkerHeartbeat(message *message.Message, connection *Connection) {
+	mq.mutex.Lock()
+	defer mq.mutex.Unlock()
+
+	workerObject, found := mq.workers[connection.Id()]
+	if !found {
+		connection.ResponseError(message, ErrNotWorker)
+		return
+	}
+
+	// 密钥过期后断开连接，worker需要使用新的密钥重新注册
+	now := time.Now()
+	workerKey := mq.currentConfig().findWorkerKey(workerObject.Key)
+	if workerKey == nil || workerKey.IsExpired(now) {
+		logs.Warn("disconnect worker using expired key", logs.KeyWorkerId, workerObject.Id, logs.KeyConnectionId, connection.Id(), "key", workerObject.Key)
+		connection.Close()
+		return
+	}
+
+	sentAt, ok := message.ValueForKey("sentAt").(float64)
+	if ok && sentAt > 0 {
+		lag := int(float64(now.UnixNano())/1000000 - sentAt*1000)
+		if lag < 0 {
+			lag = 0
+		}
+		workerObject.Lag = lag
+	}
+
+	stateMap, found := message.MapForKey("state")
+	if found {
+		workerObject.AddState(parseWorkerState(stateMap, now))
+	}
+
+	workerObject.HeartbeatAt = now
+	workerObject.IsOnline = true
+	workerObject.IsAvailable = !workerObject.IsDraining
+	workerObject.Health = 100
+}
+
+// 定时检查worker心跳，将丢失心跳的worker标记为不可用，并移除丢失次数过多的worker
+func (mq *MQ) checkWorkerHeartbeats() {
+	interval := time.Duration(mq.currentConfig().Heartbeat.Interval) * time.Millisecond
+	maxMisses := mq.currentConfig().Heartbeat.MaxMisses
+	if maxMisses <= 0 {
+		maxMisses = defaultHeartbeatMaxMisses
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-mq.done:
+			return
+		case <-ticker.C:
+		}
+
+		mq.mutex.Lock()
+		mq.updateWorkerHealth(time.Now(), interval, maxMisses)
+		mq.mutex.Unlock()
+	}
+}
+
+// 根据最后一次心跳时间更新worker的健康度，调用者需持有mq.mutex
+// 超过1.5倍间隔才算丢失一次心跳，以免网络抖动导致正常的worker被标记为不可用；
+// 丢失次数达到maxMisses之前worker仍然可用，只降低健康度
+func (mq *MQ) updateWorkerHealth(now time.Time, interval time.Duration, maxMisses int) {
+	for connectionId, workerObject := range mq.workers {
+		misses := heartbeatMisses(now.Sub(workerObject.HeartbeatAt), interval)
+		if misses == 0 {
+			continue
+		}
+
+		workerObject.Health = 100 - misses*100/maxMisses
+		if workerObject.Health < 0 {
+			workerObject.Health = 0
+		}
+
+		if misses >= maxMisses {
+			workerObject.IsAvailable = false
+			workerObject.IsOnline = false
+			connection, found := mq.connections[connectionId]
+			if found {
+				logs.Warn("evict worker which missed heartbeats", logs.KeyWorkerId, workerObject.Id, logs.KeyConnectionId, connectionId, "misses", misses)
+				connection.Close()
+			}
+		}
+	}
+}
+
+// 计算丢失的心跳次数，每次心跳有半个间隔的宽限时间
+func heartbeatMisses(elapsed time.Duration, interval time.Duration) int {
+	grace := interval / 2
+	if elapsed <= interval+grace {
+		return 0
+	}
+	return int((elapsed - grace) / interval)
+}
+
+// 从心跳数据中解析worker状态
+func parseWorkerState(stateMap map[string]interface{}, now time.Time) worker.State {
+	floatValue := func(key string) float64 {
+		value, _ := stateMap[key].(float64)
+		return value
+	}
+
+	return worker.State{
+		CPU:               floatValue("cpu"),
+		Memory:            uint64(floatValue("memory")),
+		Goroutines:        int(floatValue("goroutines")),
+		Load1:             floatValue("load1"),
+		Load5:             floatValue("load5"),
+		Load15:            floatValue("load15"),
+		QueueDepth:        int(floatValue("queueDepth")),
+		MessagesPerSecond: floatValue("messagesPerSecond"),
+		CreatedAt:         now,
+	}
+}
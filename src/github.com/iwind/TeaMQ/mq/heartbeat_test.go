@@ -0,0 +1,52 @@
+package mq
+
+import (
+	"testing"
+	"time"
+	"github.com/iwind/TeaMQ/worker"
+)
+
+func TestMQ_UpdateWorkerHealth(t *testing.T) {
+	mq := NewMQ()
+	now := time.Now()
+
+	alive := worker.NewWorker()
+	alive.IsOnline = true
+	alive.IsAvailable = true
+	alive.HeartbeatAt = now
+	mq.workers[1] = alive
+
+	late := worker.NewWorker()
+	late.IsOnline = true
+	late.IsAvailable = true
+	late.Health = 100
+	late.HeartbeatAt = now.Add(-1200 * time.Millisecond)
+	mq.workers[4] = late
+
+	hung := worker.NewWorker()
+	hung.IsOnline = true
+	hung.IsAvailable = true
+	hung.HeartbeatAt = now.Add(-2 * time.Second)
+	mq.workers[2] = hung
+
+	dead := worker.NewWorker()
+	dead.IsOnline = true
+	dead.IsAvailable = true
+	dead.HeartbeatAt = now.Add(-5 * time.Second)
+	mq.workers[3] = dead
+
+	mq.updateWorkerHealth(now, time.Second, 3)
+
+	if !alive.IsAvailable || !alive.IsOnline {
+		t.Fatal("alive worker should be available")
+	}
+	if !late.IsAvailable || !late.IsOnline || late.Health != 100 {
+		t.Fatal("worker whose heartbeat is slightly late should not miss a heartbeat")
+	}
+	if !hung.IsAvailable || !hung.IsOnline || hung.Health != 67 {
+		t.Fatalf("hung worker should be available until max misses, health: %d", hung.Health)
+	}
+	if dead.IsAvailable || dead.IsOnline || dead.Health != 0 {
+		t.Fatal("dead worker should be offline")
+	}
+}
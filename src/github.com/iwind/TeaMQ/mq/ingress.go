@@ -0,0 +1,84 @@
+package mq
+
+import (
+	"github.com/iwind/TeaMQ/message"
+	"github.com/iwind/TeaMQ/nets"
+	"strings"
+	"bufio"
+	"github.com/iwind/TeaMQ/logs"
+	"time"
+)
+
+const (
+	defaultMaxBodyDepth = 32   // 默认消息体最大嵌套深度
+	defaultMaxBodyKeys  = 1024 // 默认消息体中最多的键数
+)
+
+// 读取出错后等待错误信息发送的最长时间
+const readErrorFlushTimeout = 3 * time.Second
+
+// 检查收到的消息，不合法时返回带错误代码的错误
+func (mq *MQ) validateIngress(messageObject *message.Message) error {
+	limits := mq.currentConfig().Limits
+
+	err := mq.validateQueue(messageObject.Queue)
+	if err != nil {
+		return NewError(ErrorCodeInvalidQueue, err.Error())
+	}
+
+	// $tea.开头的队列只能是已注册的内置队列
+	if strings.HasPrefix(messageObject.Queue, message.BuiltinQueuePrefix) {
+		if _, found := mq.messageHandlers[messageObject.Queue]; !found {
+			return NewError(ErrorCodeReservedQueue, "queue '"+messageObject.Queue+"' is reserved for built-in messages")
+		}
+	}
+
+	maxDepth := limits.MaxBodyDepth
+	if maxDepth <= 0 {
+		maxDepth = defaultMaxBodyDepth
+	}
+	maxKeys := limits.MaxBodyKeys
+	if maxKeys <= 0 {
+		maxKeys = defaultMaxBodyKeys
+	}
+	depth, keys := messageObject.BodyStats()
+	if depth > maxDepth {
+		return NewErrorf(ErrorCodeBodyTooDeep, "message body should not be nested deeper than %d", maxDepth)
+	}
+	if keys > maxKeys {
+		return NewErrorf(ErrorCodeTooManyKeys, "message body should not contain more than %d keys", maxKeys)
+	}
+
+	return nil
+}
+
+// 检查队列名称
+func (mq *MQ) validateQueue(queue string) error {
+	return message.ValidateQueue(queue, mq.currentConfig().Limits.MaxQueueLength)
+}
+
+// 读取数据出错，连接随后会被关闭，所以需要等待错误信息发送完
+func (mq *MQ) handleReadError(client *nets.Client, err error) {
+	if err != bufio.ErrTooLong {
+		logs.Error("read connection failed", logs.KeyConnectionId, client.Id(), logs.KeyError, err)
+		return
+	}
+
+	logs.Warn("message is too large", logs.KeyConnectionId, client.Id(), "maxFrameSize", mq.maxFrameSize())
+
+	mq.mutex.Lock()
+	connection, found := mq.connections[client.Id()]
+	mq.mutex.Unlock()
+	if !found {
+		return
+	}
+	connection.ResponseError(nil, NewErrorf(ErrorCodeFrameTooLarge, "Message should not be longer than %d bytes", mq.maxFrameSize()))
+	connection.Flush(readErrorFlushTimeout)
+}
+
+func (mq *MQ) maxFrameSize() int {
+	if mq.currentConfig().Limits.MaxFrameSize > 0 {
+		return mq.currentConfig().Limits.MaxFrameSize
+	}
+	return nets.DefaultMaxFrameSize
+}
@@ -0,0 +1,33 @@
+package mq
+
+import (
+	"testing"
+	"github.com/iwind/TeaMQ/message"
+)
+
+func TestMQ_ValidateIngress(t *testing.T) {
+	mq := NewMQ()
+	mq.config.Limits.MaxBodyDepth = 2
+	mq.config.Limits.MaxBodyKeys = 3
+
+	for data, expectedCode := range map[string]int{
+		`{"queue":"GET_USER_PROFILE","body":{"id":1}}`:                  0,
+		`{"queue":"$tea.connection.ping"}`:                              0,
+		`{"queue":"$tea.unknown"}`:                                      ErrorCodeReservedQueue,
+		`{"queue":"user profile"}`:                                      ErrorCodeInvalidQueue,
+		`{"queue":"GET_USER_PROFILE","body":{"a":{"b":{"c":1}}}}`:       ErrorCodeBodyTooDeep,
+		`{"queue":"GET_USER_PROFILE","body":{"a":1,"b":2,"c":3,"d":4}}`: ErrorCodeTooManyKeys,
+	} {
+		messageObject, err := message.Unmarshal([]byte(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		code := 0
+		if err := mq.validateIngress(messageObject); err != nil {
+			code = ErrorCode(err)
+		}
+		if code != expectedCode {
+			t.Fatalf("%s: expected code %d, got %d", data, expectedCode, code)
+		}
+	}
+}
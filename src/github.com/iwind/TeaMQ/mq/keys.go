@@ -0,0 +1,276 @@
+package mq
+
+import (
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/iwind/TeaMQ/worker"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 哈希格式：pbkdf2-sha256$Iterations$Salt$Hash，Salt和Hash都是十六进制字符串，Hash = PBKDF2-HMAC-SHA256(Key, Salt, Iterations)
+// 使用较慢的算法，以免配置文件泄露后可以快速猜测密钥
+const (
+	keyHashPrefix     = "pbkdf2-sha256$"
+	keyHashIterations = 100000
+	keySaltSize       = 16
+)
+
+// worker注册时使用的密钥，Key和Hash只能设置一个
+// 轮换密钥时先加入新的密钥并给旧的密钥设置过期时间，worker都换成新的密钥后再删除旧的密钥
+type WorkerKey struct {
+	Name      string      `yaml:"name"`      // 名称，用于日志，为空时使用密钥的指纹
+	Key       string      `yaml:"key"`       // 明文密钥，建议使用Hash
+	Hash      string      `yaml:"hash"`      // 密钥的哈希，可以通过 mq -hash-key KEY 生成
+	WorkerIds []string    `yaml:"workerIds"` // 允许注册的worker ID，支持*等通配符，为空时不限制
+	Users     []UserRange `yaml:"users"`     // 允许的用户范围，worker的用户范围必须在其中一个范围内，为空时不限制
+	Tags      []string    `yaml:"tags"`      // 允许的标签，worker必须带有标签且都在此列表中，为空时不限制
+	ExpiresAt string      `yaml:"expiresAt"` // 过期时间，如 2026-01-01 或 2026-01-01T00:00:00+08:00，为空时不过期
+}
+
+// 生成密钥的哈希，每次生成的盐都不同
+func HashKey(key string) (string, error) {
+	salt := make([]byte, keySaltSize)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return "", err
+	}
+	hash, err := hashKey(key, salt, keyHashIterations)
+	if err != nil {
+		return "", err
+	}
+	return keyHashPrefix + strconv.Itoa(keyHashIterations) + "$" + hex.EncodeToString(salt) + "$" + hex.EncodeToString(hash), nil
+}
+
+func hashKey(key string, salt []byte, iterations int) ([]byte, error) {
+	return pbkdf2.Key(sha256.New, key, salt, iterations, sha256.Size)
+}
+
+// 判断字符串是否为HashKey()生成的哈希
+func isKeyHash(value string) bool {
+	return strings.HasPrefix(value, keyHashPrefix)
+}
+
+// 拆分哈希中的迭代次数、盐和哈希值
+func parseKeyHash(value string) (iterations int, salt []byte, hash []byte, err error) {
+	pieces := strings.Split(strings.TrimPrefix(value, keyHashPrefix), "$")
+	if !isKeyHash(value) || len(pieces) != 3 {
+		return 0, nil, nil, errors.New("should be in format 'pbkdf2-sha256$ITERATIONS$SALT$HASH'")
+	}
+	iterations, err = strconv.Atoi(pieces[0])
+	if err != nil || iterations <= 0 {
+		return 0, nil, nil, errors.New("contains invalid iterations")
+	}
+	salt, err = hex.DecodeString(pieces[1])
+	if err != nil || len(salt) == 0 {
+		return 0, nil, nil, errors.New("contains an invalid salt")
+	}
+	hash, err = hex.DecodeString(pieces[2])
+	if err != nil || len(hash) != sha256.Size {
+		return 0, nil, nil, errors.New("contains an invalid sha256 hash")
+	}
+	return iterations, salt, hash, nil
+}
+
+// 取得密钥的标识，注册的worker中只保存此标识，不保存密钥本身
+func (workerKey *WorkerKey) Id() string {
+	if len(workerKey.Name) > 0 {
+		return workerKey.Name
+	}
+	if len(workerKey.Hash) > 0 {
+		// 只使用哈希的指纹，以免在日志中泄露哈希
+		sum := sha256.Sum256([]byte(workerKey.Hash))
+		return "hash:" + hex.EncodeToString(sum[:8])
+	}
+	sum := sha256.Sum256([]byte(workerKey.Key))
+	return "sha256:" + hex.EncodeToString(sum[:8])
+}
+
+// 使用固定时间的比较判断密钥是否匹配
+func (workerKey *WorkerKey) Matches(key string) bool {
+	if len(workerKey.Hash) > 0 {
+		iterations, salt, hash, err := parseKeyHash(workerKey.Hash)
+		if err != nil {
+			return false
+		}
+		keyHash, err := hashKey(key, salt, iterations)
+		if err != nil {
+			return false
+		}
+		return subtle.ConstantTimeCompare(keyHash, hash) == 1
+	}
+	if len(workerKey.Key) == 0 {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(workerKey.Key), []byte(key)) == 1
+}
+
+// 判断密钥是否已过期
+func (workerKey *WorkerKey) IsExpired(now time.Time) bool {
+	expiresAt, err := parseKeyExpiresAt(workerKey.ExpiresAt)
+	if err != nil {
+		return true
+	}
+	return !expiresAt.IsZero() && !now.Before(expiresAt)
+}
+
+// 检查密钥是否允许注册此worker
+func (workerKey *WorkerKey) Allows(workerObject *worker.Worker) error {
+	if len(workerKey.WorkerIds) > 0 {
+		if !matchesAnyPattern(workerKey.WorkerIds, workerObject.Id) {
+			return fmt.Errorf("key '%s' is not allowed to register worker '%s'", workerKey.Id(), workerObject.Id)
+		}
+	}
+
+	if len(workerKey.Users) > 0 {
+		allowed := false
+		for _, userRange := range workerKey.Users {
+			if userRange.Min <= workerObject.User.Min && workerObject.User.Max <= userRange.Max {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return fmt.Errorf("key '%s' is not allowed to register user range [%d, %d]", workerKey.Id(), workerObject.User.Min, workerObject.User.Max)
+		}
+	}
+
+	if len(workerKey.Tags) > 0 {
+		if len(workerObject.Tags) == 0 {
+			return fmt.Errorf("key '%s' is only allowed to register workers with tags", workerKey.Id())
+		}
+		for _, tag := range workerObject.Tags {
+			if !matchesAnyPattern(workerKey.Tags, tag) {
+				return fmt.Errorf("key '%s' is not allowed to register tag '%s'", workerKey.Id(), tag)
+			}
+		}
+	}
+	return nil
+}
+
+func matchesAnyPattern(patterns []string, value string) bool {
+	for _, pattern := range patterns {
+		matched, err := path.Match(pattern, value)
+		if err == nil && matched {
+			return true
+		}
+	}
+	return false
+}
+
+// 解析过期时间，为空时返回零值
+func parseKeyExpiresAt(expiresAt string) (time.Time, error) {
+	if len(expiresAt) == 0 {
+		return time.Time{}, nil
+	}
+	t, err := time.Parse(time.RFC3339, expiresAt)
+	if err == nil {
+		return t, nil
+	}
+	t, err = time.ParseInLocation("2006-01-02", expiresAt, time.Local)
+	if err != nil {
+		return time.Time{}, errors.New("should be a date like '2006-01-02' or '2006-01-02T15:04:05+08:00'")
+	}
+	return t, nil
+}
+
+// 取得所有的密钥，包括Keys中的明文密钥和哈希
+func (config *Config) workerKeys() []*WorkerKey {
+	result := []*WorkerKey{}
+	for _, key := range config.Keys {
+		if isKeyHash(key) {
+			result = append(result, &WorkerKey{Hash: key})
+		} else {
+			result = append(result, &WorkerKey{Key: key})
+		}
+	}
+	for index := range config.WorkerKeys {
+		result = append(result, &config.WorkerKeys[index])
+	}
+	return result
+}
+
+// 查找和key匹配且未过期的密钥，所有的密钥都会被比较，以免通过响应时间猜测密钥
+func (config *Config) matchWorkerKey(key string, now time.Time) *WorkerKey {
+	var matchedKey *WorkerKey
+	for _, workerKey := range config.workerKeys() {
+		if workerKey.Matches(key) && matchedKey == nil && !workerKey.IsExpired(now) {
+			matchedKey = workerKey
+		}
+	}
+	return matchedKey
+}
+
+// 根据标识查找密钥
+func (config *Config) findWorkerKey(keyId string) *WorkerKey {
+	for _, workerKey := range config.workerKeys() {
+		if workerKey.Id() == keyId {
+			return workerKey
+		}
+	}
+	return nil
+}
+
+// 校验密钥的设置
+func (config *Config) validateKeys(configErr *ConfigError) {
+	keyIndexes := map[string]int{}
+	for index, key := range config.Keys {
+		field := fmt.Sprintf("keys[%d]", index)
+		if len(strings.TrimSpace(key)) == 0 {
+			configErr.add(field, "must not be empty")
+			continue
+		}
+		if isKeyHash(key) {
+			if _, _, _, err := parseKeyHash(key); err != nil {
+				configErr.add(field, err.Error())
+				continue
+			}
+		}
+		if otherIndex, found := keyIndexes[key]; found {
+			configErr.add(field, fmt.Sprintf("duplicates 'keys[%d]'", otherIndex))
+			continue
+		}
+		keyIndexes[key] = index
+	}
+
+	names := map[string]int{}
+	for index, workerKey := range config.WorkerKeys {
+		field := fmt.Sprintf("workerKeys[%d]", index)
+		if len(workerKey.Key) > 0 && len(workerKey.Hash) > 0 {
+			configErr.add(field, "should set only one of 'key' and 'hash'")
+		} else if len(workerKey.Key) == 0 && len(workerKey.Hash) == 0 {
+			configErr.add(field, "should set 'key' or 'hash'")
+		} else if len(workerKey.Hash) > 0 {
+			if _, _, _, err := parseKeyHash(workerKey.Hash); err != nil {
+				configErr.add(field+".hash", err.Error())
+			}
+		}
+		if len(workerKey.Name) > 0 {
+			if otherIndex, found := names[workerKey.Name]; found {
+				configErr.add(field+".name", fmt.Sprintf("duplicates 'workerKeys[%d].name'", otherIndex))
+			}
+			names[workerKey.Name] = index
+		}
+		for _, pattern := range workerKey.WorkerIds {
+			validatePattern(configErr, field+".workerIds", pattern)
+		}
+		for _, pattern := range workerKey.Tags {
+			validatePattern(configErr, field+".tags", pattern)
+		}
+		for rangeIndex, userRange := range workerKey.Users {
+			if userRange.Min <= 0 || userRange.Max < userRange.Min {
+				configErr.add(fmt.Sprintf("%s.users[%d]", field, rangeIndex), fmt.Sprintf("should be a range with 0 < min <= max, got %s", userRange))
+			}
+		}
+		if _, err := parseKeyExpiresAt(workerKey.ExpiresAt); err != nil {
+			configErr.add(field+".expiresAt", err.Error())
+		}
+	}
+}
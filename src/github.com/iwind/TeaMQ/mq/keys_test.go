@@ -0,0 +1,163 @@
+package mq
+
+import (
+	"testing"
+	"time"
+	"strings"
+	"github.com/iwind/TeaMQ/worker"
+)
+
+func TestHashKey(t *testing.T) {
+	hash1, err := HashKey("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash2, err := HashKey("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hash1 == hash2 {
+		t.Fatal("hashes of the same key should use different salts")
+	}
+	t.Log(hash1)
+
+	workerKey := &WorkerKey{Hash: hash1}
+	if !workerKey.Matches("secret") || workerKey.Matches("secret2") || workerKey.Matches("") {
+		t.Fatal("hash should only match the original key")
+	}
+
+	config := DefaultConfig()
+	config.Keys = []string{hash1, "pbkdf2-sha256$100000$abc$123"}
+	if err := config.Validate(); err == nil {
+		t.Fatal("invalid hash should be rejected")
+	}
+
+	// 没有名称的哈希密钥使用指纹作为标识，不泄露哈希本身
+	id := workerKey.Id()
+	if strings.Contains(hash1, strings.TrimPrefix(id, "hash:")) || len(id) != len("hash:")+16 {
+		t.Fatal("id of hashed key should be a short fingerprint:", id)
+	}
+}
+
+func TestWorkerKey_Allows(t *testing.T) {
+	workerKey := &WorkerKey{
+		Name:      "user-service",
+		Key:       "secret",
+		WorkerIds: []string{"user-*"},
+		Users:     []UserRange{{Min: 1, Max: 1000}},
+		Tags:      []string{"user"},
+	}
+
+	workerObject := worker.NewWorker()
+	workerObject.Id = "user-1"
+	workerObject.User.Min = 1
+	workerObject.User.Max = 500
+	workerObject.Tags = []string{"user"}
+	if err := workerKey.Allows(workerObject); err != nil {
+		t.Fatal(err)
+	}
+
+	workerObject.Id = "order-1"
+	if workerKey.Allows(workerObject) == nil {
+		t.Fatal("worker id should be checked")
+	}
+	workerObject.Id = "user-1"
+
+	workerObject.User.Max = 2000
+	if workerKey.Allows(workerObject) == nil {
+		t.Fatal("user range should be checked")
+	}
+	workerObject.User.Max = 500
+
+	workerObject.Tags = nil
+	if workerKey.Allows(workerObject) == nil {
+		t.Fatal("worker without tags should be rejected")
+	}
+}
+
+func TestWorkerKey_IsExpired(t *testing.T) {
+	now := time.Now()
+	if (&WorkerKey{}).IsExpired(now) {
+		t.Fatal("key without expiresAt should not expire")
+	}
+	if !(&WorkerKey{ExpiresAt: now.Add(-time.Minute).Format(time.RFC3339)}).IsExpired(now) {
+		t.Fatal("key should be expired")
+	}
+	if (&WorkerKey{ExpiresAt: now.AddDate(0, 0, 2).Format("2006-01-02")}).IsExpired(now) {
+		t.Fatal("key should not be expired")
+	}
+}
+
+func TestMQ_RegisterWithWorkerKeys(t *testing.T) {
+	newHash, err := HashKey("new")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 轮换期间新旧密钥同时有效
+	config := DefaultConfig()
+	config.WorkerKeys = []WorkerKey{
+		{Name: "old", Key: "old", ExpiresAt: time.Now().Add(time.Hour).Format(time.RFC3339)},
+		{Name: "new", Hash: newHash, Users: []UserRange{{Min: 1, Max: 100}}},
+	}
+	mq := startTestMQ(t, config)
+
+	register := func(key string, id string, max int) (*testClient, float64) {
+		client := dialTestNode(t, mq)
+		client.send(map[string]interface{}{
+			"queue": "$tea.worker.register",
+			"body": map[string]interface{}{
+				"key": key,
+				"id":  id,
+				"user": map[string]interface{}{
+					"min": 1,
+					"max": max,
+				},
+			},
+		})
+		code, _ := client.read()["code"].(float64)
+		return client, code
+	}
+
+	if _, code := register("wrong", "w0", 100); code != ErrorCodeAuthFailed {
+		t.Fatal("wrong key should be rejected:", code)
+	}
+	if _, code := register("new", "w1", 1000); code != ErrorCodeForbidden {
+		t.Fatal("user range not allowed by key should be rejected:", code)
+	}
+	if _, code := register("new", "w1", 100); code != 200 {
+		t.Fatal("register with new key failed:", code)
+	}
+	oldWorker, code := register("old", "w2", 1000)
+	if code != 200 {
+		t.Fatal("register with old key failed:", code)
+	}
+
+	mq.mutex.Lock()
+	for _, workerObject := range mq.workers {
+		if workerObject.Key != "old" && workerObject.Key != "new" {
+			t.Fatal("worker should keep key name instead of key:", workerObject.Key)
+		}
+	}
+	mq.mutex.Unlock()
+
+	// 旧密钥过期后，使用旧密钥的worker在下次心跳时被断开
+	newConfig := *config
+	newConfig.WorkerKeys = []WorkerKey{config.WorkerKeys[1], config.WorkerKeys[0]}
+	newConfig.WorkerKeys[1].ExpiresAt = time.Now().Add(time.Second).Format(time.RFC3339)
+	err = mq.Reload(&newConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(1100 * time.Millisecond)
+	if _, code := register("old", "w3", 1000); code != ErrorCodeAuthFailed {
+		t.Fatal("expired key should be rejected:", code)
+	}
+	oldWorker.send(map[string]interface{}{
+		"queue": "$tea.worker.heartbeat",
+	})
+	oldWorker.conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	if oldWorker.scanner.Scan() {
+		t.Fatal("worker using expired key should be disconnected")
+	}
+}
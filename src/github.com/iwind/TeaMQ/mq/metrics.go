@@ -0,0 +1,162 @@
+package mq
+
+import (
+	"github.com/iwind/TeaMQ/message"
+	"github.com/iwind/TeaMQ/metrics"
+	"github.com/iwind/TeaMQ/logs"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// 不是内置queue也不是worker注册的queue时使用的标签，以免客户端随意创建指标
+const otherQueueLabel = "other"
+
+// 认证耗时的区间，单位为秒
+var authDurationBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// MQ的指标
+type mqMetrics struct {
+	registry *metrics.Registry
+
+	connectionsOpen     *metrics.Gauge
+	connectionsAccepted *metrics.Counter
+	connectionsClosed   *metrics.Counter
+	messagesIn          *metrics.CounterVec // 按queue
+	messagesOut         *metrics.CounterVec // 按queue
+	routingFailures     *metrics.CounterVec // 按原因
+	authDuration        *metrics.Histogram
+
+	workerQueues map[string]bool // worker注册时声明的queue，作为指标的标签
+	mutex        *sync.RWMutex
+}
+
+func newMQMetrics(mq *MQ) *mqMetrics {
+	registry := metrics.NewRegistry()
+	m := &mqMetrics{
+		registry:            registry,
+		connectionsOpen:     registry.Gauge("teamq_connections_open", "Number of open client and worker connections."),
+		connectionsAccepted: registry.Counter("teamq_connections_accepted_total", "Total number of accepted connections."),
+		connectionsClosed:   registry.Counter("teamq_connections_closed_total", "Total number of closed connections."),
+		messagesIn:          registry.CounterVec("teamq_messages_in_total", "Total number of messages received, by builtin or worker queue.", "queue"),
+		messagesOut:         registry.CounterVec("teamq_messages_out_total", "Total number of messages written to connections, by builtin or worker queue.", "queue"),
+		routingFailures:     registry.CounterVec("teamq_routing_failures_total", "Total number of messages which could not be delivered, by reason.", "reason"),
+		authDuration:        registry.Histogram("teamq_auth_duration_seconds", "Latency of requests to the authentication API.", authDurationBuckets),
+		workerQueues:        map[string]bool{},
+		mutex:               &sync.RWMutex{},
+	}
+
+	registry.GaugeFunc("teamq_users_authenticated", "Number of authenticated users with at least one connection.", func() float64 {
+		mq.mutex.Lock()
+		defer mq.mutex.Unlock()
+		return float64(len(mq.users))
+	})
+	registry.GaugeFunc("teamq_workers_registered", "Number of registered workers.", func() float64 {
+		mq.mutex.Lock()
+		defer mq.mutex.Unlock()
+		return float64(len(mq.workers))
+	})
+	// 不按连接输出，以免连接ID不断增加导致指标过多，每个连接的发送队列可以在管理API的/connections中查看
+	registry.GaugeFunc("teamq_connection_outbound_depth_max", "Largest number of frames waiting in the write queue of a single connection.", func() float64 {
+		max, _ := mq.outboundDepth()
+		return float64(max)
+	})
+	registry.GaugeFunc("teamq_connection_outbound_depth_sum", "Total number of frames waiting in the write queues of all connections.", func() float64 {
+		_, sum := mq.outboundDepth()
+		return float64(sum)
+	})
+
+	return m
+}
+
+// 取得所有连接的发送队列中等待发送的数据数量的最大值和总和
+func (mq *MQ) outboundDepth() (max int, sum int) {
+	mq.mutex.Lock()
+	defer mq.mutex.Unlock()
+
+	for _, connection := range mq.connections {
+		depth := connection.OutboundLen()
+		if depth > max {
+			max = depth
+		}
+		sum += depth
+	}
+	return
+}
+
+// 开始监听指标接口
+func (mq *MQ) listenMetrics(bind string) error {
+	listener, err := net.Listen("tcp", bind)
+	if err != nil {
+		return err
+	}
+	mq.metricsListener = listener
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", mq.metrics.registry.Handler())
+	server := &http.Server{
+		Handler: mux,
+	}
+	mq.metricsServer = server
+	go func() {
+		err := server.Serve(listener)
+		if err != nil && err != http.ErrServerClosed {
+			logs.Error("serve metrics failed", logs.KeyError, err)
+		}
+	}()
+
+	logs.Info("metrics listen", "addr", listener.Addr().String())
+	return nil
+}
+
+// 记录收到的消息
+func (mq *MQ) countInbound(messageObject *message.Message) {
+	mq.metrics.messagesIn.With(mq.queueLabel(messageObject.Queue)).Inc()
+}
+
+// 记录写入连接的消息
+func (mq *MQ) countOutbound(messageObject *message.Message) {
+	mq.metrics.messagesOut.With(mq.queueLabel(messageObject.Queue)).Inc()
+}
+
+// 记录投递失败的消息
+func (mq *MQ) countRoutingFailure(reason string) {
+	mq.metrics.routingFailures.With(reason).Inc()
+}
+
+// 记录认证耗时
+func (mq *MQ) observeAuthDuration(startedAt time.Time) {
+	mq.metrics.authDuration.Observe(time.Since(startedAt).Seconds())
+}
+
+// 放入死信队列，同时记录投递失败
+func (mq *MQ) deadLetter(reason string, messageObject *message.Message) {
+	mq.countRoutingFailure(reason)
+	mq.deadLetters.Add(reason, messageObject)
+}
+
+// 取得queue在指标中的标签，只有内置queue和worker注册的queue使用自身的名称，其他的都归入other
+func (mq *MQ) queueLabel(queue string) string {
+	if _, found := mq.messageHandlers[queue]; found {
+		return queue
+	}
+
+	mq.metrics.mutex.RLock()
+	defer mq.metrics.mutex.RUnlock()
+	if mq.metrics.workerQueues[queue] {
+		return queue
+	}
+	return otherQueueLabel
+}
+
+// 设置worker注册的queue是否作为指标的标签
+func (m *mqMetrics) setWorkerQueue(queue string, registered bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if registered {
+		m.workerQueues[queue] = true
+	} else {
+		delete(m.workerQueues, queue)
+	}
+}
@@ -0,0 +1,61 @@
+package mq
+
+import (
+	"testing"
+	"bytes"
+	"strings"
+	"github.com/iwind/TeaMQ/message"
+	"github.com/iwind/TeaMQ/worker"
+)
+
+func TestMQ_QueueLabel(t *testing.T) {
+	mq := NewMQ()
+	workerObject := worker.NewWorker()
+	workerObject.Types = []string{"GET_USER_PROFILE"}
+	mq.indexWorkerTypes(1, workerObject)
+
+	for queue, label := range map[string]string{
+		"$tea.worker.register": "$tea.worker.register",
+		"GET_USER_PROFILE":     "GET_USER_PROFILE",
+		"user.1":               "other",
+		"random.queue.12345":   "other",
+	} {
+		if mq.queueLabel(queue) != label {
+			t.Fatalf("label of '%s' should be '%s', got '%s'", queue, label, mq.queueLabel(queue))
+		}
+	}
+
+	mq.unindexWorkerTypes(1, workerObject)
+	if mq.queueLabel("GET_USER_PROFILE") != "other" {
+		t.Fatal("queue should not be a label after worker removed")
+	}
+}
+
+func TestMQ_Metrics(t *testing.T) {
+	mq := NewMQ()
+	mq.countInbound(&message.Message{Queue: "user.1"})
+	mq.countOutbound(&message.Message{Queue: "user.2"})
+	mq.deadLetter(DeadLetterReasonNoWorker, &message.Message{Queue: "hello"})
+	for connectionId, depth := range map[int]int{1: 2, 2: 3} {
+		connection := NewConnection(nil)
+		for i := 0; i < depth; i ++ {
+			connection.Write([]byte("hello"))
+		}
+		mq.connections[connectionId] = connection
+	}
+
+	buffer := &bytes.Buffer{}
+	mq.metrics.registry.WriteText(buffer)
+	for _, line := range []string{
+		`teamq_messages_in_total{queue="other"} 1`,
+		`teamq_messages_out_total{queue="other"} 1`,
+		`teamq_routing_failures_total{reason="no_worker"} 1`,
+		`teamq_workers_registered 0`,
+		`teamq_connection_outbound_depth_max 3`,
+		`teamq_connection_outbound_depth_sum 5`,
+	} {
+		if !strings.Contains(buffer.String(), line+"\n") {
+			t.Fatal("metrics should contain '" + line + "'")
+		}
+	}
+}
@@ -2,8 +2,7 @@ package mq
 
 import (
 	"io/ioutil"
-	"log"
-	"github.com/go-yaml/yaml"
+	"github.com/iwind/TeaMQ/logs"
 	"github.com/iwind/TeaMQ/nets"
 	"fmt"
 	"sync"
@@ -15,6 +14,11 @@ import (
 	"strings"
 	"encoding/json"
 	"github.com/iwind/TeaMQ/worker"
+	"time"
+	"sort"
+	"net"
+	"errors"
+	"context"
 )
 
 type MQ struct {
@@ -22,8 +26,34 @@ type MQ struct {
 	subscriberQueues map[string]map[int]int // { Queue1: [ ConnectionID1:1, ConnectionID2:1, ... ], ... }
 	users            map[int64]map[int]int  // { UserId1: [ ConnectionID1:1, ... ] }
 	workers          map[int]*worker.Worker // { ConnectionID: Work1, ... }
+	types            map[string]map[int]int // { MessageType: { ConnectionID1:1, ... }, ... }
 
-	config *Config
+	pendingMessages map[string]*pendingQueue // { WorkerID: Queue, ... }
+	resumeTimers    map[string]*time.Timer                 // { WorkerID: Timer, ... }
+
+	deadLetters *DeadLetterQueue
+	scheduler   *Scheduler
+	rateLimiter *RateLimiter
+
+	server        *nets.Server
+	listener      net.Listener // 不为nil时使用此监听器接受连接，而不监听Bind和Port
+	cluster       *Cluster     // 没有开启集群时为nil
+	adminListener net.Listener // 没有开启管理API时为nil
+	adminServer   *http.Server
+
+	metrics         *mqMetrics
+	metricsListener net.Listener // 没有开启指标接口时为nil
+	metricsServer   *http.Server
+
+	config       *Config
+	configMutex  *sync.RWMutex // 重新加载配置时替换config
+	onLoadConfig func(*Config) // 从文件中读取配置后调用，如使用命令行参数覆盖配置
+
+	done           chan bool // 开始关闭时关闭此通道，后台任务随之退出
+	stopped        chan bool // 关闭完成后关闭此通道
+	isStarted      bool
+	isShuttingDown bool
+	listenErr      error
 
 	mutex   *sync.Mutex
 	idIndex int
@@ -34,23 +64,114 @@ type MQ struct {
 type Config struct {
 	Bind string
 	Port int
-	Keys []string
+	Keys []string // 明文密钥或 HashKey() 生成的哈希
 	Auth struct {
 		On  bool
 		API string
 	}
+
+	// 带有限制的密钥，和Keys一起生效
+	WorkerKeys []WorkerKey `yaml:"workerKeys"`
+
+	// worker心跳设置，Interval为0时不检查心跳
+	Heartbeat struct {
+		Interval  int `yaml:"interval"`  // 心跳间隔，单位为ms（毫秒）
+		MaxMisses int `yaml:"maxMisses"` // 连续丢失多少次心跳后移除worker
+	}
+
+	// worker用户范围设置
+	Workers struct {
+		Overlap        string `yaml:"overlap"`        // 用户范围重叠时的处理方式：reject - 拒绝注册，replica - 作为副本一起分担消息
+		Strict         bool   `yaml:"strict"`         // 严格模式下，没有worker负责的用户发送的消息会被拒绝，而不是随机发给一个worker
+		MaxPending     int    `yaml:"maxPending"`     // 每个worker最多等待确认的消息数，超出后最早的消息被放入死信队列，为0时使用默认值10000
+		PendingTimeout int    `yaml:"pendingTimeout"` // 等待worker确认的最长时间，单位为秒，超时的消息被放入死信队列，为0时使用默认值600
+	}
+
+	// 死信队列设置
+	DeadLetters struct {
+		MaxSize int `yaml:"maxSize"` // 最多保存的消息数，超出后丢弃最早的消息
+	} `yaml:"deadLetters"`
+
+	// 定时投递设置
+	Scheduler struct {
+		Store               string `yaml:"store"`               // 保存未投递消息的文件，为空时不保存
+		MaxPending          int    `yaml:"maxPending"`          // 最多等待投递的消息数，为0时为100000
+		MaxPendingPerSender int    `yaml:"maxPendingPerSender"` // 每个发送者（用户、连接或worker）最多等待投递的消息数，为0时为1000
+	}
+
+	// 消息有效期设置
+	TTL struct {
+		Queues map[string]float64 `yaml:"queues"` // { QueuePattern: Seconds, ... }，支持*等通配符
+		Action string             `yaml:"action"` // 过期后的处理方式：drop - 丢弃，deadletter - 放入死信队列
+	} `yaml:"ttl"`
+
+	// 客户端限速设置，worker的限速由其注册时的maxMessagesPerSecond决定
+	RateLimit struct {
+		User       RateLimitRule            `yaml:"user"`       // 每个已认证用户
+		Connection RateLimitRule            `yaml:"connection"` // 每个连接
+		Queues     map[string]RateLimitRule `yaml:"queues"`     // { QueuePattern: Rule, ... }，同一队列的所有消息共享额度
+		Action     string                   `yaml:"action"`     // 超出限制时的处理方式：reject - 拒绝，delay - 延迟处理，disconnect - 断开连接
+		MaxDelay   int                      `yaml:"maxDelay"`   // 延迟处理的最长时间，单位为ms（毫秒），超过后拒绝
+	} `yaml:"rateLimit"`
+
+	// 收到消息时的限制，为0时使用默认值
+	Limits struct {
+		MaxFrameSize   int `yaml:"maxFrameSize"`   // 单条消息的最大字节数，超出后断开连接
+		MaxBodyDepth   int `yaml:"maxBodyDepth"`   // 消息体的最大嵌套深度
+		MaxBodyKeys    int `yaml:"maxBodyKeys"`    // 消息体中最多的键数，包括嵌套的键
+		MaxQueueLength int `yaml:"maxQueueLength"` // 队列名称的最大长度
+	} `yaml:"limits"`
+
+	// 集群设置，Bind为空时不开启集群
+	Cluster struct {
+		Id             string   `yaml:"id"`             // 节点ID，为空时自动生成
+		Bind           string   `yaml:"bind"`           // 接收其他节点连接的地址，如 0.0.0.0:7778
+		Peers          []string `yaml:"peers"`          // 其他节点的地址
+		Key            string   `yaml:"key"`            // 节点之间认证用的Key，所有节点必须一致
+		GossipInterval int      `yaml:"gossipInterval"` // 同步状态的间隔，单位为ms（毫秒）
+	} `yaml:"cluster"`
+
+	// 管理API设置，Bind为空时不开启
+	Admin struct {
+		Bind  string `yaml:"bind"`  // 监听地址，如 127.0.0.1:7779
+		Token string `yaml:"token"` // 访问令牌，不能为空
+	} `yaml:"admin"`
+
+	// 日志设置
+	Log logs.Config `yaml:"log"`
+
+	// 指标接口设置，Bind为空时不开启，指标在 /metrics 中以Prometheus文本格式输出
+	Metrics struct {
+		Bind string `yaml:"bind"` // 监听地址，如 127.0.0.1:7780
+	} `yaml:"metrics"`
 }
 
+const (
+	OverlapReject  = "reject"
+	OverlapReplica = "replica"
+)
+
 func NewMQ() *MQ {
 	mq := &MQ{
 		connections:      map[int]*Connection{},
 		subscriberQueues: map[string]map[int]int{},
 		users:            map[int64]map[int]int{},
 		workers:          map[int]*worker.Worker{},
+		types:            map[string]map[int]int{},
+		pendingMessages:  map[string]*pendingQueue{},
+		resumeTimers:     map[string]*time.Timer{},
+		deadLetters:      NewDeadLetterQueue(defaultDeadLetterQueueSize),
+		scheduler:        NewScheduler(),
+		rateLimiter:      NewRateLimiter(),
+		config:           &Config{},
+		configMutex:      &sync.RWMutex{},
 		mutex:            &sync.Mutex{},
 		idIndex:          0,
 		messageHandlers:  map[string]func(message *message.Message, connection *Connection){},
+		done:             make(chan bool),
+		stopped:          make(chan bool),
 	}
+	mq.metrics = newMQMetrics(mq)
 
 	// 处理内置queue
 	mq.Handle("$tea.subscribe.queue", func(message *message.Message, connection *Connection) {
@@ -59,56 +180,72 @@ func NewMQ() *MQ {
 
 		queue, _ := message.StringForKey("queue")
 		if len(queue) > 0 {
+			err := mq.validateQueue(queue)
+			if err != nil {
+				connection.ResponseError(message, NewError(ErrorCodeInvalidQueue, err.Error()))
+				return
+			}
+
 			if !connection.IsSubscribedQueue(queue) {
 				if _, found := mq.subscriberQueues[queue]; !found {
 					mq.subscriberQueues[queue] = map[int]int{}
 				}
 				mq.subscriberQueues[queue][connection.Id()] = 1
 				connection.SubscribeQueue(queue)
-				connection.ResponseSuccess("ok")
 			}
+
+			// 返回当前订阅的所有queue
+			queues := connection.Queues()
+			sort.Strings(queues)
+			connection.ResponseSuccess(message, "ok", map[string]interface{}{
+				"queues": queues,
+			})
 		} else {
-			connection.ResponseError("'queue' must not be empty\n")
+			connection.ResponseError(message, NewError(ErrorCodeInvalidMessage, "'queue' must not be empty"))
 		}
 	})
 
 	// 退出当前连接
 	mq.Handle("$tea.connection.quit", func(message *message.Message, connection *Connection) {
-		connection.Close()
+		connection.CloseAfterWriting()
 	})
 
 	// 认证
 	mq.Handle("$tea.connection.auth", func(message *message.Message, connection *Connection) {
-		if !mq.config.Auth.On {
-			connection.ResponseError("MQ did not open the authentication")
+		if !mq.currentConfig().Auth.On {
+			connection.ResponseError(message, NewError(ErrorCodeForbidden, "MQ did not open the authentication"))
 			return
 		}
 
 		token, _ := message.StringForKey("token")
 		if len(token) == 0 {
-			connection.ResponseError("Need 'body.token' to be a valid string value")
+			connection.ResponseError(message, NewError(ErrorCodeInvalidMessage, "Need 'body.token' to be a valid string value"))
 			return
 		}
 
 		params := &url.Values{}
 		params.Set("TEA_AUTH_TOKEN", token)
-		request, err := http.NewRequest(http.MethodPost, mq.config.Auth.API, strings.NewReader(params.Encode()))
+		request, err := http.NewRequest(http.MethodPost, mq.currentConfig().Auth.API, strings.NewReader(params.Encode()))
 		if err != nil {
-			connection.ResponseError(err.Error())
+			connection.ResponseError(message, ErrAuthFailed)
+			logs.Error("create auth request failed", logs.KeyConnectionId, connection.Id(), logs.KeyError, err)
+			return
 		}
 		request.Header.Add("Content-Type", "application/x-www-form-urlencoded")
 		client := &http.Client{}
+		startedAt := time.Now()
 		response, err := client.Do(request)
+		mq.observeAuthDuration(startedAt)
 		if err != nil {
-			connection.ResponseError("there has a error on authentication server")
-			log.Println("Error:" + err.Error())
+			connection.ResponseError(message, ErrAuthFailed)
+			logs.Error("request auth API failed", logs.KeyConnectionId, connection.Id(), logs.KeyError, err)
 			return
 		}
 
 		data, err := ioutil.ReadAll(response.Body)
 		if err != nil {
-			connection.ResponseError("there has a error on authentication server")
-			log.Println("Error:" + err.Error())
+			connection.ResponseError(message, ErrAuthFailed)
+			logs.Error("read auth response failed", logs.KeyConnectionId, connection.Id(), logs.KeyError, err)
 			return
 		}
 
@@ -119,22 +256,22 @@ func NewMQ() *MQ {
 		}{}
 		err = json.Unmarshal(data, responseJSON)
 		if err != nil {
-			connection.ResponseError("there has a error on authentication server")
-			log.Println("Error:" + err.Error())
+			connection.ResponseError(message, ErrAuthFailed)
+			logs.Error("decode auth response failed", logs.KeyConnectionId, connection.Id(), logs.KeyError, err)
 			return
 		}
 
 		if responseJSON.Code == 200 {
 			if responseJSON.Data == nil {
-				connection.ResponseError("there has a error on authentication server")
-				log.Println("Error:" + "'data' should be in valid format")
+				connection.ResponseError(message, ErrAuthFailed)
+				logs.Error("auth response 'data' should be in valid format", logs.KeyConnectionId, connection.Id())
 				return
 			}
 
 			userId, found := responseJSON.Data["userId"]
 			if !found {
-				connection.ResponseError("there has a error on authentication server")
-				log.Println("Error:" + "'data.userId' should be in valid format")
+				connection.ResponseError(message, ErrAuthFailed)
+				logs.Error("auth response 'data.userId' should be in valid format", logs.KeyConnectionId, connection.Id())
 				return
 			}
 
@@ -144,8 +281,8 @@ func NewMQ() *MQ {
 				userIdString := strings.TrimSpace(newUserId)
 				userIdInt, err := strconv.Atoi(userIdString)
 				if err != nil {
-					connection.ResponseError("there has a error on authentication server")
-					log.Println("Error:" + "'data.userId' should not be a integer number")
+					connection.ResponseError(message, ErrAuthFailed)
+					logs.Error("auth response 'data.userId' should be a integer number", logs.KeyConnectionId, connection.Id())
 					return
 				}
 				realUserId = int64(userIdInt)
@@ -165,44 +302,48 @@ func NewMQ() *MQ {
 				}
 			}
 
-			log.Printf("register:%d\n", realUserId)
-			connection.setUserId(realUserId)
+			logs.Info("authenticate user", logs.KeyConnectionId, connection.Id(), logs.KeyUserId, realUserId)
 
-			// 记录到users中
+			// 记录到users中，需要持有mq.mutex，因为管理接口、集群同步和连接关闭时会在其他goroutine中读写
+			mq.mutex.Lock()
+			if _, found := mq.connections[connection.Id()]; !found {
+				mq.mutex.Unlock()
+				return
+			}
+			mq.removeUserConnection(connection)
+			connection.setUserId(realUserId)
 			userConnections, found := mq.users[realUserId]
 			if !found {
 				userConnections = map[int]int{}
 				mq.users[realUserId] = userConnections
 			}
-			mq.users[realUserId][connection.Id()] = 1
+			userConnections[connection.Id()] = 1
+			mq.mutex.Unlock()
 
-			connection.ResponseSuccess("ok")
+			connection.ResponseSuccess(message, "ok", map[string]interface{}{
+				"userId": realUserId,
+			})
 
 			return
 		}
-		connection.ResponseError("there has a error on authentication server")
-		log.Println("Error: authenticate server returns a wrong json format:" + string(data))
+		connection.ResponseError(message, ErrAuthFailed)
+		logs.Error("auth API returns a wrong json format", logs.KeyConnectionId, connection.Id(), logs.KeyBody, string(data))
 	})
 
 	// 注册Worker
 	mq.Handle("$tea.worker.register", func(message *message.Message, connection *Connection) {
-		log.Println("Register new worker")
+		logs.Info("register new worker", logs.KeyConnectionId, connection.Id())
 
 		// 检查Key
 		key := message.StringForKeyDefault("key", "")
 		if len(key) == 0 {
-			connection.ResponseError("Register failed, key must be specified")
+			connection.ResponseError(message, NewError(ErrorCodeAuthRequired, "Register failed, key must be specified"))
 			return
 		}
-		found := false
-		for _, savedKey := range mq.config.Keys {
-			if savedKey == key {
-				found = true
-				break
-			}
-		}
-		if !found {
-			connection.ResponseError("Register failed, key '" + key + "' is invalid")
+		workerKey := mq.currentConfig().matchWorkerKey(key, time.Now())
+		if workerKey == nil {
+			logs.Warn("register worker with invalid key", logs.KeyConnectionId, connection.Id())
+			connection.ResponseError(message, NewError(ErrorCodeAuthFailed, "Register failed, key is invalid or expired"))
 			return
 		}
 
@@ -213,7 +354,14 @@ func NewMQ() *MQ {
 		workerObject.Id = message.StringForKeyDefault("id", "")
 		workerObject.Name = message.StringForKeyDefault("name", "")
 		workerObject.Description = message.StringForKeyDefault("description", "")
-		workerObject.Key = message.StringForKeyDefault("key", "")
+		workerObject.Key = workerKey.Id()
+		workerObject.IsBackup, _ = message.ValueForKey("backup").(bool)
+		if maxMessagesPerSecond, ok := message.ValueForKey("maxMessagesPerSecond").(float64); ok && maxMessagesPerSecond > 0 {
+			workerObject.MaxMessagesPerSecond = int(maxMessagesPerSecond)
+		}
+
+		workerObject.Tags, _ = message.StringsForKey("tags")
+		workerObject.Types, _ = message.StringsForKey("types")
 
 		userMap, found := message.MapForKey("user")
 		if found {
@@ -234,41 +382,214 @@ func NewMQ() *MQ {
 			}
 		}
 
+		workerObject.IsOnline = true
+		workerObject.IsAvailable = true
+		workerObject.Health = 100
+		workerObject.HeartbeatAt = time.Now()
+
+		err := workerKey.Allows(workerObject)
+		if err != nil {
+			logs.Warn("register worker not allowed by key", logs.KeyWorkerId, workerObject.Id, logs.KeyConnectionId, connection.Id(), logs.KeyError, err)
+			connection.ResponseError(message, NewError(ErrorCodeForbidden, "Register failed, "+err.Error()))
+			return
+		}
+
+		err = mq.validateWorkerRange(connection.Id(), workerObject)
+		if err != nil {
+			connection.ResponseError(message, NewError(ErrorCodeInvalidMessage, "Register failed, "+err.Error()))
+			return
+		}
+
+		if oldWorker, found := mq.workers[connection.Id()]; found {
+			mq.unindexWorkerTypes(connection.Id(), oldWorker)
+		}
 		mq.workers[connection.Id()] = workerObject
+		mq.indexWorkerTypes(connection.Id(), workerObject)
+		connection.SetWorker(true)
+
+		connection.ResponseSuccess(message, "ok", nil)
+		mq.logUncoveredUserRanges()
+
+		// 恢复断开连接前未完成的消息
+		mq.resumePendingMessages(workerObject.Id, connection)
+	})
+
+	// worker心跳
+	mq.Handle("$tea.worker.heartbeat", mq.handleWorkerHeartbeat)
+
+	// worker准备下线
+	mq.Handle("$tea.worker.drain", mq.handleWorkerDrain)
 
-		connection.ResponseSuccess("ok")
+	// 死信队列
+	mq.Handle("$tea.admin.deadletters", mq.handleListDeadLetters)
+	mq.Handle("$tea.admin.deadletters.replay", mq.handleReplayDeadLetters)
+
+	// 限速计数
+	mq.Handle("$tea.admin.ratelimits", mq.handleListRateLimits)
+
+	// 取消定时投递的消息
+	mq.Handle("$tea.message.cancel", mq.handleCancelMessage)
+
+	// 客户端检测连接是否可用
+	mq.Handle("$tea.connection.ping", func(message *message.Message, connection *Connection) {
+		connection.ResponseSuccess(message, "pong", nil)
 	})
 
+	// worker处理完消息
+	mq.Handle("$tea.worker.ack", func(message *message.Message, connection *Connection) {
+		mq.mutex.Lock()
+		defer mq.mutex.Unlock()
+
+		workerObject, found := mq.workers[connection.Id()]
+		if !found {
+			connection.ResponseError(message, ErrNotWorker)
+			return
+		}
+
+		id := message.StringForKeyDefault("id", "")
+		fromConnectionId, _ := message.ValueForKey("fromConnectionId").(float64)
+		mq.removePendingMessage(workerObject.Id, pendingMessageKey(int(fromConnectionId), id))
+	})
+
+	return mq
+}
+
+// 使用配置创建MQ，之后调用Start()开始监听
+func NewMQWithConfig(config *Config) *MQ {
+	mq := NewMQ()
+	if config != nil {
+		mq.config = config
+	}
 	return mq
 }
 
-func (mq *MQ) StartWithConfig(configFile string) {
-	configBytes, err := ioutil.ReadFile(configFile)
+// 读取配置文件并开始监听，配置文件修改后自动重新加载，阻塞直到MQ关闭
+func (mq *MQ) StartWithConfig(configFile string) error {
+	config, err := LoadConfig(configFile)
 	if err != nil {
-		log.Println("Failed to start:" + err.Error())
-		return
+		logs.Error("failed to start", logs.KeyError, err)
+		return err
+	}
+	mq.setConfig(config)
+
+	err = mq.Start()
+	if err != nil {
+		logs.Error("failed to start", logs.KeyError, err)
+		return err
+	}
+	mq.WatchConfigFile(configFile, 0)
+	return mq.Wait()
+}
+
+// 使用创建时的配置开始监听，不阻塞，端口为0时自动分配，实际监听的地址可以通过Addr()取得
+func (mq *MQ) Start() error {
+	mq.mutex.Lock()
+	if mq.isStarted || mq.isShuttingDown {
+		mq.mutex.Unlock()
+		return errors.New("MQ can not be started twice")
 	}
+	mq.isStarted = true
+	mq.mutex.Unlock()
 
-	config := &Config{}
-	yaml.Unmarshal(configBytes, config)
+	config := mq.currentConfig()
+	err := config.Validate()
+	if err != nil {
+		mq.Shutdown(context.Background())
+		return err
+	}
+	if len(config.Keys) == 0 && len(config.WorkerKeys) == 0 {
+		logs.Warn("no keys configured, workers can not register")
+	}
+
+	err = mq.listen(config)
+	if err != nil {
+		// 释放已经打开的端口
+		mq.Shutdown(context.Background())
+		return err
+	}
 
-	mq.config = config
+	go func() {
+		err := mq.server.Listen()
+		if err != nil {
+			logs.Error("listen failed", logs.KeyError, err)
+
+			mq.mutex.Lock()
+			mq.listenErr = err
+			mq.mutex.Unlock()
+			mq.Shutdown(context.Background())
+		}
+	}()
+
+	logs.Info("MQ listen", "addr", mq.Addr().String())
+	return nil
+}
+
+// 设置接受连接的监听器，如内存监听器，需要在Start()之前调用，设置后不再监听Bind和Port
+func (mq *MQ) SetListener(listener net.Listener) {
+	mq.listener = listener
+}
+
+// 实际监听的地址，在Start()之后才有值
+func (mq *MQ) Addr() net.Addr {
+	if mq.server == nil {
+		return nil
+	}
+	return mq.server.Addr()
+}
+
+// 等待MQ关闭，因为监听出错而关闭时返回错误
+func (mq *MQ) Wait() error {
+	<-mq.stopped
+
+	mq.mutex.Lock()
+	defer mq.mutex.Unlock()
+	return mq.listenErr
+}
+
+// 使用配置开始监听，不阻塞，需要调用mq.server.Listen()接受连接
+func (mq *MQ) listen(config *Config) error {
+	err := logs.Configure(config.Log)
+	if err != nil {
+		return err
+	}
+
+	mq.setConfig(config)
+	if config.DeadLetters.MaxSize > 0 {
+		mq.deadLetters.SetMaxSize(config.DeadLetters.MaxSize)
+	}
 
 	server := nets.NewServer("tcp", fmt.Sprintf("%s:%d", config.Bind, config.Port))
+	if mq.listener != nil {
+		server.SetListener(mq.listener)
+	}
+	server.SetMaxFrameSize(mq.maxFrameSize())
+	server.ErrorClient(mq.handleReadError)
 	server.AcceptClient(func(client *nets.Client) {
 		mq.mutex.Lock()
 		defer mq.mutex.Unlock()
 
+		// 开始关闭后才接受的连接不会收到关闭通知，直接关闭
+		if mq.isShuttingDown {
+			client.Close()
+			return
+		}
+
 		mq.idIndex ++
 		client.SetId(mq.idIndex)
 
 		connection := NewConnection(client)
+		connection.OnExpire(mq.expireOutbound)
+		connection.OnWrite(mq.countOutbound)
 		mq.connections[client.Id()] = connection
+		go connection.StartWriting()
+
+		mq.metrics.connectionsAccepted.Inc()
+		mq.metrics.connectionsOpen.Inc()
 
-		log.Printf("Accept new connection %d\n", client.Id())
+		logs.Info("accept new connection", logs.KeyConnectionId, client.Id())
 
 		//@TODO 30秒内没有认证自动关闭
-		if mq.config.Auth.On {
+		if mq.currentConfig().Auth.On {
 
 		}
 	})
@@ -282,10 +603,14 @@ func (mq *MQ) StartWithConfig(configFile string) {
 			return
 		}
 
-		log.Println("quit connection " + strconv.Itoa(connectionId))
+		logs.Info("quit connection", logs.KeyConnectionId, connectionId)
 
-		// 从连接列表中删除
+		// 从连接列表中删除，并停止发送
 		delete(mq.connections, connectionId)
+		connection.Close()
+		mq.metrics.connectionsClosed.Inc()
+		mq.metrics.connectionsOpen.Dec()
+		mq.rateLimiter.Remove(connectionRateLimitKey(connectionId))
 
 		// 从queues中删除
 		for _, queue := range connection.Queues() {
@@ -297,22 +622,22 @@ func (mq *MQ) StartWithConfig(configFile string) {
 		}
 
 		// 从用户列表中删除
-		userId := connection.userId
-		if userId > 0 {
-			connectionIds, found := mq.users[userId]
-			if found {
-				delete(connectionIds, connectionId)
-				if len(connectionIds) == 0 {
-					log.Printf("Remove user %d\n", userId)
-					delete(mq.users, userId)
-				}
-			}
-		}
+		mq.removeUserConnection(connection)
 
 		// 从workers中删除
-		if _, ok := mq.workers[connectionId]; ok {
-			log.Println("Remove worker " + strconv.Itoa(connectionId))
+		if workerObject, ok := mq.workers[connectionId]; ok {
+			logs.Info("remove worker", logs.KeyWorkerId, workerObject.Id, logs.KeyConnectionId, connectionId)
 			delete(mq.workers, connectionId)
+			mq.unindexWorkerTypes(connectionId, workerObject)
+			mq.rateLimiter.Remove(workerRateLimitKey(connectionId))
+			mq.logUncoveredUserRanges()
+
+			mq.waitWorkerResume(workerObject.Id)
+		}
+
+		// 通知为此连接创建过代理的节点
+		if mq.cluster != nil {
+			mq.cluster.connectionClosed(connectionId)
 		}
 	})
 	server.ReceiveClient(func(client *nets.Client, data []byte) {
@@ -320,96 +645,347 @@ func (mq *MQ) StartWithConfig(configFile string) {
 			return
 		}
 
+		mq.mutex.Lock()
 		connection, found := mq.connections[client.Id()]
+		mq.mutex.Unlock()
 		if !found {
 			return
 		}
+		connection.addBytesIn(len(data) + 1)
 
 		messageObject, err := message.Unmarshal(data)
 		if err != nil {
-			connection.ResponseError(err.Error())
+			connection.ResponseError(nil, NewError(ErrorCodeInvalidMessage, err.Error()))
+			return
+		}
+		err = mq.validateIngress(messageObject)
+		if err != nil {
+			connection.ResponseError(messageObject, err)
 			return
 		}
 
 		// 判断是否已认证
-		if mq.config.Auth.On && messageObject.Queue != "$tea.connection.auth" && messageObject.Queue != "$tea.worker.register" {
-			connection.ResponseError("The connection need authenticate")
+		if mq.currentConfig().Auth.On && !connection.IsAuthenticated() && !connection.IsWorker() && messageObject.Queue != "$tea.connection.auth" && messageObject.Queue != "$tea.worker.register" && messageObject.Queue != "$tea.connection.ping" {
+			connection.ResponseError(messageObject, ErrAuthRequired)
 			return
 		}
 
-		if len(messageObject.Queue) > 0 {
-			// 是否为内置queue
-			handler, found := mq.messageHandlers[messageObject.Queue]
-			if found {
-				handler(messageObject, connection)
-			} else {
-				// 非内置queue
-				// 如果是来自worker，则直接发送到用户端
-				if connection.isWorker {
-					messageObject.Pattern = messageObject.Queue
-
-					// 支持具体的queue，如user.1
-					connections, found := mq.subscriberQueues[messageObject.Queue]
-					if found && len(connections) > 0 {
-						for connectionId := range connections {
-							data, err := messageObject.Encode()
-							if err != nil {
-								log.Println("Error:" + err.Error())
-							} else {
-								mq.connections[connectionId].Write(data)
-							}
-						}
-					}
-
-					// @TODO 支持更宽泛的订阅queue，如user.*, user.[1:1000000]
-				} else {
-					log.Println("receive " + string(data))
-
-					// 如果来自用户端，则转发到worker
-					selectedConnectionId := 0
-					if messageObject.FromUserId() > 0 && len(mq.workers) > 0 {
-						for workerConnectionId, workerObject := range mq.workers {
-							if workerObject.User.Min <= messageObject.FromUserId() && workerObject.User.Max >= messageObject.FromUserId() {
-								selectedConnectionId = workerConnectionId
-							}
-						}
-					}
-					if selectedConnectionId == 0 && len(mq.workers) > 0 {
-						// 随机选一个
-						for id := range mq.workers {
-							selectedConnectionId = id
-							break
-						}
-					}
-
-					if selectedConnectionId == 0 {
-						log.Println("Error:There is not worker for the message")
-					} else {
-						connection, found := mq.connections[selectedConnectionId]
-						if found {
-							data, err := messageObject.Encode()
-							if err != nil {
-								log.Println("Error:" + err.Error())
-							} else {
-								connection.Write(data)
-							}
-						}
-					}
-				}
+		// 校验和认证之后再计数
+		mq.countInbound(messageObject)
 
+		// 客户端限速，延迟处理的消息在等待后再处理，之后的消息排在其后以保持顺序
+		if !connection.IsWorker() {
+			wait, ok := mq.limitClientMessage(messageObject, connection)
+			if !ok {
+				return
 			}
+			if wait > 0 || connection.HasDelayed() {
+				dataString := string(data)
+				err := connection.Delay(wait, func() {
+					mq.receive(messageObject, connection, dataString)
+				})
+				if err != nil {
+					connection.ResponseError(messageObject, NewError(ErrorCodeRateLimited, err.Error()))
+				}
+				return
+			}
+		}
+
+		mq.receive(messageObject, connection, string(data))
+	})
+
+	err = server.Bind()
+	if err != nil {
+		return err
+	}
+	mq.server = server
+
+	if config.Heartbeat.Interval > 0 {
+		go mq.checkWorkerHeartbeats()
+	}
+
+	mq.scheduler.SetLimits(config.Scheduler.MaxPending, config.Scheduler.MaxPendingPerSender)
+	if len(config.Scheduler.Store) > 0 {
+		err = mq.scheduler.Load(config.Scheduler.Store)
+		if err != nil {
+			logs.Error("load scheduled messages failed", "file", config.Scheduler.Store, logs.KeyError, err)
+		}
+	}
+	mq.scheduler.OnDue(func(scheduledMessage *ScheduledMessage) {
+		mq.route(scheduledMessage.Message, scheduledMessage.FromWorker)
+	})
+	go mq.scheduler.Start()
+
+	if len(config.Cluster.Bind) > 0 {
+		mq.cluster = NewCluster(mq, config)
+		err = mq.cluster.Start(config.Cluster.Peers)
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(config.Admin.Bind) > 0 {
+		err = mq.listenAdmin(config.Admin.Bind, config.Admin.Token)
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(config.Metrics.Bind) > 0 {
+		err = mq.listenMetrics(config.Metrics.Bind)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// 从连接当前的用户中删除连接，用户没有其他连接时删除用户，调用者需持有mq.mutex
+func (mq *MQ) removeUserConnection(connection *Connection) {
+	userId := connection.userId
+	if userId <= 0 {
+		return
+	}
+	connectionIds, found := mq.users[userId]
+	if !found {
+		return
+	}
+	delete(connectionIds, connection.Id())
+	if len(connectionIds) == 0 {
+		logs.Info("remove user", logs.KeyUserId, userId)
+		delete(mq.users, userId)
+		mq.rateLimiter.Release(userRateLimitKey(userId))
+	}
+}
+
+// 处理收到的消息
+func (mq *MQ) receive(messageObject *message.Message, connection *Connection, data string) {
+	if len(messageObject.Queue) > 0 {
+		// 是否为内置queue
+		handler, found := mq.messageHandlers[messageObject.Queue]
+		if found {
+			handler(messageObject, connection)
 		} else {
-			log.Println("Error:Message must has a 'queue'")
-			connection.ResponseError("Message must has a 'queue'")
+			// 非内置queue
+			if connection.isWorker {
+				messageObject.Pattern = messageObject.Queue
+			} else {
+				logs.Debug("receive message", logs.KeyConnectionId, connection.Id(), logs.KeyQueue, messageObject.Queue, logs.KeyMessageId, messageObject.Id(), logs.KeyBody, data)
+
+				// 记录发送者，以便worker回复，并忽略客户端伪造的发送者和目标，未认证的连接用户ID为0
+				messageObject.SetFromConnectionId(connection.Id())
+				messageObject.SetFromUserId(connection.UserId())
+				messageObject.ClearTarget()
+			}
+
+			// 定时消息
+			if messageObject.IsScheduled() {
+				mq.scheduleMessage(messageObject, connection)
+				return
+			}
+
+			mq.route(messageObject, connection.isWorker)
+		}
+	} else {
+		logs.Warn("message must has a 'queue'", logs.KeyConnectionId, connection.Id())
+		connection.ResponseError(messageObject, NewError(ErrorCodeInvalidMessage, "Message must has a 'queue'"))
+		return
+	}
+}
+
+// 投递非内置queue的消息
+func (mq *MQ) route(messageObject *message.Message, fromWorker bool) {
+	// 如果是来自worker，则直接发送到用户端
+	if fromWorker {
+		// 回复给指定的连接
+		if messageObject.ToConnectionId() > 0 {
+			mq.replyToConnection(messageObject)
 			return
 		}
-	})
-	server.Listen()
+
+		// 发送给指定用户的所有连接
+		if messageObject.ToUserId() > 0 {
+			mq.sendToUser(messageObject)
+			return
+		}
+
+		mq.publish(messageObject)
+		return
+	}
+
+	// 如果来自用户端，则转发到worker
+	mq.dispatchToWorker(messageObject)
 }
 
-func (mq *MQ) Start() {
-	configFile := "conf/mq.conf"
-	mq.StartWithConfig(configFile)
+// 发送消息给订阅了对应queue的连接，包括集群中其他节点上的连接
+func (mq *MQ) publish(messageObject *message.Message) {
+	if mq.cluster != nil && !mq.isExpired(messageObject, time.Now()) {
+		mq.cluster.publish(messageObject)
+	}
+	mq.publishLocal(messageObject)
+}
+
+// 发送消息给本节点上订阅了对应queue的连接
+func (mq *MQ) publishLocal(messageObject *message.Message) {
+	mq.mutex.Lock()
+	defer mq.mutex.Unlock()
+
+	// 支持具体的queue，如user.1
+	connections, found := mq.subscriberQueues[messageObject.Queue]
+	if found && len(connections) > 0 {
+		expiresAt := mq.expiresAt(messageObject)
+		if !expiresAt.IsZero() && time.Now().After(expiresAt) {
+			mq.expire(messageObject)
+			return
+		}
+
+		data, err := messageObject.Encode()
+		if err != nil {
+			logs.Error("encode message failed", logs.KeyQueue, messageObject.Queue, logs.KeyMessageId, messageObject.Id(), logs.KeyError, err)
+			mq.deadLetter(DeadLetterReasonEncodeFailed, messageObject)
+			return
+		}
+		for connectionId := range connections {
+			err = mq.connections[connectionId].enqueue(&outboundData{
+				data:      data,
+				message:   messageObject,
+				expiresAt: expiresAt,
+			})
+			if err != nil {
+				logs.Error("publish message failed", logs.KeyConnectionId, connectionId, logs.KeyQueue, messageObject.Queue, logs.KeyError, err)
+			}
+		}
+	}
+
+	// @TODO 支持更宽泛的订阅queue，如user.*, user.[1:1000000]
+}
+
+// 将来自用户端的消息转发到worker
+func (mq *MQ) dispatchToWorker(messageObject *message.Message) {
+	mq.mutex.Lock()
+	defer mq.mutex.Unlock()
+
+	if mq.isExpired(messageObject, time.Now()) {
+		mq.expire(messageObject)
+		return
+	}
+
+	selectedConnectionId := mq.selectWorker(messageObject)
+	if selectedConnectionId == 0 {
+		// 能处理的worker都已达到每秒最大消息数
+		limitedConnectionId := mq.selectWorkerWithRateLimits(messageObject, false)
+		if limitedConnectionId > 0 {
+			mq.waitWorkerRateLimit(messageObject, limitedConnectionId)
+			return
+		}
+
+		// 转发给集群中有worker的节点，来自其他节点的消息不再转发，以免循环
+		fromConnection, found := mq.connections[messageObject.FromConnectionId()]
+		if mq.cluster != nil && (!found || !fromConnection.IsRemote()) && mq.cluster.dispatch(messageObject) {
+			return
+		}
+
+		mq.deadLetter(DeadLetterReasonNoWorker, messageObject)
+
+		errorMessage := "There is no worker for type '" + messageObject.Queue + "'"
+		if mq.currentConfig().Workers.Strict {
+			errorMessage += " and user " + strconv.FormatInt(messageObject.FromUserId(), 10)
+		}
+		logs.Warn("no worker for message", logs.KeyQueue, messageObject.Queue, logs.KeyUserId, messageObject.FromUserId(), logs.KeyConnectionId, messageObject.FromConnectionId())
+
+		// 通知发送消息的客户端
+		if found {
+			fromConnection.ResponseError(messageObject, NewError(ErrorCodeNoWorker, errorMessage))
+		}
+		return
+	}
+
+	connection, found := mq.connections[selectedConnectionId]
+	if !found {
+		mq.deadLetter(DeadLetterReasonConnectionClosed, messageObject)
+		return
+	}
+
+	mq.takeWorkerRateLimit(selectedConnectionId)
+
+	// 在下次心跳之前计入worker的负载，以免消息都转发给同一个worker
+	mq.workers[selectedConnectionId].InFlight ++
+
+	// 记录未完成的消息，以便worker重连后恢复，没有ID的worker无法恢复
+	workerId := mq.workers[selectedConnectionId].Id
+	mq.addPendingMessage(workerId, messageObject)
+
+	err := connection.WriteMessage(messageObject, mq.expiresAt(messageObject))
+	if err != nil {
+		logs.Error("dispatch message failed", logs.KeyWorkerId, workerId, logs.KeyConnectionId, selectedConnectionId, logs.KeyQueue, messageObject.Queue, logs.KeyError, err)
+		if len(workerId) == 0 {
+			mq.deadLetter(DeadLetterReasonConnectionClosed, messageObject)
+		}
+	}
+}
+
+// 将worker的回复发送给指定的连接
+func (mq *MQ) replyToConnection(messageObject *message.Message) {
+	mq.mutex.Lock()
+	targetConnection, found := mq.connections[messageObject.ToConnectionId()]
+	mq.mutex.Unlock()
+
+	if mq.isExpired(messageObject, time.Now()) {
+		mq.expire(messageObject)
+		return
+	}
+
+	if !found {
+		logs.Warn("the connection to reply is not found", logs.KeyConnectionId, messageObject.ToConnectionId(), logs.KeyQueue, messageObject.Queue)
+		mq.deadLetter(DeadLetterReasonConnectionClosed, messageObject)
+		return
+	}
+
+	err := targetConnection.WriteMessage(messageObject, mq.expiresAt(messageObject))
+	if err != nil {
+		logs.Error("reply message failed", logs.KeyConnectionId, messageObject.ToConnectionId(), logs.KeyQueue, messageObject.Queue, logs.KeyError, err)
+		mq.deadLetter(DeadLetterReasonConnectionClosed, messageObject)
+	}
+}
+
+// 将worker的消息发送给指定用户的所有连接，包括集群中其他节点上的连接
+func (mq *MQ) sendToUser(messageObject *message.Message) {
+	mq.mutex.Lock()
+	defer mq.mutex.Unlock()
+
+	if mq.isExpired(messageObject, time.Now()) {
+		mq.expire(messageObject)
+		return
+	}
+
+	count := mq.sendToLocalUser(messageObject)
+	if mq.cluster != nil && mq.cluster.sendToUser(messageObject) {
+		count ++
+	}
+	if count == 0 {
+		logs.Warn("user is not online", logs.KeyUserId, messageObject.ToUserId(), logs.KeyQueue, messageObject.Queue)
+		mq.deadLetter(DeadLetterReasonConnectionClosed, messageObject)
+	}
+}
+
+// 将消息发送给本节点上指定用户的所有连接，返回发送的连接数，调用者需持有mq.mutex
+func (mq *MQ) sendToLocalUser(messageObject *message.Message) int {
+	expiresAt := mq.expiresAt(messageObject)
+	count := 0
+	for connectionId := range mq.users[messageObject.ToUserId()] {
+		connection, found := mq.connections[connectionId]
+		if !found {
+			continue
+		}
+		err := connection.WriteMessage(messageObject, expiresAt)
+		if err != nil {
+			logs.Error("send message to user failed", logs.KeyUserId, messageObject.ToUserId(), logs.KeyConnectionId, connectionId, logs.KeyError, err)
+			continue
+		}
+		count ++
+	}
+	return count
 }
 
 func (mq *MQ) Handle(queue string, handler func(message *message.Message, connection *Connection)) {
@@ -4,6 +4,14 @@ import (
 	"testing"
 	"gopkg.in/yaml.v2"
 	"os"
+	"net"
+	"context"
+	"time"
+	"path/filepath"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
 )
 
 func TestMQ_Yaml(t *testing.T) {
@@ -24,6 +32,162 @@ func TestMQ_Yaml(t *testing.T) {
 }
 
 func TestMQ_Start(t *testing.T) {
-	projectDir, _ := os.LookupEnv("GOPATH")
-	NewMQ().StartWithConfig(projectDir + "/src/main/mq/conf/mq.conf")
+	config := &Config{
+		Bind: "127.0.0.1",
+	}
+	mq := startTestMQ(t, config)
+	if mq.Addr().(*net.TCPAddr).Port == 0 {
+		t.Fatal("port should be assigned")
+	}
+	if mq.Start() == nil {
+		t.Fatal("MQ should not be started twice")
+	}
+
+	client := dialTestNode(t, mq)
+	client.send(map[string]interface{}{
+		"queue": "$tea.connection.ping",
+	})
+	if response := client.read(); response["message"] != "pong" {
+		t.Fatal("unexpected response:", response)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err := mq.Shutdown(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = mq.Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	configFile := filepath.Join(os.TempDir(), "teamq-config-test.conf")
+	defer os.Remove(configFile)
+
+	err := ioutil.WriteFile(configFile, []byte("bind: 127.0.0.1\nport: [7777\n"), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = LoadConfig(configFile)
+	if err == nil {
+		t.Fatal("invalid yaml should be reported")
+	}
+
+	// 配置文件中的端口不能为0
+	err = ioutil.WriteFile(configFile, []byte("bind: 127.0.0.1\nport: 0\n"), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = LoadConfig(configFile)
+	if _, ok := err.(*ConfigError); !ok {
+		t.Fatal("port 0 in config file should be rejected, got:", err)
+	}
+
+	err = ioutil.WriteFile(configFile, []byte("bind: 127.0.0.1\nport: 7777\n"), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, err := LoadConfig(configFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Bind != "127.0.0.1" || config.Port != 7777 {
+		t.Fatal("unexpected config:", config.Bind, config.Port)
+	}
+}
+
+func TestMQ_Receive_FromUserId(t *testing.T) {
+	mq := startTestMQ(t, &Config{Bind: "127.0.0.1", Keys: []string{"k1"}})
+
+	workerClient := dialTestNode(t, mq)
+	workerClient.send(map[string]interface{}{
+		"queue": "$tea.worker.register",
+		"body": map[string]interface{}{
+			"key":   "k1",
+			"id":    "w1",
+			"types": []string{"hello"},
+			"user": map[string]interface{}{
+				"min": 1,
+				"max": 100,
+			},
+		},
+	})
+	if code := workerClient.read()["code"]; code != float64(200) {
+		t.Fatal("register failed:", code)
+	}
+
+	// 未认证的客户端不能伪造发送者
+	client := dialTestNode(t, mq)
+	client.send(map[string]interface{}{
+		"queue":      "hello",
+		"id":         "m1",
+		"fromUserId": 42,
+	})
+	dispatched := workerClient.read()
+	if dispatched["id"] != "m1" {
+		t.Fatal("unexpected dispatched message:", dispatched)
+	}
+	if fromUserId, _ := dispatched["fromUserId"].(float64); fromUserId != 0 {
+		t.Fatal("fromUserId of unauthenticated client should be 0, got", fromUserId)
+	}
+}
+
+func TestMQ_Auth(t *testing.T) {
+	authServer := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		writer.Write([]byte(`{"code": 200, "data": {"userId": "7"}}`))
+	}))
+	defer authServer.Close()
+
+	config := &Config{Bind: "127.0.0.1"}
+	config.Auth.On = true
+	config.Auth.API = authServer.URL
+	mq := startTestMQ(t, config)
+
+	// 认证的同时在其他goroutine中读取用户
+	done := make(chan bool)
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			mq.clusterState()
+		}
+	}()
+
+	wg := &sync.WaitGroup{}
+	clients := []*testClient{}
+	for i := 0; i < 5; i ++ {
+		clients = append(clients, dialTestNode(t, mq))
+	}
+	for _, client := range clients {
+		wg.Add(1)
+		go func(client *testClient) {
+			defer wg.Done()
+			client.send(map[string]interface{}{
+				"queue": "$tea.connection.auth",
+				"body": map[string]interface{}{
+					"token": "abc",
+				},
+			})
+		}(client)
+	}
+	wg.Wait()
+	for _, client := range clients {
+		if code := client.read()["code"]; code != float64(200) {
+			t.Fatal("auth failed:", code)
+		}
+	}
+	close(done)
+
+	mq.mutex.Lock()
+	count := len(mq.users[7])
+	mq.mutex.Unlock()
+	if count != 5 {
+		t.Fatal("all connections should be added to the user, got", count)
+	}
 }
@@ -0,0 +1,119 @@
+package mq
+
+import (
+	"github.com/iwind/TeaMQ/worker"
+	"fmt"
+	"math"
+	"sort"
+	"github.com/iwind/TeaMQ/logs"
+	"strings"
+)
+
+// 用户ID范围
+type UserRange struct {
+	Min int64
+	Max int64
+}
+
+func (userRange UserRange) String() string {
+	if userRange.Max == math.MaxInt64 {
+		return fmt.Sprintf("[%d, +∞)", userRange.Min)
+	}
+	return fmt.Sprintf("[%d, %d]", userRange.Min, userRange.Max)
+}
+
+// 校验worker的用户范围，调用者需持有mq.mutex
+func (mq *MQ) validateWorkerRange(connectionId int, workerObject *worker.Worker) error {
+	if workerObject.User.Min <= 0 || workerObject.User.Max <= 0 {
+		return fmt.Errorf("user range [%d, %d] is invalid, 'user.min' and 'user.max' should be greater than 0", workerObject.User.Min, workerObject.User.Max)
+	}
+	if workerObject.User.Min > workerObject.User.Max {
+		return fmt.Errorf("user range [%d, %d] is invalid, 'user.min' should not be greater than 'user.max'", workerObject.User.Min, workerObject.User.Max)
+	}
+
+	if mq.currentConfig().Workers.Overlap != OverlapReject || workerObject.IsBackup {
+		return nil
+	}
+
+	// 只有提供相同服务的worker之间才会争用用户范围，同一个worker重连时不算重叠
+	for otherConnectionId, otherWorker := range mq.workers {
+		if otherConnectionId == connectionId || otherWorker.IsBackup || otherWorker.IsDraining {
+			continue
+		}
+		if len(workerObject.Id) > 0 && otherWorker.Id == workerObject.Id {
+			continue
+		}
+		if !sameTags(workerObject.Tags, otherWorker.Tags) {
+			continue
+		}
+		if workerObject.OverlapsUsers(otherWorker) {
+			return fmt.Errorf("user range [%d, %d] overlaps with worker '%s' [%d, %d]", workerObject.User.Min, workerObject.User.Max, otherWorker.Id, otherWorker.User.Min, otherWorker.User.Max)
+		}
+	}
+	return nil
+}
+
+// 取得没有可用的非备用worker负责的用户范围
+func (mq *MQ) UncoveredUserRanges() []UserRange {
+	mq.mutex.Lock()
+	defer mq.mutex.Unlock()
+	return mq.uncoveredUserRanges()
+}
+
+// 调用者需持有mq.mutex
+func (mq *MQ) uncoveredUserRanges() []UserRange {
+	ranges := []UserRange{}
+	for _, workerObject := range mq.workers {
+		if !workerObject.IsAvailable || workerObject.IsBackup {
+			continue
+		}
+		ranges = append(ranges, UserRange{Min: workerObject.User.Min, Max: workerObject.User.Max})
+	}
+	sort.Slice(ranges, func(i, j int) bool {
+		return ranges[i].Min < ranges[j].Min
+	})
+
+	uncovered := []UserRange{}
+	next := int64(1) // 下一个尚未被覆盖的用户ID
+	for _, userRange := range ranges {
+		if userRange.Min > next {
+			uncovered = append(uncovered, UserRange{Min: next, Max: userRange.Min - 1})
+		}
+		if userRange.Max >= next {
+			if userRange.Max == math.MaxInt64 {
+				return uncovered
+			}
+			next = userRange.Max + 1
+		}
+	}
+	return append(uncovered, UserRange{Min: next, Max: math.MaxInt64})
+}
+
+// 在worker变化时输出没有worker负责的用户范围，都有worker负责时不输出，调用者需持有mq.mutex
+func (mq *MQ) logUncoveredUserRanges() {
+	uncovered := mq.uncoveredUserRanges()
+	if len(uncovered) == 0 {
+		return
+	}
+	descriptions := []string{}
+	for _, userRange := range uncovered {
+		descriptions = append(descriptions, userRange.String())
+	}
+	logs.Warn("uncovered user ranges", "ranges", strings.Join(descriptions, ", "))
+}
+
+func sameTags(tags1 []string, tags2 []string) bool {
+	if len(tags1) != len(tags2) {
+		return false
+	}
+	sorted1 := append([]string{}, tags1...)
+	sorted2 := append([]string{}, tags2...)
+	sort.Strings(sorted1)
+	sort.Strings(sorted2)
+	for index, tag := range sorted1 {
+		if sorted2[index] != tag {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,51 @@
+package mq
+
+import (
+	"testing"
+	"math"
+)
+
+func TestMQ_ValidateWorkerRange(t *testing.T) {
+	mq := NewMQ()
+	mq.config.Workers.Overlap = OverlapReject
+	mq.workers[1] = newTestWorker(1, 100)
+
+	for _, userRange := range []UserRange{{0, 0}, {200, 100}, {50, 150}} {
+		err := mq.validateWorkerRange(2, newTestWorker(userRange.Min, userRange.Max))
+		if err == nil {
+			t.Fatalf("range %s should be rejected", userRange)
+		}
+		t.Log(err)
+	}
+
+	if err := mq.validateWorkerRange(2, newTestWorker(101, 200)); err != nil {
+		t.Fatal(err)
+	}
+
+	// 不同服务的worker之间不算重叠
+	payment := newTestWorker(1, 100)
+	payment.Tags = []string{"payment"}
+	if err := mq.validateWorkerRange(2, payment); err != nil {
+		t.Fatal(err)
+	}
+
+	mq.config.Workers.Overlap = OverlapReplica
+	if err := mq.validateWorkerRange(2, newTestWorker(50, 150)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMQ_UncoveredUserRanges(t *testing.T) {
+	mq := NewMQ()
+	mq.workers[1] = newTestWorker(1, 100)
+	mq.workers[2] = newTestWorker(51, 150)
+	mq.workers[3] = newTestWorker(201, 300)
+
+	uncovered := mq.UncoveredUserRanges()
+	t.Log(uncovered)
+	if len(uncovered) != 2 ||
+		uncovered[0] != (UserRange{151, 200}) ||
+		uncovered[1] != (UserRange{301, math.MaxInt64}) {
+		t.Fatalf("unexpected uncovered ranges: %v", uncovered)
+	}
+}
@@ -0,0 +1,414 @@
+package mq
+
+import (
+	"github.com/iwind/TeaMQ/message"
+	"time"
+	"sync"
+	"path"
+	"sort"
+	"strconv"
+	"github.com/iwind/TeaMQ/logs"
+)
+
+// 超出限制时的处理方式
+const (
+	RateLimitActionReject     = "reject"     // 拒绝消息并返回错误
+	RateLimitActionDelay      = "delay"      // 延迟处理，直到有可用的额度
+	RateLimitActionDisconnect = "disconnect" // 返回错误后断开连接
+)
+
+// 因超出限速被拒绝时记录的投递失败原因
+const routingFailureRateLimited = "rate_limited"
+
+// 延迟处理的最长时间，超过后拒绝消息
+const defaultRateLimitMaxDelay = 5 * time.Second
+
+// 限速规则
+type RateLimitRule struct {
+	Rate  float64 `yaml:"rate"`  // 每秒允许的消息数，为0时不限制
+	Burst int     `yaml:"burst"` // 允许的突发消息数，为0时等于Rate
+}
+
+func (rule RateLimitRule) IsOn() bool {
+	return rule.Rate > 0
+}
+
+func (rule RateLimitRule) capacity() float64 {
+	if rule.Burst > 0 {
+		return float64(rule.Burst)
+	}
+	if rule.Rate < 1 {
+		return 1
+	}
+	return rule.Rate
+}
+
+// 令牌桶，允许令牌数为负数，表示已经预支了以后的额度
+type tokenBucket struct {
+	rule      RateLimitRule
+	tokens    float64
+	updatedAt time.Time
+
+	allowed int64 // 直接通过的消息数
+	delayed int64 // 延迟处理的消息数
+	limited int64 // 被拒绝的消息数
+}
+
+// 补充令牌
+func (bucket *tokenBucket) refill(now time.Time) {
+	seconds := now.Sub(bucket.updatedAt).Seconds()
+	if seconds > 0 {
+		bucket.tokens += seconds * bucket.rule.Rate
+		if bucket.tokens > bucket.rule.capacity() {
+			bucket.tokens = bucket.rule.capacity()
+		}
+		bucket.updatedAt = now
+	}
+}
+
+// 取得下一个令牌可用前需要等待的时间
+func (bucket *tokenBucket) wait() time.Duration {
+	if bucket.tokens >= 1 {
+		return 0
+	}
+	return time.Duration((1 - bucket.tokens) / bucket.rule.Rate * float64(time.Second))
+}
+
+// 限速器，按Key（连接、用户、队列、worker）分别计数
+type RateLimiter struct {
+	buckets  map[string]*tokenBucket // { Key: Bucket, ... }
+	released map[string]bool         // 已释放但令牌还没有补满的Key
+
+	mutex *sync.Mutex
+}
+
+func NewRateLimiter() *RateLimiter {
+	return &RateLimiter{
+		buckets:  map[string]*tokenBucket{},
+		released: map[string]bool{},
+		mutex:    &sync.Mutex{},
+	}
+}
+
+// 取得桶，规则变化时更新规则
+func (limiter *RateLimiter) bucket(key string, rule RateLimitRule, now time.Time) *tokenBucket {
+	bucket, found := limiter.buckets[key]
+	if !found {
+		bucket = &tokenBucket{
+			rule:      rule,
+			tokens:    rule.capacity(),
+			updatedAt: now,
+		}
+		limiter.buckets[key] = bucket
+		return bucket
+	}
+	delete(limiter.released, key)
+	bucket.refill(now)
+	bucket.rule = rule
+	if bucket.tokens > rule.capacity() {
+		bucket.tokens = rule.capacity()
+	}
+	return bucket
+}
+
+// 计算所有规则都有可用额度前需要等待的时间，不消耗额度
+func (limiter *RateLimiter) Wait(rules map[string]RateLimitRule, now time.Time) time.Duration {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+
+	maxWait := time.Duration(0)
+	for key, rule := range rules {
+		if !rule.IsOn() {
+			continue
+		}
+		wait := limiter.bucket(key, rule, now).wait()
+		if wait > maxWait {
+			maxWait = wait
+		}
+	}
+	return maxWait
+}
+
+// 检查并消耗额度，返回需要等待的时间
+// 不需要等待时直接消耗额度；需要等待且不超过maxDelay时预支额度；否则不消耗额度并返回false
+func (limiter *RateLimiter) Reserve(rules map[string]RateLimitRule, now time.Time, maxDelay time.Duration) (wait time.Duration, ok bool) {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+
+	buckets := []*tokenBucket{}
+	for key, rule := range rules {
+		if !rule.IsOn() {
+			continue
+		}
+		bucket := limiter.bucket(key, rule, now)
+		if bucketWait := bucket.wait(); bucketWait > wait {
+			wait = bucketWait
+		}
+		buckets = append(buckets, bucket)
+	}
+
+	if wait > maxDelay {
+		for _, bucket := range buckets {
+			bucket.limited ++
+		}
+		return wait, false
+	}
+
+	for _, bucket := range buckets {
+		bucket.tokens --
+		if wait > 0 {
+			bucket.delayed ++
+		} else {
+			bucket.allowed ++
+		}
+	}
+	return wait, true
+}
+
+// 记录未通过限制的消息
+func (limiter *RateLimiter) Count(rules map[string]RateLimitRule, delayed bool) {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+
+	for key := range rules {
+		bucket, found := limiter.buckets[key]
+		if !found {
+			continue
+		}
+		if delayed {
+			bucket.delayed ++
+		} else {
+			bucket.limited ++
+		}
+	}
+}
+
+// 删除不再使用的Key
+func (limiter *RateLimiter) Remove(key string) {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+
+	delete(limiter.buckets, key)
+	delete(limiter.released, key)
+}
+
+// 释放暂时不用的Key，令牌补满后才删除，以免重新连接后立即恢复全部额度
+func (limiter *RateLimiter) Release(key string) {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+
+	if _, found := limiter.buckets[key]; found {
+		limiter.released[key] = true
+	}
+	limiter.removeRefilled(time.Now())
+}
+
+// 删除已释放并且令牌已补满的Key
+func (limiter *RateLimiter) removeRefilled(now time.Time) {
+	for key := range limiter.released {
+		bucket, found := limiter.buckets[key]
+		if found {
+			bucket.refill(now)
+			if bucket.tokens < bucket.rule.capacity() {
+				continue
+			}
+			delete(limiter.buckets, key)
+		}
+		delete(limiter.released, key)
+	}
+}
+
+// 取得所有计数，按Key排序
+func (limiter *RateLimiter) Counters() []map[string]interface{} {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+
+	now := time.Now()
+	limiter.removeRefilled(now)
+
+	keys := []string{}
+	for key := range limiter.buckets {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	counters := []map[string]interface{}{}
+	for _, key := range keys {
+		bucket := limiter.buckets[key]
+		bucket.refill(now)
+		counters = append(counters, map[string]interface{}{
+			"key":     key,
+			"rate":    bucket.rule.Rate,
+			"burst":   bucket.rule.capacity(),
+			"tokens":  bucket.tokens,
+			"allowed": bucket.allowed,
+			"delayed": bucket.delayed,
+			"limited": bucket.limited,
+		})
+	}
+	return counters
+}
+
+func connectionRateLimitKey(connectionId int) string {
+	return "connection:" + strconv.Itoa(connectionId)
+}
+
+func userRateLimitKey(userId int64) string {
+	return "user:" + strconv.FormatInt(userId, 10)
+}
+
+func queueRateLimitKey(pattern string) string {
+	return "queue:" + pattern
+}
+
+func workerRateLimitKey(connectionId int) string {
+	return "worker:" + strconv.Itoa(connectionId)
+}
+
+// 取得队列匹配的限速规则，完全匹配优先，其次是最长的通配符
+func (mq *MQ) queueRateLimitRule(queue string) (pattern string, rule RateLimitRule, found bool) {
+	queues := mq.currentConfig().RateLimit.Queues
+	if rule, found := queues[queue]; found {
+		return queue, rule, true
+	}
+	for queuePattern, queueRule := range queues {
+		matched, err := path.Match(queuePattern, queue)
+		if err != nil || !matched {
+			continue
+		}
+		if len(queuePattern) > len(pattern) || (len(queuePattern) == len(pattern) && queuePattern < pattern) {
+			pattern = queuePattern
+			rule = queueRule
+			found = true
+		}
+	}
+	return
+}
+
+// 取得客户端消息需要遵守的限速规则
+func (mq *MQ) clientRateLimitRules(messageObject *message.Message, connection *Connection) map[string]RateLimitRule {
+	config := mq.currentConfig().RateLimit
+	rules := map[string]RateLimitRule{}
+	if config.Connection.IsOn() {
+		rules[connectionRateLimitKey(connection.Id())] = config.Connection
+	}
+	if config.User.IsOn() && connection.IsAuthenticated() {
+		rules[userRateLimitKey(connection.userId)] = config.User
+	}
+	if _, isBuiltin := mq.messageHandlers[messageObject.Queue]; !isBuiltin {
+		if pattern, rule, found := mq.queueRateLimitRule(messageObject.Queue); found && rule.IsOn() {
+			rules[queueRateLimitKey(pattern)] = rule
+		}
+	}
+	return rules
+}
+
+func (mq *MQ) rateLimitMaxDelay() time.Duration {
+	if mq.currentConfig().RateLimit.MaxDelay > 0 {
+		return time.Duration(mq.currentConfig().RateLimit.MaxDelay) * time.Millisecond
+	}
+	return defaultRateLimitMaxDelay
+}
+
+// 检查客户端消息是否超出限制，返回需要延迟处理的时间，返回false时消息已被拒绝
+func (mq *MQ) limitClientMessage(messageObject *message.Message, connection *Connection) (time.Duration, bool) {
+	rules := mq.clientRateLimitRules(messageObject, connection)
+	if len(rules) == 0 {
+		return 0, true
+	}
+
+	action := mq.currentConfig().RateLimit.Action
+	maxDelay := time.Duration(0)
+	if action == RateLimitActionDelay {
+		maxDelay = mq.rateLimitMaxDelay()
+	}
+
+	wait, ok := mq.rateLimiter.Reserve(rules, time.Now(), maxDelay)
+	if ok {
+		return wait, true
+	}
+
+	mq.countRoutingFailure(routingFailureRateLimited)
+	logs.Warn("rate limited", logs.KeyConnectionId, connection.Id(), logs.KeyUserId, connection.userId, logs.KeyQueue, messageObject.Queue)
+	connection.ResponseError(messageObject, NewError(ErrorCodeRateLimited, "Rate limit exceeded, retry after "+wait.Round(time.Millisecond).String()))
+	if action == RateLimitActionDisconnect {
+		connection.CloseAfterWriting()
+	}
+	return wait, false
+}
+
+// 取得worker的限速规则
+func (mq *MQ) workerRateLimitRules(connectionId int) map[string]RateLimitRule {
+	workerObject, found := mq.workers[connectionId]
+	if !found || workerObject.MaxMessagesPerSecond <= 0 {
+		return nil
+	}
+	return map[string]RateLimitRule{
+		workerRateLimitKey(connectionId): {
+			Rate:  float64(workerObject.MaxMessagesPerSecond),
+			Burst: workerObject.MaxMessagesPerSecond,
+		},
+	}
+}
+
+// 判断worker是否已达到每秒最大消息数，调用者需持有mq.mutex
+func (mq *MQ) isWorkerRateLimited(connectionId int, now time.Time) bool {
+	rules := mq.workerRateLimitRules(connectionId)
+	return len(rules) > 0 && mq.rateLimiter.Wait(rules, now) > 0
+}
+
+// 消耗worker的额度，调用者需持有mq.mutex
+func (mq *MQ) takeWorkerRateLimit(connectionId int) {
+	rules := mq.workerRateLimitRules(connectionId)
+	if len(rules) > 0 {
+		mq.rateLimiter.Reserve(rules, time.Now(), 0)
+	}
+}
+
+// 能处理消息的worker都已达到每秒最大消息数时，等到有额度后再重新转发，调用者需持有mq.mutex
+// 处理方式为reject时直接拒绝，delay和disconnect都会延迟转发，因为这不是客户端造成的
+func (mq *MQ) waitWorkerRateLimit(messageObject *message.Message, connectionId int) {
+	rules := mq.workerRateLimitRules(connectionId)
+	wait := mq.rateLimiter.Wait(rules, time.Now())
+	if mq.currentConfig().RateLimit.Action == RateLimitActionDelay || mq.currentConfig().RateLimit.Action == RateLimitActionDisconnect {
+		if wait <= mq.rateLimitMaxDelay() {
+			mq.rateLimiter.Count(rules, true)
+
+			// 放到发送消息的连接的延迟队列中，以保持顺序，连接关闭后不再转发
+			fromConnection, found := mq.connections[messageObject.FromConnectionId()]
+			if !found {
+				time.AfterFunc(wait, func() {
+					mq.dispatchToWorker(messageObject)
+				})
+				return
+			}
+			err := fromConnection.Delay(wait, func() {
+				mq.dispatchToWorker(messageObject)
+			})
+			if err != nil {
+				logs.Warn("delay message failed", logs.KeyConnectionId, fromConnection.Id(), logs.KeyQueue, messageObject.Queue, logs.KeyError, err)
+			}
+			return
+		}
+	}
+
+	mq.rateLimiter.Count(rules, false)
+	mq.countRoutingFailure(routingFailureRateLimited)
+	logs.Warn("workers rate limited", logs.KeyConnectionId, connectionId, logs.KeyQueue, messageObject.Queue)
+	fromConnection, found := mq.connections[messageObject.FromConnectionId()]
+	if found {
+		fromConnection.ResponseError(messageObject, NewError(ErrorCodeRateLimited, "Workers are busy, retry after "+wait.Round(time.Millisecond).String()))
+	}
+}
+
+// 列出限速计数，只允许worker访问
+func (mq *MQ) handleListRateLimits(message *message.Message, connection *Connection) {
+	if !connection.IsWorker() {
+		connection.ResponseError(message, NewError(ErrorCodeForbidden, "Permission denied, only workers can access rate limits"))
+		return
+	}
+
+	connection.ResponseSuccess(message, "ok", map[string]interface{}{
+		"rateLimits": mq.rateLimiter.Counters(),
+	})
+}
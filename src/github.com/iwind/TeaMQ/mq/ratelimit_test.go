@@ -0,0 +1,168 @@
+package mq
+
+import (
+	"testing"
+	"time"
+	"github.com/iwind/TeaMQ/message"
+)
+
+func TestRateLimiter_Reserve(t *testing.T) {
+	limiter := NewRateLimiter()
+	rules := map[string]RateLimitRule{
+		"connection:1": {Rate: 10, Burst: 2},
+	}
+
+	now := time.Now()
+	for i := 0; i < 2; i ++ {
+		if wait, ok := limiter.Reserve(rules, now, 0); !ok || wait != 0 {
+			t.Fatal("messages within burst should be allowed")
+		}
+	}
+
+	// 额度用完后拒绝
+	if _, ok := limiter.Reserve(rules, now, 0); ok {
+		t.Fatal("message over burst should be rejected")
+	}
+
+	// 允许延迟时预支额度
+	wait, ok := limiter.Reserve(rules, now, time.Second)
+	if !ok || wait != 100*time.Millisecond {
+		t.Fatalf("message should be delayed 100ms, got %s", wait)
+	}
+
+	// 补充令牌
+	if _, ok := limiter.Reserve(rules, now.Add(300*time.Millisecond), 0); !ok {
+		t.Fatal("message should be allowed after refilling")
+	}
+
+	counters := limiter.Counters()
+	if len(counters) != 1 || counters[0]["allowed"] != int64(3) || counters[0]["delayed"] != int64(1) || counters[0]["limited"] != int64(1) {
+		t.Fatal("counters are wrong:", counters)
+	}
+
+	limiter.Remove("connection:1")
+	if len(limiter.Counters()) != 0 {
+		t.Fatal("bucket should be removed")
+	}
+}
+
+func TestMQ_SelectWorker_RateLimit(t *testing.T) {
+	mq := NewMQ()
+	mq.workers[1] = newTestWorker(1, 100)
+	mq.workers[1].MaxMessagesPerSecond = 1
+	mq.workers[2] = newTestWorker(101, 200)
+
+	messageObject := &message.Message{Queue: "GET_USER_PROFILE"}
+	messageObject.SetFromUserId(50)
+	if id := mq.selectWorker(messageObject); id != 1 {
+		t.Fatalf("expected worker 1, got %d", id)
+	}
+	mq.takeWorkerRateLimit(1)
+
+	// 达到每秒最大消息数后转发给其他worker
+	if id := mq.selectWorker(messageObject); id != 2 {
+		t.Fatalf("expected worker 2, got %d", id)
+	}
+
+	mq.config.Workers.Strict = true
+	if id := mq.selectWorker(messageObject); id != 0 {
+		t.Fatalf("expected no worker, got %d", id)
+	}
+	if id := mq.selectWorkerWithRateLimits(messageObject, false); id != 1 {
+		t.Fatalf("expected rate limited worker 1, got %d", id)
+	}
+}
+
+func TestMQ_QueueRateLimitRule(t *testing.T) {
+	mq := NewMQ()
+	mq.config.RateLimit.Queues = map[string]RateLimitRule{
+		"user.*":       {Rate: 100},
+		"user.login.*": {Rate: 10},
+	}
+
+	pattern, rule, found := mq.queueRateLimitRule("user.login.sms")
+	if !found || pattern != "user.login.*" || rule.Rate != 10 {
+		t.Fatal("the longest pattern should be used")
+	}
+
+	_, _, found = mq.queueRateLimitRule("GET_USER_PROFILE")
+	if found {
+		t.Fatal("queue should not be limited")
+	}
+}
+
+func TestRateLimiter_Release(t *testing.T) {
+	limiter := NewRateLimiter()
+	rules := map[string]RateLimitRule{
+		"user:1": {Rate: 10, Burst: 1},
+	}
+	limiter.Reserve(rules, time.Now(), 0)
+
+	// 令牌补满之前保留
+	limiter.Release("user:1")
+	if len(limiter.Counters()) != 1 {
+		t.Fatal("bucket should be kept until refilled")
+	}
+
+	time.Sleep(150 * time.Millisecond)
+	if len(limiter.Counters()) != 0 {
+		t.Fatal("bucket should be removed after refilled")
+	}
+}
+
+func TestMQ_RateLimit_Reconnect(t *testing.T) {
+	config := &Config{Bind: "127.0.0.1"}
+	config.RateLimit.User = RateLimitRule{Rate: 0.1, Burst: 1}
+	mq := startTestMQ(t, config)
+
+	// 模拟已认证的用户
+	connect := func() *testClient {
+		client := dialTestNode(t, mq)
+		client.send(map[string]interface{}{
+			"queue": "$tea.connection.ping",
+		})
+		client.read()
+
+		mq.mutex.Lock()
+		for connectionId, connection := range mq.connections {
+			if !connection.IsAuthenticated() {
+				connection.setUserId(5)
+				mq.users[5] = map[int]int{connectionId: 1}
+			}
+		}
+		mq.mutex.Unlock()
+		return client
+	}
+
+	client := connect()
+	client.send(map[string]interface{}{
+		"queue": "hello",
+	})
+	if code := client.read()["code"]; code != float64(ErrorCodeNoWorker) {
+		t.Fatal("first message should be allowed:", code)
+	}
+	client.conn.Close()
+
+	deadline := time.Now().Add(3 * time.Second)
+	for {
+		mq.mutex.Lock()
+		_, found := mq.users[5]
+		mq.mutex.Unlock()
+		if !found {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("user should be removed after disconnected")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// 重新连接后不能恢复额度
+	client = connect()
+	client.send(map[string]interface{}{
+		"queue": "hello",
+	})
+	if code := client.read()["code"]; code != float64(ErrorCodeRateLimited) {
+		t.Fatal("user should still be rate limited after reconnecting:", code)
+	}
+}
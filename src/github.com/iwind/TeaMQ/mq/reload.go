@@ -0,0 +1,179 @@
+package mq
+
+import (
+	"github.com/iwind/TeaMQ/logs"
+	"os"
+	"os/signal"
+	"reflect"
+	"syscall"
+	"time"
+)
+
+// 检查配置文件是否修改的默认间隔
+const defaultConfigWatchInterval = 2 * time.Second
+
+// 当前的配置，重新加载后会被替换，不要修改返回的配置
+func (mq *MQ) currentConfig() *Config {
+	mq.configMutex.RLock()
+	defer mq.configMutex.RUnlock()
+	return mq.config
+}
+
+func (mq *MQ) setConfig(config *Config) {
+	mq.configMutex.Lock()
+	defer mq.configMutex.Unlock()
+	mq.config = config
+}
+
+// 重新加载配置，配置不合法时返回错误并保持原来的配置
+// Keys、认证、限速、TTL、worker、死信队列和日志设置立即生效
+// 监听地址、集群、管理API、指标接口、心跳、定时消息和最大消息长度需要重启才能生效，修改时保持原来的设置并输出日志
+func (mq *MQ) Reload(config *Config) error {
+	err := config.Validate()
+	if err != nil {
+		return err
+	}
+	err = logs.Configure(config.Log)
+	if err != nil {
+		return err
+	}
+
+	oldConfig := mq.currentConfig()
+	newConfig := *config
+	for _, field := range restartRequiredChanges(oldConfig, config) {
+		logs.Warn("config change requires restart, ignored", "field", field)
+	}
+	newConfig.Bind = oldConfig.Bind
+	newConfig.Port = oldConfig.Port
+	newConfig.Heartbeat = oldConfig.Heartbeat
+	newConfig.Scheduler = oldConfig.Scheduler
+	newConfig.Limits.MaxFrameSize = oldConfig.Limits.MaxFrameSize
+	newConfig.Cluster = oldConfig.Cluster
+	newConfig.Admin = oldConfig.Admin
+	newConfig.Metrics = oldConfig.Metrics
+	mq.setConfig(&newConfig)
+
+	if newConfig.DeadLetters.MaxSize > 0 {
+		mq.deadLetters.SetMaxSize(newConfig.DeadLetters.MaxSize)
+	} else {
+		mq.deadLetters.SetMaxSize(defaultDeadLetterQueueSize)
+	}
+
+	mq.mutex.Lock()
+	mq.disconnectRevokedWorkers(&newConfig)
+	mq.mutex.Unlock()
+
+	logs.Info("config reloaded")
+	return nil
+}
+
+// 设置从文件中读取配置后的回调，在重新加载之前调用，用来再次应用命令行参数等覆盖的选项
+func (mq *MQ) OnLoadConfig(callback func(config *Config)) {
+	mq.onLoadConfig = callback
+}
+
+// 读取配置文件并重新加载
+func (mq *MQ) ReloadConfigFile(configFile string) error {
+	config, err := LoadConfig(configFile)
+	if err == nil {
+		if mq.onLoadConfig != nil {
+			mq.onLoadConfig(config)
+		}
+		err = mq.Reload(config)
+	}
+	if err != nil {
+		logs.Error("reload config failed", "file", configFile, logs.KeyError, err)
+	}
+	return err
+}
+
+// 监视配置文件，文件修改或收到SIGHUP时重新加载，MQ关闭后停止，interval为0时使用默认间隔
+func (mq *MQ) WatchConfigFile(configFile string, interval time.Duration) {
+	if interval <= 0 {
+		interval = defaultConfigWatchInterval
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+
+	modTime, size := configFileVersion(configFile)
+	go func() {
+		defer signal.Stop(signals)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-mq.done:
+				return
+			case <-signals:
+				logs.Info("receive SIGHUP, reload config", "file", configFile)
+			case <-ticker.C:
+				newModTime, newSize := configFileVersion(configFile)
+				if newModTime.Equal(modTime) && newSize == size {
+					continue
+				}
+				logs.Info("config file changed, reload config", "file", configFile)
+			}
+
+			modTime, size = configFileVersion(configFile)
+			mq.ReloadConfigFile(configFile)
+		}
+	}()
+}
+
+// 断开密钥已被删除、已过期或不再允许的worker，调用者需持有mq.mutex
+func (mq *MQ) disconnectRevokedWorkers(config *Config) {
+	now := time.Now()
+	for connectionId, workerObject := range mq.workers {
+		workerKey := config.findWorkerKey(workerObject.Key)
+		if workerKey != nil && !workerKey.IsExpired(now) && workerKey.Allows(workerObject) == nil {
+			continue
+		}
+		connection, found := mq.connections[connectionId]
+		if !found {
+			continue
+		}
+		logs.Warn("disconnect worker using revoked key", logs.KeyWorkerId, workerObject.Id, logs.KeyConnectionId, connectionId, "key", workerObject.Key)
+		connection.Close()
+	}
+}
+
+// 取得需要重启才能生效的修改
+func restartRequiredChanges(oldConfig *Config, newConfig *Config) []string {
+	changes := []string{}
+	if oldConfig.Bind != newConfig.Bind {
+		changes = append(changes, "bind")
+	}
+	if oldConfig.Port != newConfig.Port {
+		changes = append(changes, "port")
+	}
+	if oldConfig.Heartbeat != newConfig.Heartbeat {
+		changes = append(changes, "heartbeat")
+	}
+	if oldConfig.Scheduler != newConfig.Scheduler {
+		changes = append(changes, "scheduler")
+	}
+	if oldConfig.Limits.MaxFrameSize != newConfig.Limits.MaxFrameSize {
+		changes = append(changes, "limits.maxFrameSize")
+	}
+	if !reflect.DeepEqual(oldConfig.Cluster, newConfig.Cluster) {
+		changes = append(changes, "cluster")
+	}
+	if oldConfig.Admin != newConfig.Admin {
+		changes = append(changes, "admin")
+	}
+	if oldConfig.Metrics != newConfig.Metrics {
+		changes = append(changes, "metrics")
+	}
+	return changes
+}
+
+// 配置文件的修改时间和大小，文件不存在时返回零值
+func configFileVersion(configFile string) (time.Time, int64) {
+	stat, err := os.Stat(configFile)
+	if err != nil {
+		return time.Time{}, 0
+	}
+	return stat.ModTime(), stat.Size()
+}
@@ -0,0 +1,151 @@
+package mq
+
+import (
+	"testing"
+	"time"
+	"os"
+	"path/filepath"
+	"io/ioutil"
+	"net"
+)
+
+func TestMQ_Reload(t *testing.T) {
+	config := &Config{
+		Bind: "127.0.0.1",
+		Keys: []string{"k1", "k2"},
+	}
+	mq := startTestMQ(t, config)
+
+	register := func(key string, id string) *testClient {
+		client := dialTestNode(t, mq)
+		client.send(map[string]interface{}{
+			"queue": "$tea.worker.register",
+			"body": map[string]interface{}{
+				"key": key,
+				"id":  id,
+				"user": map[string]interface{}{
+					"min": 1,
+					"max": 100,
+				},
+			},
+		})
+		if code := client.read()["code"]; code != float64(200) {
+			t.Fatal("register failed:", code)
+		}
+		return client
+	}
+	worker1 := register("k1", "w1")
+	worker2 := register("k2", "w2")
+
+	newConfig := &Config{
+		Bind: "0.0.0.0",
+		Port: 9999,
+		Keys: []string{"k2"},
+	}
+	newConfig.RateLimit.Connection = RateLimitRule{Rate: 10}
+	err := mq.Reload(newConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	current := mq.currentConfig()
+	if current.Bind != "127.0.0.1" || current.Port != 0 {
+		t.Fatal("bind and port should not be changed without restart")
+	}
+	if len(current.Keys) != 1 || current.Keys[0] != "k2" || current.RateLimit.Connection.Rate != 10 {
+		t.Fatal("keys and rate limits should be reloaded")
+	}
+
+	// 使用已撤销的Key的worker被断开
+	worker1.conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	if worker1.scanner.Scan() {
+		t.Fatal("worker using revoked key should be disconnected")
+	}
+	worker2.send(map[string]interface{}{
+		"queue": "$tea.connection.ping",
+	})
+	if response := worker2.read(); response["message"] != "pong" {
+		t.Fatal("worker using valid key should stay connected:", response)
+	}
+}
+
+func TestMQ_WatchConfigFile(t *testing.T) {
+	configFile := filepath.Join(os.TempDir(), "teamq-reload-test.conf")
+	defer os.Remove(configFile)
+
+	err := ioutil.WriteFile(configFile, []byte("bind: 127.0.0.1\nport: 7777\nkeys: [k1]\n"), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, err := LoadConfig(configFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.Port = 0
+	mq := startTestMQ(t, config)
+	mq.WatchConfigFile(configFile, 10*time.Millisecond)
+
+	err = ioutil.WriteFile(configFile, []byte("bind: 127.0.0.1\nport: 7777\nkeys: [k1, k2]\n"), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(3 * time.Second)
+	for len(mq.currentConfig().Keys) != 2 {
+		if time.Now().After(deadline) {
+			t.Fatal("config file should be reloaded after changed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestMQ_OnLoadConfig(t *testing.T) {
+	configFile := filepath.Join(os.TempDir(), "teamq-override-test.conf")
+	defer os.Remove(configFile)
+
+	err := ioutil.WriteFile(configFile, []byte("bind: 127.0.0.1\nport: 7777\nkeys: [k1]\n"), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, err := LoadConfig(configFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 模拟命令行参数覆盖配置文件中的端口
+	override := func(config *Config) {
+		config.Port = 8888
+	}
+	override(config)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mq := NewMQWithConfig(config)
+	mq.SetListener(listener)
+	err = mq.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var loadedConfig *Config
+	mq.OnLoadConfig(func(config *Config) {
+		override(config)
+		loadedConfig = config
+	})
+
+	err = ioutil.WriteFile(configFile, []byte("bind: 127.0.0.1\nport: 7777\nkeys: [k1, k2]\n"), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = mq.ReloadConfigFile(configFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	current := mq.currentConfig()
+	if len(current.Keys) != 2 || current.Port != 8888 {
+		t.Fatal("overrides should be applied again after reload")
+	}
+	if changes := restartRequiredChanges(config, loadedConfig); len(changes) != 0 {
+		t.Fatal("overrides should not be reported as changes:", changes)
+	}
+}
@@ -0,0 +1,412 @@
+package mq
+
+import (
+	"github.com/iwind/TeaMQ/message"
+	"github.com/iwind/TeaMQ/utils/string"
+	"github.com/iwind/TeaMQ/utils/time"
+	"time"
+	"sync"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"github.com/iwind/TeaMQ/logs"
+	"path/filepath"
+	"strconv"
+)
+
+const (
+	schedulerTick  = time.Second // 时间轮每格的时间
+	schedulerSlots = 3600        // 时间轮的格数，转一圈为1小时
+
+	defaultSchedulerMaxPending          = 100000 // 默认最多等待投递的消息数
+	defaultSchedulerMaxPendingPerSender = 1000   // 默认每个发送者最多等待投递的消息数
+)
+
+// 等待投递的消息
+type ScheduledMessage struct {
+	Sender     string // 发送者，消息ID在同一个发送者中唯一，如 user:1、connection:2、worker:w1
+	Message    *message.Message
+	FromWorker bool
+	DeliverAt  time.Time
+
+	slot   int
+	rounds int // 还需要转多少圈
+}
+
+// 持久化时的格式
+type scheduledMessageJSON struct {
+	Sender     string          `json:"sender"`
+	Message    json.RawMessage `json:"message"`
+	FromWorker bool            `json:"fromWorker"`
+}
+
+// 基于时间轮的定时投递调度器
+type Scheduler struct {
+	slots    []map[string]*ScheduledMessage // [ { Sender/MessageID: ScheduledMessage, ... }, ... ]
+	messages map[string]*ScheduledMessage   // { Sender/MessageID: ScheduledMessage, ... }
+	senders  map[string]int                 // { Sender: Count, ... }
+	current  int
+
+	maxPending          int // 最多等待投递的消息数
+	maxPendingPerSender int // 每个发送者最多等待投递的消息数
+
+	store   string // 持久化文件，为空时不持久化
+	isDirty bool
+
+	onDue func(scheduledMessage *ScheduledMessage)
+
+	done      chan bool // 关闭后停止转动
+	isStopped bool
+
+	mutex *sync.Mutex
+}
+
+func NewScheduler() *Scheduler {
+	scheduler := &Scheduler{
+		slots:    make([]map[string]*ScheduledMessage, schedulerSlots),
+		messages: map[string]*ScheduledMessage{},
+		senders:  map[string]int{},
+		done:     make(chan bool),
+		mutex:    &sync.Mutex{},
+
+		maxPending:          defaultSchedulerMaxPending,
+		maxPendingPerSender: defaultSchedulerMaxPendingPerSender,
+	}
+	for index := range scheduler.slots {
+		scheduler.slots[index] = map[string]*ScheduledMessage{}
+	}
+	return scheduler
+}
+
+// 设置消息到期时的回调
+func (scheduler *Scheduler) OnDue(callback func(scheduledMessage *ScheduledMessage)) {
+	scheduler.onDue = callback
+}
+
+// 设置等待投递的消息数限制，为0时使用默认值
+func (scheduler *Scheduler) SetLimits(maxPending int, maxPendingPerSender int) {
+	scheduler.mutex.Lock()
+	defer scheduler.mutex.Unlock()
+
+	if maxPending <= 0 {
+		maxPending = defaultSchedulerMaxPending
+	}
+	if maxPendingPerSender <= 0 {
+		maxPendingPerSender = defaultSchedulerMaxPendingPerSender
+	}
+	scheduler.maxPending = maxPending
+	scheduler.maxPendingPerSender = maxPendingPerSender
+}
+
+// 添加消息，同一个发送者的消息ID不能重复，超出数量限制时返回ErrorCodeTooManyScheduled错误
+func (scheduler *Scheduler) Add(sender string, messageObject *message.Message, fromWorker bool, deliverAt time.Time) error {
+	scheduler.mutex.Lock()
+	defer scheduler.mutex.Unlock()
+
+	key := scheduledMessageKey(sender, messageObject.Id())
+	if _, found := scheduler.messages[key]; found {
+		return NewError(ErrorCodeInvalidMessage, "message '"+messageObject.Id()+"' is already scheduled")
+	}
+	if len(scheduler.messages) >= scheduler.maxPending {
+		return NewError(ErrorCodeTooManyScheduled, "too many scheduled messages")
+	}
+	if scheduler.senders[sender] >= scheduler.maxPendingPerSender {
+		return NewError(ErrorCodeTooManyScheduled, "too many scheduled messages from the sender")
+	}
+
+	ticks := int((deliverAt.Sub(time.Now()) + schedulerTick - 1) / schedulerTick)
+	if ticks < 1 {
+		ticks = 1
+	}
+
+	scheduledMessage := &ScheduledMessage{
+		Sender:     sender,
+		Message:    messageObject,
+		FromWorker: fromWorker,
+		DeliverAt:  deliverAt,
+		slot:       (scheduler.current + ticks) % schedulerSlots,
+		rounds:     (ticks - 1) / schedulerSlots,
+	}
+	scheduler.slots[scheduledMessage.slot][key] = scheduledMessage
+	scheduler.messages[key] = scheduledMessage
+	scheduler.senders[sender] ++
+	scheduler.isDirty = true
+	return nil
+}
+
+// 取消消息
+func (scheduler *Scheduler) Cancel(sender string, messageId string) (*ScheduledMessage, bool) {
+	scheduler.mutex.Lock()
+	defer scheduler.mutex.Unlock()
+
+	key := scheduledMessageKey(sender, messageId)
+	scheduledMessage, found := scheduler.messages[key]
+	if !found {
+		return nil, false
+	}
+	scheduler.remove(key, scheduledMessage)
+	scheduler.isDirty = true
+	return scheduledMessage, true
+}
+
+// 查找消息
+func (scheduler *Scheduler) Find(sender string, messageId string) (*ScheduledMessage, bool) {
+	scheduler.mutex.Lock()
+	defer scheduler.mutex.Unlock()
+
+	scheduledMessage, found := scheduler.messages[scheduledMessageKey(sender, messageId)]
+	return scheduledMessage, found
+}
+
+// 某个发送者等待投递的消息数
+func (scheduler *Scheduler) SenderLen(sender string) int {
+	scheduler.mutex.Lock()
+	defer scheduler.mutex.Unlock()
+
+	return scheduler.senders[sender]
+}
+
+func (scheduler *Scheduler) Len() int {
+	scheduler.mutex.Lock()
+	defer scheduler.mutex.Unlock()
+
+	return len(scheduler.messages)
+}
+
+// 开始运行，每格时间转动一次时间轮，直到调用Stop()
+func (scheduler *Scheduler) Start() {
+	ticker := time.NewTicker(schedulerTick)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-scheduler.done:
+			return
+		case <-ticker.C:
+		}
+
+		for _, scheduledMessage := range scheduler.tick() {
+			if scheduler.onDue == nil {
+				continue
+			}
+
+			// 时间轮的精度为一格，剩余不足一格的时间用定时器补足，保证不会提前投递
+			remaining := scheduledMessage.DeliverAt.Sub(time.Now())
+			if remaining > 0 {
+				dueMessage := scheduledMessage
+				time.AfterFunc(remaining, func() {
+					scheduler.onDue(dueMessage)
+				})
+			} else {
+				scheduler.onDue(scheduledMessage)
+			}
+		}
+		scheduler.save()
+	}
+}
+
+// 停止转动时间轮，并保存未投递的消息
+func (scheduler *Scheduler) Stop() {
+	scheduler.mutex.Lock()
+	if !scheduler.isStopped {
+		scheduler.isStopped = true
+		close(scheduler.done)
+	}
+	scheduler.mutex.Unlock()
+
+	scheduler.save()
+}
+
+// 转动时间轮，返回到期的消息
+func (scheduler *Scheduler) tick() []*ScheduledMessage {
+	scheduler.mutex.Lock()
+	defer scheduler.mutex.Unlock()
+
+	scheduler.current = (scheduler.current + 1) % schedulerSlots
+
+	dueMessages := []*ScheduledMessage{}
+	for key, scheduledMessage := range scheduler.slots[scheduler.current] {
+		if scheduledMessage.rounds > 0 {
+			scheduledMessage.rounds --
+			continue
+		}
+		scheduler.remove(key, scheduledMessage)
+		dueMessages = append(dueMessages, scheduledMessage)
+	}
+	if len(dueMessages) > 0 {
+		scheduler.isDirty = true
+	}
+	return dueMessages
+}
+
+// 删除消息，调用者需持有scheduler.mutex
+func (scheduler *Scheduler) remove(key string, scheduledMessage *ScheduledMessage) {
+	delete(scheduler.slots[scheduledMessage.slot], key)
+	delete(scheduler.messages, key)
+	scheduler.senders[scheduledMessage.Sender] --
+	if scheduler.senders[scheduledMessage.Sender] <= 0 {
+		delete(scheduler.senders, scheduledMessage.Sender)
+	}
+}
+
+// 发送者和消息ID组成的键
+func scheduledMessageKey(sender string, messageId string) string {
+	return sender + "/" + messageId
+}
+
+// 从文件中加载重启前未投递的消息
+func (scheduler *Scheduler) Load(store string) error {
+	scheduler.mutex.Lock()
+	scheduler.store = store
+	scheduler.mutex.Unlock()
+
+	err := os.MkdirAll(filepath.Dir(store), 0777)
+	if err != nil {
+		return err
+	}
+
+	data, err := ioutil.ReadFile(store)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	items := []*scheduledMessageJSON{}
+	err = json.Unmarshal(data, &items)
+	if err != nil {
+		return err
+	}
+
+	for _, item := range items {
+		messageObject, err := message.Unmarshal(item.Message)
+		if err != nil {
+			logs.Error("load scheduled message failed", logs.KeyError, err)
+			continue
+		}
+		sender := item.Sender
+		if len(sender) == 0 {
+			sender = schedulerSender(item.FromWorker, "", messageObject.FromUserId(), messageObject.FromConnectionId())
+		}
+		err = scheduler.Add(sender, messageObject, item.FromWorker, messageObject.DeliveryTime(time.Now()))
+		if err != nil {
+			logs.Error("load scheduled message failed", logs.KeyMessageId, messageObject.Id(), logs.KeyError, err)
+		}
+	}
+	logs.Info("load scheduled messages", "count", len(items))
+	return nil
+}
+
+// 保存未投递的消息到文件
+func (scheduler *Scheduler) save() {
+	scheduler.mutex.Lock()
+	defer scheduler.mutex.Unlock()
+
+	if len(scheduler.store) == 0 || !scheduler.isDirty {
+		return
+	}
+
+	items := []*scheduledMessageJSON{}
+	for _, scheduledMessage := range scheduler.messages {
+		// 回复给某个连接的消息在重启后没有意义
+		if scheduledMessage.Message.ToConnectionId() > 0 {
+			continue
+		}
+
+		data, err := scheduledMessage.Message.Encode()
+		if err != nil {
+			logs.Error("encode scheduled message failed", logs.KeyMessageId, scheduledMessage.Message.Id(), logs.KeyError, err)
+			continue
+		}
+		items = append(items, &scheduledMessageJSON{
+			Sender:     scheduledMessage.Sender,
+			Message:    data,
+			FromWorker: scheduledMessage.FromWorker,
+		})
+	}
+	data, err := json.Marshal(items)
+	if err != nil {
+		logs.Error("encode scheduled messages failed", logs.KeyError, err)
+		return
+	}
+
+	// 先写入临时文件再改名，防止写入过程中退出导致文件损坏
+	tmpFile := scheduler.store + ".tmp"
+	err = ioutil.WriteFile(tmpFile, data, 0666)
+	if err == nil {
+		err = os.Rename(tmpFile, scheduler.store)
+	}
+	if err != nil {
+		logs.Error("save scheduled messages failed", "file", scheduler.store, logs.KeyError, err)
+		return
+	}
+	scheduler.isDirty = false
+}
+
+// 加入定时投递，并告知发送者消息ID
+func (mq *MQ) scheduleMessage(messageObject *message.Message, connection *Connection) {
+	if len(messageObject.Id()) == 0 {
+		messageObject.SetId(stringutil.Rand(16))
+	}
+
+	// 统一转换为绝对时间，以便重启后恢复
+	deliverAt := messageObject.DeliveryTime(time.Now())
+	messageObject.DeliverAt = timeutil.UnixFloat(deliverAt)
+	messageObject.Delay = 0
+
+	err := mq.scheduler.Add(mq.connectionSender(connection), messageObject, connection.IsWorker(), deliverAt)
+	if err != nil {
+		connection.ResponseError(messageObject, err)
+		return
+	}
+
+	connection.ResponseSuccess(messageObject, "ok", map[string]interface{}{
+		"id":        messageObject.Id(),
+		"deliverAt": messageObject.DeliverAt,
+	})
+}
+
+// 取消定时投递的消息，只能取消同一个发送者的消息
+func (mq *MQ) handleCancelMessage(message *message.Message, connection *Connection) {
+	id := message.StringForKeyDefault("id", "")
+	if len(id) == 0 {
+		connection.ResponseError(message, NewError(ErrorCodeInvalidMessage, "'id' must not be empty"))
+		return
+	}
+
+	_, found := mq.scheduler.Cancel(mq.connectionSender(connection), id)
+	if !found {
+		connection.ResponseError(message, NewError(ErrorCodeNotFound, "The scheduled message '"+id+"' is not found"))
+		return
+	}
+	connection.ResponseSuccess(message, "ok", nil)
+}
+
+// 取得连接作为定时消息发送者的标识，已认证的用户在所有连接中共享
+func (mq *MQ) connectionSender(connection *Connection) string {
+	workerId := ""
+	if connection.IsWorker() {
+		mq.mutex.Lock()
+		if workerObject, found := mq.workers[connection.Id()]; found {
+			workerId = workerObject.Id
+		}
+		mq.mutex.Unlock()
+	}
+
+	userId := int64(0)
+	if connection.IsAuthenticated() {
+		userId = connection.userId
+	}
+	return schedulerSender(connection.IsWorker(), workerId, userId, connection.Id())
+}
+
+// 定时消息发送者的标识
+func schedulerSender(fromWorker bool, workerId string, userId int64, connectionId int) string {
+	if fromWorker {
+		return "worker:" + workerId
+	}
+	if userId > 0 {
+		return "user:" + strconv.FormatInt(userId, 10)
+	}
+	return "connection:" + strconv.Itoa(connectionId)
+}
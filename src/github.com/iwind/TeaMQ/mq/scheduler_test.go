@@ -0,0 +1,129 @@
+package mq
+
+import (
+	"testing"
+	"time"
+	"os"
+	"path/filepath"
+	"github.com/iwind/TeaMQ/message"
+)
+
+func TestScheduler_Tick(t *testing.T) {
+	scheduler := NewScheduler()
+
+	soon := &message.Message{Queue: "A"}
+	soon.SetId("soon")
+	scheduler.Add("user:1", soon, false, time.Now().Add(2*time.Second))
+
+	later := &message.Message{Queue: "B"}
+	later.SetId("later")
+	scheduler.Add("worker:w1", later, true, time.Now().Add((schedulerSlots+2)*schedulerTick))
+
+	if err := scheduler.Add("user:1", soon, false, time.Now()); err == nil {
+		t.Fatal("duplicated message id should be rejected")
+	}
+
+	for i := 0; i < 2; i ++ {
+		dueMessages := scheduler.tick()
+		if i == 1 && (len(dueMessages) != 1 || dueMessages[0].Message.Id() != "soon") {
+			t.Fatalf("message 'soon' should be due at tick %d", i)
+		}
+	}
+
+	// 'later'需要再转一圈才到期
+	for i := 0; i < schedulerSlots-1; i ++ {
+		if len(scheduler.tick()) > 0 {
+			t.Fatalf("message 'later' should not be due at tick %d", i)
+		}
+	}
+	if dueMessages := scheduler.tick(); len(dueMessages) != 1 || !dueMessages[0].FromWorker {
+		t.Fatal("message 'later' should be due")
+	}
+
+	scheduler.Add("worker:w1", later, true, time.Now().Add(time.Minute))
+	if _, found := scheduler.Cancel("worker:w1", "later"); !found || scheduler.Len() != 0 {
+		t.Fatal("message 'later' should be cancelled")
+	}
+}
+
+func TestScheduler_Persistence(t *testing.T) {
+	store := filepath.Join(os.TempDir(), "teamq-scheduler-test", "scheduled.json")
+	defer os.RemoveAll(filepath.Dir(store))
+
+	scheduler := NewScheduler()
+	if err := scheduler.Load(store); err != nil {
+		t.Fatal(err)
+	}
+	messageObject := &message.Message{Queue: "REMIND", Body: map[string]interface{}{"text": "hello"}}
+	messageObject.SetId("remind1")
+	messageObject.DeliverAt = float64(time.Now().Add(time.Hour).Unix())
+	scheduler.Add("worker:w1", messageObject, true, time.Now().Add(time.Hour))
+	scheduler.save()
+
+	restored := NewScheduler()
+	if err := restored.Load(store); err != nil {
+		t.Fatal(err)
+	}
+	scheduledMessage, found := restored.Find("worker:w1", "remind1")
+	if !found || !scheduledMessage.FromWorker || scheduledMessage.Message.Body["text"] != "hello" {
+		t.Fatal("scheduled message should be restored")
+	}
+}
+
+func TestScheduler_Limits(t *testing.T) {
+	scheduler := NewScheduler()
+	scheduler.SetLimits(3, 2)
+
+	newMessage := func(id string) *message.Message {
+		messageObject := &message.Message{Queue: "A"}
+		messageObject.SetId(id)
+		return messageObject
+	}
+	deliverAt := time.Now().Add(time.Minute)
+
+	// 不同发送者的消息ID互不影响
+	if err := scheduler.Add("user:1", newMessage("m1"), false, deliverAt); err != nil {
+		t.Fatal(err)
+	}
+	if err := scheduler.Add("user:2", newMessage("m1"), false, deliverAt); err != nil {
+		t.Fatal("same id from another sender should be accepted:", err)
+	}
+	if _, found := scheduler.Cancel("user:2", "m1"); !found {
+		t.Fatal("sender should cancel its own message")
+	}
+	if _, found := scheduler.Find("user:1", "m1"); !found {
+		t.Fatal("message of another sender should not be cancelled")
+	}
+
+	if err := scheduler.Add("user:1", newMessage("m2"), false, deliverAt); err != nil {
+		t.Fatal(err)
+	}
+	if err := scheduler.Add("user:1", newMessage("m3"), false, deliverAt); ErrorCode(err) != ErrorCodeTooManyScheduled {
+		t.Fatal("messages over the sender limit should be rejected:", err)
+	}
+	if err := scheduler.Add("user:2", newMessage("m1"), false, deliverAt); err != nil {
+		t.Fatal(err)
+	}
+	if err := scheduler.Add("user:3", newMessage("m1"), false, deliverAt); ErrorCode(err) != ErrorCodeTooManyScheduled {
+		t.Fatal("messages over the global limit should be rejected:", err)
+	}
+	if scheduler.SenderLen("user:1") != 2 || scheduler.Len() != 3 {
+		t.Fatal("wrong counts")
+	}
+}
+
+func TestMQ_ScheduleMessage_Response(t *testing.T) {
+	mq := startTestMQ(t, &Config{Bind: "127.0.0.1"})
+
+	client := dialTestNode(t, mq)
+	client.send(map[string]interface{}{
+		"queue": "REMIND",
+		"id":    "s1",
+		"delay": 60,
+	})
+	response := client.read()
+	data, _ := response["data"].(map[string]interface{})
+	if response["code"] != float64(200) || response["id"] != "s1" || data["id"] != "s1" || data["deliverAt"] == nil {
+		t.Fatal("unexpected response:", response)
+	}
+}
@@ -0,0 +1,208 @@
+package mq
+
+import (
+	"github.com/iwind/TeaMQ/message"
+	"github.com/iwind/TeaMQ/utils/string"
+	"time"
+	"github.com/iwind/TeaMQ/logs"
+	"strconv"
+	"container/list"
+)
+
+// worker断开后等待其重连的时间，超时后未完成的消息会被转发给其他worker
+const workerResumeTimeout = 60 * time.Second
+
+// 每个worker最多等待确认的消息数和等待确认的最长时间，超出后最早的消息被放入死信队列
+const (
+	defaultWorkerMaxPending     = 10000
+	defaultWorkerPendingTimeout = 600 * time.Second
+)
+
+func pendingMessageKey(fromConnectionId int, messageId string) string {
+	return strconv.Itoa(fromConnectionId) + ":" + messageId
+}
+
+// 已转发给worker但尚未确认的消息
+type pendingMessage struct {
+	key       string
+	message   *message.Message
+	pendingAt time.Time
+}
+
+// 一个worker等待确认的消息，按转发的顺序保存，以便淘汰最早的消息
+type pendingQueue struct {
+	elements map[string]*list.Element // { MessageKey: Element, ... }
+	list     *list.List               // [ *pendingMessage, ... ]
+}
+
+func newPendingQueue() *pendingQueue {
+	return &pendingQueue{
+		elements: map[string]*list.Element{},
+		list:     list.New(),
+	}
+}
+
+func (queue *pendingQueue) Len() int {
+	return queue.list.Len()
+}
+
+// 加入消息，已存在时移到最后
+func (queue *pendingQueue) Add(key string, messageObject *message.Message, now time.Time) {
+	queue.Remove(key)
+	queue.elements[key] = queue.list.PushBack(&pendingMessage{
+		key:       key,
+		message:   messageObject,
+		pendingAt: now,
+	})
+}
+
+func (queue *pendingQueue) Contains(key string) bool {
+	_, found := queue.elements[key]
+	return found
+}
+
+func (queue *pendingQueue) Remove(key string) {
+	element, found := queue.elements[key]
+	if !found {
+		return
+	}
+	queue.list.Remove(element)
+	delete(queue.elements, key)
+}
+
+// 最早加入的消息，没有消息时返回nil
+func (queue *pendingQueue) Oldest() *pendingMessage {
+	element := queue.list.Front()
+	if element == nil {
+		return nil
+	}
+	return element.Value.(*pendingMessage)
+}
+
+// 按加入的顺序列出所有消息
+func (queue *pendingQueue) All() []*pendingMessage {
+	result := []*pendingMessage{}
+	for element := queue.list.Front(); element != nil; element = element.Next() {
+		result = append(result, element.Value.(*pendingMessage))
+	}
+	return result
+}
+
+// 记录已转发给worker但尚未处理完的消息，调用者需持有mq.mutex
+// 超出数量限制或等待超时的最早的消息不再等待确认，放入死信队列
+func (mq *MQ) addPendingMessage(workerId string, messageObject *message.Message) {
+	if len(workerId) == 0 {
+		return
+	}
+
+	if len(messageObject.Id()) == 0 {
+		messageObject.SetId(stringutil.Rand(16))
+	}
+
+	queue, found := mq.pendingMessages[workerId]
+	if !found {
+		queue = newPendingQueue()
+		mq.pendingMessages[workerId] = queue
+	}
+	now := time.Now()
+	queue.Add(pendingMessageKey(messageObject.FromConnectionId(), messageObject.Id()), messageObject, now)
+
+	maxPending := mq.workerMaxPending()
+	timeout := mq.workerPendingTimeout()
+	count := 0
+	for {
+		oldest := queue.Oldest()
+		if oldest == nil || (queue.Len() <= maxPending && now.Sub(oldest.pendingAt) <= timeout) {
+			break
+		}
+		queue.Remove(oldest.key)
+		mq.deadLetter(DeadLetterReasonNotAcked, oldest.message)
+		count ++
+	}
+	if count > 0 {
+		logs.Warn("worker did not ack messages in time", logs.KeyWorkerId, workerId, "count", count)
+	}
+}
+
+func (mq *MQ) workerMaxPending() int {
+	if mq.currentConfig().Workers.MaxPending > 0 {
+		return mq.currentConfig().Workers.MaxPending
+	}
+	return defaultWorkerMaxPending
+}
+
+func (mq *MQ) workerPendingTimeout() time.Duration {
+	if mq.currentConfig().Workers.PendingTimeout > 0 {
+		return time.Duration(mq.currentConfig().Workers.PendingTimeout) * time.Second
+	}
+	return defaultWorkerPendingTimeout
+}
+
+// 删除已处理完的消息，调用者需持有mq.mutex
+func (mq *MQ) removePendingMessage(workerId string, key string) {
+	queue, found := mq.pendingMessages[workerId]
+	if !found {
+		return
+	}
+	queue.Remove(key)
+	if queue.Len() == 0 {
+		delete(mq.pendingMessages, workerId)
+	}
+}
+
+// worker断开后开始等待其重连，调用者需持有mq.mutex
+func (mq *MQ) waitWorkerResume(workerId string) {
+	if _, found := mq.pendingMessages[workerId]; !found {
+		return
+	}
+
+	if timer, found := mq.resumeTimers[workerId]; found {
+		timer.Stop()
+	}
+	mq.resumeTimers[workerId] = time.AfterFunc(workerResumeTimeout, func() {
+		mq.mutex.Lock()
+		delete(mq.resumeTimers, workerId)
+		queue, found := mq.pendingMessages[workerId]
+		delete(mq.pendingMessages, workerId)
+		mq.mutex.Unlock()
+
+		if !found {
+			return
+		}
+		logs.Warn("worker did not resume, dispatch pending messages to other workers", logs.KeyWorkerId, workerId, "count", queue.Len())
+		for _, pending := range queue.All() {
+			mq.dispatchToWorker(pending.message)
+		}
+	})
+}
+
+// worker重新注册后重新发送未完成的消息，worker会根据消息ID去重，调用者需持有mq.mutex
+func (mq *MQ) resumePendingMessages(workerId string, connection *Connection) {
+	if timer, found := mq.resumeTimers[workerId]; found {
+		timer.Stop()
+		delete(mq.resumeTimers, workerId)
+	}
+
+	queue, found := mq.pendingMessages[workerId]
+	if !found {
+		return
+	}
+
+	logs.Info("resume pending messages", logs.KeyWorkerId, workerId, "count", queue.Len())
+	now := time.Now()
+	for _, pending := range queue.All() {
+		messageObject := pending.message
+
+		// 等待期间过期的消息不再发送
+		if mq.isExpired(messageObject, now) {
+			mq.removePendingMessage(workerId, pending.key)
+			mq.expire(messageObject)
+			continue
+		}
+
+		err := connection.WriteMessage(messageObject, mq.expiresAt(messageObject))
+		if err != nil {
+			logs.Error("resume message failed", logs.KeyWorkerId, workerId, logs.KeyMessageId, messageObject.Id(), logs.KeyError, err)
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package mq
+
+import (
+	"testing"
+	"time"
+	"strconv"
+	"github.com/iwind/TeaMQ/message"
+)
+
+func TestMQ_AddPendingMessage_Limits(t *testing.T) {
+	mq := NewMQ()
+	mq.config.Workers.MaxPending = 2
+
+	// 超出数量限制时淘汰最早的消息
+	for i := 1; i <= 3; i ++ {
+		messageObject := &message.Message{Queue: "GET_USER_PROFILE"}
+		messageObject.SetId("m" + strconv.Itoa(i))
+		mq.addPendingMessage("w1", messageObject)
+	}
+	queue := mq.pendingMessages["w1"]
+	if queue.Len() != 2 || queue.Oldest().message.Id() != "m2" {
+		t.Fatal("oldest message should be removed when exceeding max pending")
+	}
+	letters := mq.deadLetters.List()
+	if len(letters) != 1 || letters[0].Reason != DeadLetterReasonNotAcked || letters[0].Message.Id() != "m1" {
+		t.Fatal("removed message should be dead lettered")
+	}
+
+	// 等待超时的消息也被淘汰
+	queue.Oldest().pendingAt = time.Now().Add(-defaultWorkerPendingTimeout - time.Second)
+	messageObject := &message.Message{Queue: "GET_USER_PROFILE"}
+	messageObject.SetId("m4")
+	mq.addPendingMessage("w1", messageObject)
+	if queue.Len() != 2 || queue.Oldest().message.Id() != "m3" {
+		t.Fatal("timed out message should be removed")
+	}
+	if mq.deadLetters.Len() != 2 {
+		t.Fatal("timed out message should be dead lettered")
+	}
+
+	mq.removePendingMessage("w1", pendingMessageKey(0, "m3"))
+	mq.removePendingMessage("w1", pendingMessageKey(0, "m4"))
+	if len(mq.pendingMessages) != 0 {
+		t.Fatal("worker without pending messages should be removed")
+	}
+}
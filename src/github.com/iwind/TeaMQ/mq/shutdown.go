@@ -0,0 +1,116 @@
+package mq
+
+import (
+	"context"
+	"github.com/iwind/TeaMQ/logs"
+	"sync"
+	"time"
+)
+
+// 没有设置期限时，等待每个连接发送完队列中数据的最长时间
+const defaultShutdownFlushTimeout = 10 * time.Second
+
+// 关闭MQ：停止接受新连接，通知所有客户端和worker，发送完队列中的数据，保存定时消息，然后关闭所有连接
+// ctx到期时强制关闭剩余的连接并返回ctx.Err()，多次调用时等待第一次调用完成
+func (mq *MQ) Shutdown(ctx context.Context) error {
+	mq.mutex.Lock()
+	if mq.isShuttingDown {
+		mq.mutex.Unlock()
+		select {
+		case <-mq.stopped:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	mq.isShuttingDown = true
+	close(mq.done)
+
+	connections := []*Connection{}
+	for _, connection := range mq.connections {
+		connections = append(connections, connection)
+	}
+	mq.mutex.Unlock()
+
+	defer close(mq.stopped)
+
+	logs.Info("shutting down", "connections", len(connections))
+
+	// 停止接受新的连接和请求
+	if mq.server != nil {
+		mq.server.Close()
+	}
+	if mq.cluster != nil {
+		mq.cluster.Stop()
+	}
+	if mq.adminServer != nil {
+		mq.adminServer.Shutdown(ctx)
+	}
+	if mq.metricsServer != nil {
+		mq.metricsServer.Shutdown(ctx)
+	}
+
+	// 通知连接，并等待之前放入队列的数据发送完
+	flushTimeout := defaultShutdownFlushTimeout
+	if deadline, ok := ctx.Deadline(); ok {
+		flushTimeout = time.Until(deadline)
+	}
+	wg := &sync.WaitGroup{}
+	for _, connection := range connections {
+		if connection.IsRemote() {
+			connection.Close()
+			continue
+		}
+
+		err := connection.SendMessage("$tea.mq.shutdown", map[string]interface{}{})
+		if err != nil {
+			logs.Warn("send shutdown notice failed", logs.KeyConnectionId, connection.Id(), logs.KeyError, err)
+		}
+
+		wg.Add(1)
+		go func(connection *Connection) {
+			defer wg.Done()
+			if !connection.Flush(flushTimeout) {
+				logs.Warn("flush connection failed", logs.KeyConnectionId, connection.Id(), "outbound", connection.OutboundLen())
+			}
+			connection.Close()
+		}(connection)
+	}
+	err := waitContext(ctx, wg.Wait)
+
+	// 保存未投递的定时消息
+	mq.scheduler.Stop()
+
+	// 等待所有连接的关闭回调执行完，超时后强制关闭
+	if mq.server != nil {
+		if err == nil {
+			err = waitContext(ctx, mq.server.Wait)
+		}
+		if err != nil {
+			mq.server.CloseClients()
+		}
+	}
+
+	if err != nil {
+		logs.Error("shutdown timeout", logs.KeyError, err)
+		return err
+	}
+	logs.Info("shutdown completed")
+	return nil
+}
+
+// 在ctx到期之前等待wait执行完
+func waitContext(ctx context.Context, wait func()) error {
+	finished := make(chan bool)
+	go func() {
+		wait()
+		close(finished)
+	}()
+
+	select {
+	case <-finished:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
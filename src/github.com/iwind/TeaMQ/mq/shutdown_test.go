@@ -0,0 +1,105 @@
+package mq
+
+import (
+	"testing"
+	"context"
+	"time"
+	"os"
+	"path/filepath"
+	"net"
+	"github.com/iwind/TeaMQ/message"
+)
+
+func TestMQ_Shutdown(t *testing.T) {
+	store := filepath.Join(os.TempDir(), "teamq-shutdown-test", "scheduled.json")
+	defer os.RemoveAll(filepath.Dir(store))
+
+	config := &Config{
+		Bind: "127.0.0.1",
+	}
+	config.Scheduler.Store = store
+
+	mq := startTestMQ(t, config)
+	waitErr := make(chan error, 1)
+	go func() {
+		waitErr <- mq.Wait()
+	}()
+
+	client := dialTestNode(t, mq)
+	client.send(map[string]interface{}{
+		"queue": "$tea.connection.ping",
+	})
+	client.read()
+
+	messageObject := &message.Message{Queue: "REMIND", Body: map[string]interface{}{"text": "hello"}}
+	messageObject.SetId("remind1")
+	mq.scheduler.Add("worker:w1", messageObject, true, time.Now().Add(time.Hour))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err := mq.Shutdown(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if notice := client.read(); notice["queue"] != "$tea.mq.shutdown" {
+		t.Fatal("expected shutdown notice, got:", notice)
+	}
+	if client.scanner.Scan() {
+		t.Fatal("connection should be closed after shutdown")
+	}
+
+	select {
+	case err := <-waitErr:
+		if err != nil {
+			t.Fatal("Wait() should return nil after shutdown, got:", err)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("Wait() should return after shutdown")
+	}
+
+	conn, err := net.Dial("tcp", mq.Addr().String())
+	if err == nil {
+		conn.Close()
+		t.Fatal("new connections should be refused after shutdown")
+	}
+
+	if len(mq.connections) != 0 {
+		t.Fatal("connections should be removed, left:", len(mq.connections))
+	}
+
+	restored := NewScheduler()
+	if err := restored.Load(store); err != nil {
+		t.Fatal(err)
+	}
+	if _, found := restored.Find("worker:w1", "remind1"); !found {
+		t.Fatal("scheduled messages should be saved on shutdown")
+	}
+
+	// 再次调用时直接返回
+	if err := mq.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMQ_Shutdown_AcceptAfterShuttingDown(t *testing.T) {
+	mq := startTestMQ(t, &Config{Bind: "127.0.0.1"})
+
+	// 模拟在开始关闭和停止监听之间接受的连接
+	mq.mutex.Lock()
+	mq.isShuttingDown = true
+	mq.mutex.Unlock()
+
+	client := dialTestNode(t, mq)
+	client.conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	if client.scanner.Scan() {
+		t.Fatal("connection accepted after shutting down should be closed")
+	}
+	mq.mutex.Lock()
+	count := len(mq.connections)
+	mq.isShuttingDown = false
+	mq.mutex.Unlock()
+	if count != 0 {
+		t.Fatal("connection accepted after shutting down should not be added")
+	}
+}
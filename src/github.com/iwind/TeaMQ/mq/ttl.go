@@ -0,0 +1,79 @@
+package mq
+
+import (
+	"github.com/iwind/TeaMQ/message"
+	"time"
+	"path"
+	"github.com/iwind/TeaMQ/logs"
+)
+
+// 消息过期后的处理方式
+const (
+	TTLActionDrop       = "drop"       // 直接丢弃
+	TTLActionDeadLetter = "deadletter" // 放入死信队列
+)
+
+// 取得消息的有效期，消息自身的设置优先，其次是队列的设置，单位为秒
+func (mq *MQ) messageTTL(messageObject *message.Message) float64 {
+	if messageObject.TTL > 0 {
+		return messageObject.TTL
+	}
+
+	queues := mq.currentConfig().TTL.Queues
+	if len(queues) == 0 {
+		return 0
+	}
+
+	// 完全匹配优先，其次是最长的通配符
+	if ttl, found := queues[messageObject.Queue]; found {
+		return ttl
+	}
+	matchedPattern := ""
+	ttl := float64(0)
+	for pattern, patternTTL := range queues {
+		matched, err := path.Match(pattern, messageObject.Queue)
+		if err != nil || !matched {
+			continue
+		}
+		if len(pattern) > len(matchedPattern) || (len(pattern) == len(matchedPattern) && pattern < matchedPattern) {
+			matchedPattern = pattern
+			ttl = patternTTL
+		}
+	}
+	return ttl
+}
+
+// 取得消息的过期时间，为零值时不过期
+func (mq *MQ) expiresAt(messageObject *message.Message) time.Time {
+	return messageObject.ExpiresAt(mq.messageTTL(messageObject))
+}
+
+// 判断消息是否已过期
+func (mq *MQ) isExpired(messageObject *message.Message, now time.Time) bool {
+	expiresAt := mq.expiresAt(messageObject)
+	return !expiresAt.IsZero() && now.After(expiresAt)
+}
+
+// 处理过期的消息
+func (mq *MQ) expire(messageObject *message.Message) {
+	mq.countRoutingFailure(DeadLetterReasonExpired)
+	if mq.currentConfig().TTL.Action == TTLActionDeadLetter {
+		mq.deadLetters.Add(DeadLetterReasonExpired, messageObject)
+		return
+	}
+	logs.Info("drop expired message", logs.KeyQueue, messageObject.Queue, logs.KeyMessageId, messageObject.Id(), logs.KeyConnectionId, messageObject.FromConnectionId())
+}
+
+// 处理在连接发送队列中过期的消息，同时不再等待worker处理
+func (mq *MQ) expireOutbound(messageObject *message.Message) {
+	mq.mutex.Lock()
+	key := pendingMessageKey(messageObject.FromConnectionId(), messageObject.Id())
+	for workerId, queue := range mq.pendingMessages {
+		if queue.Contains(key) {
+			mq.removePendingMessage(workerId, key)
+		}
+	}
+	mq.mutex.Unlock()
+
+	mq.expire(messageObject)
+}
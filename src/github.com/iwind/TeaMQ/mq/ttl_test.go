@@ -0,0 +1,66 @@
+package mq
+
+import (
+	"testing"
+	"time"
+	"github.com/iwind/TeaMQ/message"
+)
+
+func TestMQ_MessageTTL(t *testing.T) {
+	mq := NewMQ()
+	mq.config.TTL.Queues = map[string]float64{
+		"user.*":           60,
+		"user.profile.*":   30,
+		"user.profile.get": 10,
+	}
+
+	for queue, ttl := range map[string]float64{
+		"user.login":       60,
+		"user.profile.set": 30,
+		"user.profile.get": 10,
+		"GET_USER_PROFILE": 0,
+	} {
+		if mq.messageTTL(&message.Message{Queue: queue}) != ttl {
+			t.Fatal("ttl of queue '" + queue + "' is wrong")
+		}
+	}
+
+	// 消息自身的设置优先
+	if mq.messageTTL(&message.Message{Queue: "user.login", TTL: 5}) != 5 {
+		t.Fatal("message ttl should override queue ttl")
+	}
+}
+
+func TestMQ_DispatchToWorker_Expired(t *testing.T) {
+	mq := NewMQ()
+	mq.config.TTL.Action = TTLActionDeadLetter
+
+	messageObject := &message.Message{
+		Queue:     "GET_USER_PROFILE",
+		TTL:       1,
+		DeliverAt: float64(time.Now().Add(-10 * time.Second).Unix()),
+	}
+	if !mq.isExpired(messageObject, time.Now()) {
+		t.Fatal("message should be expired")
+	}
+	mq.dispatchToWorker(messageObject)
+
+	letters := mq.deadLetters.List()
+	if len(letters) != 1 || letters[0].Reason != DeadLetterReasonExpired {
+		t.Fatal("expired message should be dead lettered")
+	}
+}
+
+func TestMQ_ExpireOutbound(t *testing.T) {
+	mq := NewMQ()
+	messageObject := &message.Message{Queue: "GET_USER_PROFILE"}
+	mq.addPendingMessage("w1", messageObject)
+
+	mq.expireOutbound(messageObject)
+	if len(mq.pendingMessages) != 0 {
+		t.Fatal("expired message should not be pending")
+	}
+	if mq.deadLetters.Len() != 0 {
+		t.Fatal("expired message should be dropped by default")
+	}
+}
@@ -6,8 +6,9 @@ import (
 )
 
 type Client struct {
-	id         int
-	connection net.Conn
+	id           int
+	connection   net.Conn
+	maxFrameSize int
 }
 
 func (client *Client) Id() int {
@@ -18,6 +19,16 @@ func (client *Client) SetId(id int) {
 	client.id = id
 }
 
+// 设置单条数据（一行）的最大长度
+func (client *Client) SetMaxFrameSize(maxFrameSize int) {
+	client.maxFrameSize = maxFrameSize
+}
+
+// 远程地址
+func (client *Client) RemoteAddr() net.Addr {
+	return client.connection.RemoteAddr()
+}
+
 func (client *Client) Write(message string) (int, error) {
 	return client.connection.Write([]byte(message))
 }
@@ -34,6 +45,11 @@ func (client *Client) Close() {
 	client.connection.Close()
 }
 
+// 使用已建立的连接，如内存连接
+func (client *Client) SetConnection(conn net.Conn) {
+	client.connection = conn
+}
+
 func (client *Client) Connect(network string, address string) error {
 	conn, err := net.Dial(network, address)
 	if err != nil {
@@ -44,7 +60,13 @@ func (client *Client) Connect(network string, address string) error {
 }
 
 func (client *Client) Receive(receiver func(message string)) {
+	maxFrameSize := client.maxFrameSize
+	if maxFrameSize <= 0 {
+		maxFrameSize = DefaultMaxFrameSize
+	}
+
 	scanner := bufio.NewScanner(client.connection)
+	scanner.Buffer(make([]byte, 0, initialFrameBufferSize(maxFrameSize)), maxFrameSize)
 	for scanner.Scan() {
 		receiver(scanner.Text())
 	}
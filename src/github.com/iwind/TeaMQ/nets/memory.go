@@ -0,0 +1,70 @@
+package nets
+
+import (
+	"net"
+	"errors"
+	"sync"
+)
+
+// 内存中的监听器，通过Dial()建立的连接不经过网络，用于测试或在同一进程中嵌入
+type MemoryListener struct {
+	conns    chan net.Conn
+	done     chan bool
+	isClosed bool
+
+	mutex *sync.Mutex
+}
+
+// 内存监听器的地址
+type memoryAddr struct{}
+
+func (addr memoryAddr) Network() string {
+	return "memory"
+}
+
+func (addr memoryAddr) String() string {
+	return "memory"
+}
+
+func NewMemoryListener() *MemoryListener {
+	return &MemoryListener{
+		conns: make(chan net.Conn),
+		done:  make(chan bool),
+		mutex: &sync.Mutex{},
+	}
+}
+
+// 建立一对内存连接，一端返回给调用者，另一端由Accept()返回
+func (listener *MemoryListener) Dial() (net.Conn, error) {
+	serverConn, clientConn := net.Pipe()
+	select {
+	case <-listener.done:
+		return nil, errors.New("the memory listener is closed")
+	case listener.conns <- serverConn:
+		return clientConn, nil
+	}
+}
+
+func (listener *MemoryListener) Accept() (net.Conn, error) {
+	select {
+	case <-listener.done:
+		return nil, errors.New("the memory listener is closed")
+	case conn := <-listener.conns:
+		return conn, nil
+	}
+}
+
+func (listener *MemoryListener) Close() error {
+	listener.mutex.Lock()
+	defer listener.mutex.Unlock()
+
+	if !listener.isClosed {
+		listener.isClosed = true
+		close(listener.done)
+	}
+	return nil
+}
+
+func (listener *MemoryListener) Addr() net.Addr {
+	return memoryAddr{}
+}
@@ -2,25 +2,56 @@ package nets
 
 import (
 	"net"
-	"log"
+	"github.com/iwind/TeaMQ/logs"
 	"bufio"
+	"sync"
+	"time"
+	"errors"
+)
+
+// 默认单条数据的最大长度
+const DefaultMaxFrameSize = 1024 * 1024
+
+// 接受连接遇到临时错误时的重试间隔
+const (
+	minAcceptRetryDelay = 5 * time.Millisecond
+	maxAcceptRetryDelay = time.Second
 )
 
 type Server struct {
 	network string
 	address string
 
-	listener net.Listener
+	listener     net.Listener
+	maxFrameSize int
 
 	onAcceptClient  func(client *Client)
 	onCloseClient   func(client *Client)
 	onReceiveClient func(client *Client, data []byte)
+	onErrorClient   func(client *Client, err error)
+
+	clients   map[*Client]bool // 正在读取数据的连接
+	clientsWg *sync.WaitGroup
+	isClosed  bool
+
+	mutex *sync.Mutex
 }
 
 func NewServer(network, address string) *Server {
 	return &Server{
-		network: network,
-		address: address,
+		network:      network,
+		address:      address,
+		maxFrameSize: DefaultMaxFrameSize,
+		clients:      map[*Client]bool{},
+		clientsWg:    &sync.WaitGroup{},
+		mutex:        &sync.Mutex{},
+	}
+}
+
+// 设置单条数据（一行）的最大长度，超出后关闭连接
+func (server *Server) SetMaxFrameSize(maxFrameSize int) {
+	if maxFrameSize > 0 {
+		server.maxFrameSize = maxFrameSize
 	}
 }
 
@@ -36,20 +67,82 @@ func (server *Server) ReceiveClient(callback func(client *Client, data []byte))
 	server.onReceiveClient = callback
 }
 
-func (server *Server) Listen() error {
+// 读取数据出错时的回调，回调之后会关闭连接，如数据超出最大长度（bufio.ErrTooLong）
+func (server *Server) ErrorClient(callback func(client *Client, err error)) {
+	server.onErrorClient = callback
+}
+
+// 使用已有的监听器，如内存监听器，之后不再监听network和address
+func (server *Server) SetListener(listener net.Listener) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	server.listener = listener
+}
+
+// 开始监听端口，但不接受连接，之后可以通过Addr()取得实际监听的地址
+func (server *Server) Bind() error {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	if server.listener != nil {
+		return nil
+	}
+	if server.isClosed {
+		return errors.New("the server is closed")
+	}
 	listener, err := net.Listen(server.network, server.address)
 	if err != nil {
 		return err
 	}
 	server.listener = listener
+	return nil
+}
+
+// 实际监听的地址，在Bind()或Listen()之后才有值
+func (server *Server) Addr() net.Addr {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	if server.listener == nil {
+		return nil
+	}
+	return server.listener.Addr()
+}
+
+// 监听并接受连接，调用Close()后返回nil
+func (server *Server) Listen() error {
+	err := server.Bind()
+	if err != nil {
+		return err
+	}
+	server.mutex.Lock()
+	listener := server.listener
+	server.mutex.Unlock()
 
 	var id int
+	var retryDelay time.Duration
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
-			log.Println(err)
-			continue
+			if server.IsClosed() {
+				return nil
+			}
+
+			// 临时错误（如打开的文件过多）时等待一段时间后重试，其他错误直接返回
+			if netErr, ok := err.(net.Error); ok && netErr.Temporary() {
+				retryDelay *= 2
+				if retryDelay < minAcceptRetryDelay {
+					retryDelay = minAcceptRetryDelay
+				} else if retryDelay > maxAcceptRetryDelay {
+					retryDelay = maxAcceptRetryDelay
+				}
+				logs.Error("accept connection failed", logs.KeyError, err, "retryDelay", retryDelay)
+				time.Sleep(retryDelay)
+				continue
+			}
+			return err
 		}
+		retryDelay = 0
 
 		id ++
 
@@ -57,27 +150,97 @@ func (server *Server) Listen() error {
 			id:         id,
 			connection: conn,
 		}
+		if !server.addClient(client) {
+			conn.Close()
+			return nil
+		}
 		if server.onAcceptClient != nil {
 			server.onAcceptClient(client)
 		}
 		go func(client *Client) {
-			input := bufio.NewScanner(client.connection)
-			for input.Scan() {
-				if server.onReceiveClient != nil {
-					server.onReceiveClient(client, input.Bytes())
-				}
-			}
-
 			defer func() {
 				client.connection.Close()
 				if server.onCloseClient != nil {
 					server.onCloseClient(client)
 				}
+				server.removeClient(client)
 			}()
+
+			input := bufio.NewScanner(client.connection)
+			input.Buffer(make([]byte, 0, initialFrameBufferSize(server.maxFrameSize)), server.maxFrameSize)
+			for input.Scan() {
+				if server.onReceiveClient != nil {
+					server.onReceiveClient(client, input.Bytes())
+				}
+			}
+			if err := input.Err(); err != nil && server.onErrorClient != nil {
+				server.onErrorClient(client, err)
+			}
 		}(client)
 	}
 }
 
+// 停止接受新的连接，已有的连接不受影响
 func (server *Server) Close() {
-	server.listener.Close()
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	if server.isClosed {
+		return
+	}
+	server.isClosed = true
+	if server.listener != nil {
+		server.listener.Close()
+	}
+}
+
+// 是否已调用Close()
+func (server *Server) IsClosed() bool {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	return server.isClosed
+}
+
+// 关闭所有已接受的连接
+func (server *Server) CloseClients() {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	for client := range server.clients {
+		client.connection.Close()
+	}
+}
+
+// 等待所有连接关闭，并且关闭连接的回调执行完
+func (server *Server) Wait() {
+	server.clientsWg.Wait()
+}
+
+// 记录新的连接，已关闭时返回false
+func (server *Server) addClient(client *Client) bool {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	if server.isClosed {
+		return false
+	}
+	server.clients[client] = true
+	server.clientsWg.Add(1)
+	return true
+}
+
+func (server *Server) removeClient(client *Client) {
+	server.mutex.Lock()
+	delete(server.clients, client)
+	server.mutex.Unlock()
+
+	server.clientsWg.Done()
+}
+
+// 缓冲区初始大小，按需增长到最大长度
+func initialFrameBufferSize(maxFrameSize int) int {
+	if maxFrameSize < 4096 {
+		return maxFrameSize
+	}
+	return 4096
 }
@@ -2,13 +2,36 @@ package nets
 
 import (
 	"testing"
-	"log"
 	"strings"
 	"sync"
 	"fmt"
 	"time"
 )
 
+// 使用内存监听器启动服务
+func startMemoryServer(t *testing.T, server *Server) *MemoryListener {
+	listener := NewMemoryListener()
+	server.SetListener(listener)
+	go func() {
+		err := server.Listen()
+		if err != nil {
+			t.Error(err)
+		}
+	}()
+	return listener
+}
+
+// 通过内存连接建立客户端，可能在其他goroutine中调用，所以返回错误而不是直接失败
+func dialMemoryClient(listener *MemoryListener) (*Client, error) {
+	conn, err := listener.Dial()
+	if err != nil {
+		return nil, err
+	}
+	client := &Client{}
+	client.SetConnection(conn)
+	return client, nil
+}
+
 func TestNewServer(t *testing.T) {
 	var server = NewServer("tcp", "localhost:8001")
 	var clients = map[int]*Client{}
@@ -17,84 +40,167 @@ func TestNewServer(t *testing.T) {
 		mux.Lock()
 		clients[client.id] = client
 		mux.Unlock()
-		log.Println("accept ", client.id)
 	})
-	server.ReceiveClient(func(client *Client, message string) {
+	server.ReceiveClient(func(client *Client, data []byte) {
+		message := string(data)
 		if strings.TrimSpace(message) == "quit" {
 			client.Close()
 			return
 		}
 		client.Writeln("OK")
-		log.Println("receive ", client.id, " ", message)
+
+		// 转发给其他连接
+		mux.Lock()
+		defer mux.Unlock()
 		for i, c := range clients {
 			if i != client.id {
-				go func(c *Client) {
-					log.Println("write message to ", i)
-					now := time.Now()
-					c.Write(message + "|" + fmt.Sprintf("%d", now.Nanosecond()) + "\n")
-				}(c)
+				go c.Writeln(message)
 			}
 		}
 	})
+	closed := make(chan int, 2)
 	server.CloseClient(func(client *Client) {
 		mux.Lock()
 		delete(clients, client.id)
-		log.Println("close ", client.id, " left:", len(clients))
 		mux.Unlock()
+		closed <- client.id
 	})
-	server.Listen()
-}
+	listener := startMemoryServer(t, server)
+	defer server.Close()
 
-func TestNewServerSimple(t *testing.T) {
-	var server = NewServer("tcp", "localhost:8001")
-	var clients = map[int]*Client{}
-	var mux sync.Mutex
-	server.AcceptClient(func(client *Client) {
-		mux.Lock()
-		clients[client.id] = client
-		mux.Unlock()
-		log.Println("clients:", len(clients))
+	client1, err := dialMemoryClient(listener)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client2, err := dialMemoryClient(listener)
+	if err != nil {
+		t.Fatal(err)
+	}
+	received1 := make(chan string, 10)
+	received2 := make(chan string, 10)
+	go client1.Receive(func(message string) {
+		received1 <- message
 	})
-	server.ReceiveClient(func(client *Client, message string) {
-		log.Println(message)
-		client.Writeln("OK")
+	go client2.Receive(func(message string) {
+		received2 <- message
 	})
-	server.CloseClient(func(client *Client) {
+
+	// 等待两个连接都被接受
+	for {
 		mux.Lock()
-		delete(clients, client.id)
+		count := len(clients)
 		mux.Unlock()
-	})
-	server.Listen()
+		if count == 2 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	client1.Writeln("Hello")
+	for _, expected := range []struct {
+		received chan string
+		message  string
+	}{
+		{received1, "OK"},
+		{received2, "Hello"},
+	} {
+		select {
+		case message := <-expected.received:
+			if message != expected.message {
+				t.Fatal("expected '" + expected.message + "', got '" + message + "'")
+			}
+		case <-time.After(time.Second):
+			t.Fatal("expected '" + expected.message + "' within 1s")
+		}
+	}
+
+	client1.Writeln("quit")
+	client2.Close()
+	for i := 0; i < 2; i ++ {
+		select {
+		case <-closed:
+		case <-time.After(time.Second):
+			t.Fatal("connections should be closed")
+		}
+	}
 }
 
-func TestClient(t *testing.T) {
-	client := &Client{}
-	err := client.Connect("tcp", "localhost:8001")
+func TestNewServerSimple(t *testing.T) {
+	var server = NewServer("tcp", "localhost:8001")
+	server.ReceiveClient(func(client *Client, data []byte) {
+		client.Writeln("OK")
+	})
+	listener := startMemoryServer(t, server)
+	defer server.Close()
+
+	client, err := dialMemoryClient(listener)
 	if err != nil {
 		t.Fatal(err)
 	}
+	defer client.Close()
 	go client.Writeln("Hello")
 	client.Receive(func(message string) {
-		log.Println("received:", message)
+		if message != "OK" {
+			t.Fatal("unexpected message:", message)
+		}
+		client.Close()
 	})
-	t.Log("finished")
 }
 
 func TestMultipleClients(t *testing.T) {
-	for i := 0; i < 2000; i ++ {
+	var server = NewServer("tcp", "localhost:8001")
+	server.ReceiveClient(func(client *Client, data []byte) {
+		client.Writeln("OK " + string(data))
+	})
+	listener := startMemoryServer(t, server)
+
+	wg := &sync.WaitGroup{}
+	errs := make(chan error, 200)
+	for i := 0; i < 200; i ++ {
+		wg.Add(1)
 		go func(i int) {
-			client := &Client{}
-			err := client.Connect("tcp", "localhost:8001")
+			defer wg.Done()
+
+			client, err := dialMemoryClient(listener)
 			if err != nil {
-				log.Println(err)
+				errs <- err
 				return
 			}
-			log.Println("connected:", i)
+			go client.Writeln(fmt.Sprintf("%d", i))
 			client.Receive(func(message string) {
-				log.Println("received:", message)
+				if message != fmt.Sprintf("OK %d", i) {
+					t.Error("unexpected message:", message)
+				}
+				client.Close()
 			})
-			t.Log("finished ", i)
 		}(i)
 	}
-	time.Sleep(20 * time.Second)
+	wg.Wait()
+
+	server.Close()
+	server.Wait()
+
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+}
+
+func TestServer_Close(t *testing.T) {
+	var server = NewServer("tcp", "127.0.0.1:0")
+	listenErr := make(chan error, 1)
+	go func() {
+		listenErr <- server.Listen()
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	server.Close()
+	select {
+	case err := <-listenErr:
+		if err != nil {
+			t.Fatal("Listen() should return nil after Close(), got:", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Listen() should return after Close()")
+	}
 }
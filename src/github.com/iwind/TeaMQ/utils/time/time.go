@@ -5,6 +5,7 @@ import (
 	"bytes"
 	"strconv"
 	"fmt"
+	"strings"
 )
 
 var weekShortDays = [...]string{
@@ -97,3 +98,51 @@ func Format(t time.Time, format string) string {
 
 	return buffer.String()
 }
+
+// 解析时间，支持unix时间戳（秒，可以带小数）、RFC3339格式和 "Y-m-d H:i:s" 格式，后者使用本地时区
+func Parse(value string) (time.Time, error) {
+	value = strings.TrimSpace(value)
+
+	timestamp, err := strconv.ParseFloat(value, 64)
+	if err == nil {
+		return FromUnixFloat(timestamp), nil
+	}
+
+	t, err := time.Parse(time.RFC3339Nano, value)
+	if err == nil {
+		return t, nil
+	}
+
+	t, err = time.ParseInLocation("2006-01-02 15:04:05", value, time.Local)
+	if err == nil {
+		return t, nil
+	}
+
+	return time.Time{}, fmt.Errorf("can not parse time '%s'", value)
+}
+
+// 解析时间长度，支持秒数（可以带小数）和Go的时间长度格式，如 10s, 5m, 1h30m
+func ParseDuration(value string) (time.Duration, error) {
+	value = strings.TrimSpace(value)
+
+	seconds, err := strconv.ParseFloat(value, 64)
+	if err == nil {
+		return time.Duration(seconds * float64(time.Second)), nil
+	}
+
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("can not parse duration '%s'", value)
+	}
+	return duration, nil
+}
+
+// 转换为unix时间戳，单位为秒，带小数
+func UnixFloat(t time.Time) float64 {
+	return float64(t.UnixNano()) / 1000000000
+}
+
+// 从带小数的unix时间戳转换为时间
+func FromUnixFloat(timestamp float64) time.Time {
+	return time.Unix(0, int64(timestamp*1000000000))
+}
@@ -0,0 +1,40 @@
+package timeutil
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParse(t *testing.T) {
+	for _, value := range []string{"1527397329.5", "2018-05-27T05:02:09Z", "2018-05-27 13:02:09"} {
+		result, err := Parse(value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Log(value, "=>", result)
+	}
+
+	_, err := Parse("tomorrow")
+	if err == nil {
+		t.Fatal("invalid time should return error")
+	}
+}
+
+func TestParseDuration(t *testing.T) {
+	duration, err := ParseDuration("1.5")
+	if err != nil || duration != 1500*time.Millisecond {
+		t.Fatal("1.5 should be 1.5s")
+	}
+
+	duration, err = ParseDuration("1h30m")
+	if err != nil || duration != 90*time.Minute {
+		t.Fatal("1h30m should be 90m")
+	}
+}
+
+func TestUnixFloat(t *testing.T) {
+	now := time.Now()
+	if FromUnixFloat(UnixFloat(now)).Sub(now) > time.Microsecond {
+		t.Fatal("convert failed")
+	}
+}
@@ -1,10 +1,18 @@
 package worker
 
+import (
+	"time"
+	"github.com/iwind/TeaMQ/utils/string"
+)
+
+// 最多保存的状态数
+const maxStates = 10
+
 type Worker struct {
 	Id          string // ID
 	Name        string // 名称
 	Description string // 描述
-	Key         string // 密钥
+	Key         string // 注册时使用的密钥的标识，不保存密钥本身
 
 	IP string // 所在服务器的IP
 
@@ -16,12 +24,17 @@ type Worker struct {
 	IsAvailable bool // 是否可用
 	Weight      int  // 权重
 	IsBackup    bool // 是否为备用节点，当其余节点不可用的时候才使用
+	IsDraining  bool // 是否正在下线，下线中的节点不再接收新的消息
 
 	MaxMessagesPerSecond int // 每秒支持的最大消息数
+	InFlight             int // 最后一次上报状态之后转发给此节点的消息数，上报状态时清零
+
+	HeartbeatAt time.Time // 最后一次心跳时间
 
 	Options map[string]interface{} // 选项
 	Tags    []string               // 标签，用来将节点进行分组
-	States  []State                // 节点状态，包括CPU、负载、内存等信息
+	Types   []string               // 能处理的消息类型，为空时表示能处理所有类型
+	States  []State                // 节点状态，包括CPU、负载、内存等信息，按时间先后排列
 
 	User struct {
 		Min int64
@@ -38,5 +51,71 @@ func NewWorker() (*Worker) {
 	}
 }
 
+// 判断是否带有某个标签
+func (worker *Worker) HasTag(tag string) bool {
+	return stringutil.Contains(worker.Tags, tag)
+}
+
+// 判断用户是否在worker负责的范围内
+func (worker *Worker) ContainsUser(userId int64) bool {
+	return userId > 0 && worker.User.Min <= userId && worker.User.Max >= userId
+}
+
+// 判断用户范围是否和另一个worker重叠
+func (worker *Worker) OverlapsUsers(other *Worker) bool {
+	return worker.User.Min <= other.User.Max && other.User.Min <= worker.User.Max
+}
+
+// 添加状态，只保留最近的几个，新的状态中已经包含之前转发的消息
+func (worker *Worker) AddState(state State) {
+	worker.InFlight = 0
+	worker.States = append(worker.States, state)
+	if len(worker.States) > maxStates {
+		worker.States = worker.States[len(worker.States)-maxStates:]
+	}
+}
+
+// 取得最新的状态
+func (worker *Worker) State() *State {
+	if len(worker.States) == 0 {
+		return nil
+	}
+	return &worker.States[len(worker.States)-1]
+}
+
+// 估计的待处理消息数，为上报的消息数加上上报之后转发给此节点的消息数
+func (worker *Worker) QueueDepth() int {
+	depth := worker.InFlight
+	if state := worker.State(); state != nil {
+		depth += state.QueueDepth
+	}
+	return depth
+}
+
+// 判断当前worker的负载是否比另一个低，先比较估计的待处理消息数，再比较CPU使用率
+func (worker *Worker) IsLessLoaded(other *Worker) bool {
+	depth := worker.QueueDepth()
+	otherDepth := other.QueueDepth()
+	if depth != otherDepth {
+		return depth < otherDepth
+	}
+	state := worker.State()
+	otherState := other.State()
+	if state == nil || otherState == nil {
+		return state == nil && otherState != nil
+	}
+	return state.CPU < otherState.CPU
+}
+
+// 节点状态，由worker在心跳中上报
 type State struct {
+	CPU               float64   // CPU使用率 0-100
+	Memory            uint64    // 内存占用，单位为字节
+	Goroutines        int       // goroutine数量
+	Load1             float64   // 1分钟平均负载
+	Load5             float64   // 5分钟平均负载
+	Load15            float64   // 15分钟平均负载
+	QueueDepth        int       // 正在处理的消息数
+	MessagesPerSecond float64   // 每秒处理的消息数
+	CreatedAt         time.Time // 上报时间
 }
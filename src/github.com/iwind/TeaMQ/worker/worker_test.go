@@ -0,0 +1,44 @@
+package worker
+
+import "testing"
+
+func TestWorker_AddState(t *testing.T) {
+	worker := NewWorker()
+	if worker.State() != nil {
+		t.Fatal("new worker should not have state")
+	}
+	for i := 0; i < maxStates+5; i ++ {
+		worker.AddState(State{QueueDepth: i})
+	}
+	if len(worker.States) != maxStates {
+		t.Fatalf("expected %d states, got %d", maxStates, len(worker.States))
+	}
+	if worker.State().QueueDepth != maxStates+4 {
+		t.Fatal("latest state should be the last added")
+	}
+}
+
+func TestWorker_IsLessLoaded(t *testing.T) {
+	busy := NewWorker()
+	busy.AddState(State{QueueDepth: 10, CPU: 10})
+
+	idle := NewWorker()
+	idle.AddState(State{QueueDepth: 1, CPU: 90})
+
+	if !idle.IsLessLoaded(busy) || busy.IsLessLoaded(idle) {
+		t.Fatal("worker with less queued messages should be less loaded")
+	}
+	if !NewWorker().IsLessLoaded(busy) {
+		t.Fatal("worker without state should be preferred")
+	}
+
+	// 上报状态之后转发的消息也计入负载
+	idle.InFlight = 10
+	if idle.IsLessLoaded(busy) || !busy.IsLessLoaded(idle) {
+		t.Fatal("messages in flight should be counted")
+	}
+	idle.AddState(State{QueueDepth: 1, CPU: 90})
+	if idle.InFlight != 0 || !idle.IsLessLoaded(busy) {
+		t.Fatal("messages in flight should be reset after reporting state")
+	}
+}
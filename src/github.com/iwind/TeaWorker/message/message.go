@@ -1,10 +1,19 @@
 package message
 
-import "encoding/json"
+import (
+	"encoding/json"
+	"errors"
+)
 
 type Message struct {
+	Id    string
 	Queue string
 	Body  map[string]interface{}
+
+	FromUserId       int64 // 发送消息的用户ID，由MQ填充
+	FromConnectionId int   // 发送消息的连接ID，由MQ填充
+	ToConnectionId   int   // 回复的目标连接ID
+	ToUserId         int64 // 发送给某个用户的所有连接，MQ集群中该用户连接在其他节点上时也会转发
 }
 
 func NewMessage() *Message {
@@ -14,15 +23,69 @@ func NewMessage() *Message {
 	}
 }
 
+// 从MQ发来的数据中解析消息，MQ的响应数据中不包含queue
+func Unmarshal(data []byte) (*Message, error) {
+	messageJSON := &struct {
+		Id               string                 `json:"id"`
+		Queue            string                 `json:"queue"`
+		Body             map[string]interface{} `json:"body"`
+		FromUserId       int64                  `json:"fromUserId"`
+		FromConnectionId int                    `json:"fromConnectionId"`
+	}{}
+	err := json.Unmarshal(data, messageJSON)
+	if err != nil {
+		return nil, err
+	}
+	if messageJSON.Body == nil {
+		messageJSON.Body = map[string]interface{}{}
+	}
+
+	return &Message{
+		Id:               messageJSON.Id,
+		Queue:            messageJSON.Queue,
+		Body:             messageJSON.Body,
+		FromUserId:       messageJSON.FromUserId,
+		FromConnectionId: messageJSON.FromConnectionId,
+	}, nil
+}
+
 func (message *Message) Set(key string, value interface{}) {
 	message.Body[key] = value
 }
 
+func (message *Message) Get(key string) (interface{}, bool) {
+	value, found := message.Body[key]
+	return value, found
+}
+
+// 生成对当前消息的回复
+func (message *Message) Reply() (*Message, error) {
+	if message.FromConnectionId <= 0 {
+		return nil, errors.New("the message can not be replied, 'fromConnectionId' is missing")
+	}
+
+	reply := NewMessage()
+	reply.Id = message.Id
+	reply.Queue = message.Queue
+	reply.ToConnectionId = message.FromConnectionId
+	return reply, nil
+}
+
 func (message *Message) Encode() ([]byte, error) {
-	data, err := json.Marshal(map[string]interface{}{
+	messageJSON := map[string]interface{}{
 		"queue": message.Queue,
 		"body":  message.Body,
-	})
+	}
+	if len(message.Id) > 0 {
+		messageJSON["id"] = message.Id
+	}
+	if message.ToUserId > 0 {
+		messageJSON["toUserId"] = message.ToUserId
+	}
+	if message.ToConnectionId > 0 {
+		messageJSON["toConnectionId"] = message.ToConnectionId
+	}
+	data, err := json.Marshal(messageJSON)
 	if err == nil {
 		data = append(data, []byte("\n")...)
 	}
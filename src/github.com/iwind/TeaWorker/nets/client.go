@@ -5,9 +5,13 @@ import (
 	"bufio"
 )
 
+// 默认单条数据的最大长度，需要和MQ中的设置一致
+const DefaultMaxFrameSize = 1024 * 1024
+
 type Client struct {
-	id         int
-	connection net.Conn
+	id           int
+	connection   net.Conn
+	maxFrameSize int
 }
 
 func (client *Client) Id() int {
@@ -18,6 +22,11 @@ func (client *Client) SetId(id int) {
 	client.id = id
 }
 
+// 设置单条数据（一行）的最大长度
+func (client *Client) SetMaxFrameSize(maxFrameSize int) {
+	client.maxFrameSize = maxFrameSize
+}
+
 func (client *Client) Write(message string) (int, error) {
 	return client.connection.Write([]byte(message))
 }
@@ -34,6 +43,11 @@ func (client *Client) Close() {
 	client.connection.Close()
 }
 
+// 使用已建立的连接，如内存连接
+func (client *Client) SetConnection(conn net.Conn) {
+	client.connection = conn
+}
+
 func (client *Client) Connect(network string, address string) error {
 	conn, err := net.Dial(network, address)
 	if err != nil {
@@ -43,9 +57,17 @@ func (client *Client) Connect(network string, address string) error {
 	return nil
 }
 
-func (client *Client) Receive(receiver func(data []byte)) {
+// 接收数据，直到连接关闭或出错
+func (client *Client) Receive(receiver func(data []byte)) error {
+	maxFrameSize := client.maxFrameSize
+	if maxFrameSize <= 0 {
+		maxFrameSize = DefaultMaxFrameSize
+	}
+
 	scanner := bufio.NewScanner(client.connection)
+	scanner.Buffer(make([]byte, 0, 4096), maxFrameSize)
 	for scanner.Scan() {
 		receiver(scanner.Bytes())
 	}
+	return scanner.Err()
 }
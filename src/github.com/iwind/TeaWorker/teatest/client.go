@@ -0,0 +1,208 @@
+package teatest
+
+import (
+	"testing"
+	"net"
+	"bufio"
+	"encoding/json"
+	"sync"
+	"time"
+	"github.com/iwind/TeaMQ/utils/string"
+	"github.com/iwind/TeaMQ/nets"
+)
+
+// 客户端收到的数据，可能是消息或MQ的响应
+type Frame map[string]interface{}
+
+func (frame Frame) Id() string {
+	id, _ := frame["id"].(string)
+	return id
+}
+
+func (frame Frame) Queue() string {
+	queue, _ := frame["queue"].(string)
+	return queue
+}
+
+// 消息内容
+func (frame Frame) Body() map[string]interface{} {
+	body, _ := frame["body"].(map[string]interface{})
+	return body
+}
+
+// 是否为MQ的响应，响应中带有code
+func (frame Frame) IsResponse() bool {
+	_, found := frame["code"]
+	return found
+}
+
+// 响应代码，不是响应时返回0
+func (frame Frame) Code() int {
+	code, _ := frame["code"].(float64)
+	return int(code)
+}
+
+// 模拟的客户端，收到的数据会缓存起来，直到被Expect*取走
+type Client struct {
+	t    testing.TB
+	conn net.Conn
+
+	frames   []Frame
+	received chan bool // 收到新数据时通知等待者
+	isClosed bool
+
+	mutex *sync.Mutex
+}
+
+func newClient(t testing.TB, conn net.Conn) *Client {
+	client := &Client{
+		t:        t,
+		conn:     conn,
+		received: make(chan bool, 1),
+		mutex:    &sync.Mutex{},
+	}
+	go client.receive()
+	return client
+}
+
+// 接收数据，直到连接关闭
+func (client *Client) receive() {
+	scanner := bufio.NewScanner(client.conn)
+	scanner.Buffer(make([]byte, 0, 4096), nets.DefaultMaxFrameSize)
+	for scanner.Scan() {
+		frame := Frame{}
+		err := json.Unmarshal(scanner.Bytes(), &frame)
+		if err != nil {
+			continue
+		}
+
+		client.mutex.Lock()
+		client.frames = append(client.frames, frame)
+		client.mutex.Unlock()
+		client.notify()
+	}
+
+	client.mutex.Lock()
+	client.isClosed = true
+	client.mutex.Unlock()
+	client.notify()
+}
+
+func (client *Client) notify() {
+	select {
+	case client.received <- true:
+	default:
+	}
+}
+
+// 发送原始数据
+func (client *Client) SendFrame(frame map[string]interface{}) {
+	client.t.Helper()
+
+	data, err := json.Marshal(frame)
+	if err != nil {
+		client.t.Fatal("encode frame failed:", err)
+	}
+	_, err = client.conn.Write(append(data, '\n'))
+	if err != nil {
+		client.t.Fatal("send frame failed:", err)
+	}
+}
+
+// 发送消息，返回自动生成的消息ID
+func (client *Client) Send(queue string, body map[string]interface{}) string {
+	client.t.Helper()
+
+	id := stringutil.Rand(16)
+	client.SendFrame(map[string]interface{}{
+		"id":    id,
+		"queue": queue,
+		"body":  body,
+	})
+	return id
+}
+
+// 订阅queue，并等待MQ确认
+func (client *Client) Subscribe(queue string) {
+	client.t.Helper()
+
+	id := client.Send("$tea.subscribe.queue", map[string]interface{}{
+		"queue": queue,
+	})
+	response := client.ExpectResponse(id, DefaultTimeout)
+	if response.Code() != 200 {
+		client.t.Fatal("subscribe '"+queue+"' failed:", response["message"])
+	}
+}
+
+// 等待在timeout内收到某个queue的消息，不包括MQ的响应
+func (client *Client) ExpectMessage(queue string, timeout time.Duration) Frame {
+	client.t.Helper()
+
+	frame, found := client.wait(timeout, func(frame Frame) bool {
+		return !frame.IsResponse() && frame.Queue() == queue
+	})
+	if !found {
+		client.t.Fatal("no message on queue '"+queue+"' within", timeout)
+	}
+	return frame
+}
+
+// 确认在duration内没有收到某个queue的消息
+func (client *Client) ExpectNoMessage(queue string, duration time.Duration) {
+	client.t.Helper()
+
+	frame, found := client.wait(duration, func(frame Frame) bool {
+		return !frame.IsResponse() && frame.Queue() == queue
+	})
+	if found {
+		client.t.Fatal("unexpected message on queue '"+queue+"':", frame)
+	}
+}
+
+// 等待在timeout内收到对某个消息ID的响应
+func (client *Client) ExpectResponse(id string, timeout time.Duration) Frame {
+	client.t.Helper()
+
+	frame, found := client.wait(timeout, func(frame Frame) bool {
+		return frame.IsResponse() && frame.Id() == id
+	})
+	if !found {
+		client.t.Fatal("no response for message '"+id+"' within", timeout)
+	}
+	return frame
+}
+
+// 断开连接
+func (client *Client) Close() {
+	client.conn.Close()
+}
+
+// 取走第一个符合条件的数据，超时或连接关闭后仍没有时返回false
+func (client *Client) wait(timeout time.Duration, match func(frame Frame) bool) (Frame, bool) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		client.mutex.Lock()
+		for index, frame := range client.frames {
+			if match(frame) {
+				client.frames = append(client.frames[:index], client.frames[index+1:]...)
+				client.mutex.Unlock()
+				return frame, true
+			}
+		}
+		isClosed := client.isClosed
+		client.mutex.Unlock()
+
+		if isClosed {
+			return nil, false
+		}
+
+		select {
+		case <-client.received:
+		case <-timer.C:
+			return nil, false
+		}
+	}
+}
@@ -0,0 +1,175 @@
+// 测试工具：在同一进程中启动MQ，通过内存连接接入模拟的客户端和真实的worker，不需要监听端口和配置文件
+//
+//	harness := teatest.New(t, nil)
+//	harness.StartWorker(worker.NewWorker().Handle("HELLO", hello), nil)
+//	client := harness.NewClient()
+//	client.Send("HELLO", map[string]interface{}{ "name": "Lily" })
+//	reply := client.ExpectMessage("HELLO", time.Second)
+package teatest
+
+import (
+	"testing"
+	"github.com/iwind/TeaMQ/mq"
+	"github.com/iwind/TeaMQ/nets"
+	"github.com/iwind/TeaWorker/worker"
+	"sync"
+	"time"
+	"context"
+	"math"
+)
+
+const (
+	DefaultTimeout   = time.Second     // 等待注册、订阅等操作的默认时间
+	DefaultWorkerKey = "teatest"       // 没有设置Keys时MQ使用的Key
+	defaultMaxUserId = math.MaxInt32   // worker没有设置用户范围时的最大用户ID
+	shutdownTimeout  = 5 * time.Second // 关闭MQ的最长时间
+	pollInterval     = 5 * time.Millisecond
+)
+
+// 测试环境，测试结束时自动关闭
+type Harness struct {
+	t        testing.TB
+	mq       *mq.MQ
+	config   *mq.Config
+	listener *nets.MemoryListener
+
+	workers  []*runningWorker
+	clients  []*Client
+	isClosed bool
+
+	mutex *sync.Mutex
+}
+
+// 正在运行的worker
+type runningWorker struct {
+	worker *worker.Worker
+	done   chan error
+}
+
+// 启动MQ，config为nil时使用默认配置
+func New(t testing.TB, config *mq.Config) *Harness {
+	t.Helper()
+
+	if config == nil {
+		config = &mq.Config{}
+	}
+	if len(config.Keys) == 0 {
+		config.Keys = []string{DefaultWorkerKey}
+	}
+
+	listener := nets.NewMemoryListener()
+	mqObject := mq.NewMQWithConfig(config)
+	mqObject.SetListener(listener)
+	err := mqObject.Start()
+	if err != nil {
+		t.Fatal("start MQ failed:", err)
+	}
+
+	harness := &Harness{
+		t:        t,
+		mq:       mqObject,
+		config:   config,
+		listener: listener,
+		mutex:    &sync.Mutex{},
+	}
+	t.Cleanup(harness.Close)
+	return harness
+}
+
+// 取得MQ，以便检查内部状态
+func (harness *Harness) MQ() *mq.MQ {
+	return harness.mq
+}
+
+// 接入一个客户端
+func (harness *Harness) NewClient() *Client {
+	harness.t.Helper()
+
+	conn, err := harness.listener.Dial()
+	if err != nil {
+		harness.t.Fatal("dial MQ failed:", err)
+	}
+	client := newClient(harness.t, conn)
+
+	harness.mutex.Lock()
+	harness.clients = append(harness.clients, client)
+	harness.mutex.Unlock()
+	return client
+}
+
+// 启动worker，并等待在MQ上注册成功
+// config为nil时使用默认配置，没有设置Key和用户范围时使用MQ的第一个Key和所有用户
+func (harness *Harness) StartWorker(workerObject *worker.Worker, config *worker.Config) *worker.Worker {
+	harness.t.Helper()
+
+	if config == nil {
+		config = &worker.Config{}
+	}
+	if len(config.Key) == 0 {
+		config.Key = harness.config.Keys[0]
+	}
+	if config.User.Min <= 0 {
+		config.User.Min = 1
+	}
+	if config.User.Max <= 0 {
+		config.User.Max = defaultMaxUserId
+	}
+
+	workerObject.SetDialer(harness.listener.Dial)
+	running := &runningWorker{
+		worker: workerObject,
+		done:   make(chan error, 1),
+	}
+	go func() {
+		running.done <- workerObject.Run(config)
+	}()
+
+	harness.mutex.Lock()
+	harness.workers = append(harness.workers, running)
+	harness.mutex.Unlock()
+
+	deadline := time.Now().Add(DefaultTimeout)
+	for !workerObject.IsRegistered() {
+		select {
+		case err := <-running.done:
+			harness.t.Fatal("worker stopped before registered:", err)
+		case <-time.After(pollInterval):
+		}
+		if time.Now().After(deadline) {
+			harness.t.Fatal("worker is not registered within", DefaultTimeout)
+		}
+	}
+	return workerObject
+}
+
+// 下线所有worker，断开所有客户端，并关闭MQ
+func (harness *Harness) Close() {
+	harness.mutex.Lock()
+	if harness.isClosed {
+		harness.mutex.Unlock()
+		return
+	}
+	harness.isClosed = true
+	workers := harness.workers
+	clients := harness.clients
+	harness.mutex.Unlock()
+
+	for _, running := range workers {
+		running.worker.Drain(DefaultTimeout)
+		select {
+		case <-running.done:
+		case <-time.After(DefaultTimeout):
+			harness.t.Log("worker did not stop within", DefaultTimeout)
+		}
+	}
+	for _, client := range clients {
+		client.Close()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	err := harness.mq.Shutdown(ctx)
+	if err != nil {
+		harness.t.Log("shutdown MQ failed:", err)
+	}
+}
@@ -0,0 +1,58 @@
+package teatest
+
+import (
+	"testing"
+	"time"
+	"github.com/iwind/TeaWorker/worker"
+	"github.com/iwind/TeaWorker/message"
+)
+
+func TestHarness_Worker(t *testing.T) {
+	harness := New(t, nil)
+	harness.StartWorker(worker.NewWorker().Handle("HELLO", func(messageObject *message.Message, workerObject *worker.Worker) {
+		workerObject.Reply(messageObject, map[string]interface{}{
+			"greeting": "hello, " + messageObject.Body["name"].(string),
+		})
+	}), nil)
+
+	client := harness.NewClient()
+	id := client.Send("HELLO", map[string]interface{}{
+		"name": "Lily",
+	})
+	reply := client.ExpectMessage("HELLO", time.Second)
+	if reply.Id() != id || reply.Body()["greeting"] != "hello, Lily" {
+		t.Fatal("unexpected reply:", reply)
+	}
+}
+
+func TestHarness_Subscribe(t *testing.T) {
+	harness := New(t, nil)
+	publisher := harness.StartWorker(worker.NewWorker(), nil)
+
+	subscriber := harness.NewClient()
+	subscriber.Subscribe("news")
+	other := harness.NewClient()
+
+	news := message.NewMessage()
+	news.Queue = "news"
+	news.Set("title", "teatest")
+	err := publisher.Send(news)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if published := subscriber.ExpectMessage("news", time.Second); published.Body()["title"] != "teatest" {
+		t.Fatal("unexpected message:", published)
+	}
+	other.ExpectNoMessage("news", 100*time.Millisecond)
+}
+
+func TestClient_ExpectResponse(t *testing.T) {
+	harness := New(t, nil)
+	client := harness.NewClient()
+
+	id := client.Send("$tea.connection.ping", nil)
+	if response := client.ExpectResponse(id, time.Second); response.Code() != 200 || response["message"] != "pong" {
+		t.Fatal("unexpected response:", response)
+	}
+}
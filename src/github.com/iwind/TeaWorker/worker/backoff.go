@@ -0,0 +1,56 @@
+package worker
+
+import (
+	"time"
+	"math/rand"
+)
+
+const (
+	defaultMinReconnectInterval = 1 * time.Second
+	defaultMaxReconnectInterval = 60 * time.Second
+)
+
+// 指数退避，每次失败后等待时间加倍，并加入随机抖动，防止大量worker同时重连
+type backoff struct {
+	min      time.Duration
+	max      time.Duration
+	attempts uint
+	random   *rand.Rand
+}
+
+func newBackoff(min time.Duration, max time.Duration) *backoff {
+	if min <= 0 {
+		min = defaultMinReconnectInterval
+	}
+	if max <= 0 {
+		max = defaultMaxReconnectInterval
+	}
+	if max < min {
+		max = min
+	}
+	return &backoff{
+		min:    min,
+		max:    max,
+		random: rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// 取得下次重试前需要等待的时间，在[interval/2, interval]之间随机
+func (b *backoff) Next() time.Duration {
+	interval := b.max
+	if b.attempts < 32 {
+		interval = b.min << b.attempts
+		if interval > b.max || interval <= 0 {
+			interval = b.max
+		}
+	}
+	b.attempts ++
+
+	half := interval / 2
+	return half + time.Duration(b.random.Int63n(int64(interval-half)+1))
+}
+
+// 连接成功后重置
+func (b *backoff) Reset() {
+	b.attempts = 0
+}
@@ -0,0 +1,22 @@
+package worker
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBackoff_Next(t *testing.T) {
+	b := newBackoff(100*time.Millisecond, time.Second)
+	for i := 0; i < 10; i ++ {
+		interval := b.Next()
+		t.Log(interval)
+		if interval < 50*time.Millisecond || interval > time.Second {
+			t.Fatalf("interval %s out of range", interval)
+		}
+	}
+
+	b.Reset()
+	if interval := b.Next(); interval > 100*time.Millisecond {
+		t.Fatalf("interval should be reset, got %s", interval)
+	}
+}
@@ -0,0 +1,204 @@
+package worker
+
+import (
+	"fmt"
+	"github.com/iwind/TeaMQ/logs"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// 默认的MQ地址和端口
+const (
+	DefaultMQHost = "127.0.0.1"
+	DefaultMQPort = 7777
+)
+
+// 覆盖配置的环境变量前缀，如 TEAWORKER_KEY
+const EnvPrefix = "TEAWORKER_"
+
+// 配置错误，包含所有不合法的字段
+type ConfigError struct {
+	Fields []*FieldError
+}
+
+func (err *ConfigError) Error() string {
+	messages := []string{}
+	for _, field := range err.Fields {
+		messages = append(messages, "'"+field.Field+"' "+field.Message)
+	}
+	return "invalid config: " + strings.Join(messages, ", ")
+}
+
+func (err *ConfigError) add(field string, message string) {
+	err.Fields = append(err.Fields, &FieldError{
+		Field:   field,
+		Message: message,
+	})
+}
+
+// 没有错误时返回nil
+func (err *ConfigError) orNil() error {
+	if len(err.Fields) == 0 {
+		return nil
+	}
+	return err
+}
+
+// 默认配置，配置文件中没有的字段使用此处的值
+func DefaultConfig() *Config {
+	config := &Config{}
+	config.MQ.Host = DefaultMQHost
+	config.MQ.Port = DefaultMQPort
+	return config
+}
+
+// 从文件中读取配置，并使用环境变量覆盖，启动时会校验配置
+func LoadConfig(configFile string) (*Config, error) {
+	data, err := ioutil.ReadFile(configFile)
+	if err != nil {
+		return nil, err
+	}
+
+	config := DefaultConfig()
+	err = yaml.Unmarshal(data, config)
+	if err != nil {
+		return nil, fmt.Errorf("parse config file '%s' failed: %s", configFile, err.Error())
+	}
+
+	err = config.ApplyEnv(os.LookupEnv)
+	if err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// 使用环境变量覆盖配置，lookup通常为os.LookupEnv
+//
+// TEAWORKER_MQ_HOST, TEAWORKER_MQ_PORT, TEAWORKER_ID, TEAWORKER_NAME, TEAWORKER_KEY,
+// TEAWORKER_USER_MIN, TEAWORKER_USER_MAX, TEAWORKER_BACKUP, TEAWORKER_TAGS（逗号分隔）,
+// TEAWORKER_LOG_LEVEL, TEAWORKER_LOG_FORMAT
+func (config *Config) ApplyEnv(lookup func(key string) (string, bool)) error {
+	configErr := &ConfigError{}
+
+	lookupEnv := func(name string) (string, bool) {
+		value, found := lookup(EnvPrefix + name)
+		return strings.TrimSpace(value), found
+	}
+	setString := func(name string, target *string) {
+		if value, found := lookupEnv(name); found {
+			*target = value
+		}
+	}
+	setInt := func(name string, target *int64) {
+		value, found := lookupEnv(name)
+		if !found {
+			return
+		}
+		intValue, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			configErr.add(EnvPrefix+name, "must be an integer, got '"+value+"'")
+			return
+		}
+		*target = intValue
+	}
+
+	setString("MQ_HOST", &config.MQ.Host)
+	if value, found := lookupEnv("MQ_PORT"); found {
+		port, err := strconv.Atoi(value)
+		if err != nil {
+			configErr.add(EnvPrefix+"MQ_PORT", "must be an integer, got '"+value+"'")
+		} else {
+			config.MQ.Port = port
+		}
+	}
+	setString("ID", &config.Id)
+	setString("NAME", &config.Name)
+	setString("KEY", &config.Key)
+	setInt("USER_MIN", &config.User.Min)
+	setInt("USER_MAX", &config.User.Max)
+	if value, found := lookupEnv("BACKUP"); found {
+		backup, err := strconv.ParseBool(value)
+		if err != nil {
+			configErr.add(EnvPrefix+"BACKUP", "must be true or false, got '"+value+"'")
+		} else {
+			config.Backup = backup
+		}
+	}
+	if value, found := lookupEnv("TAGS"); found {
+		config.Tags = []string{}
+		for _, tag := range strings.Split(value, ",") {
+			tag = strings.TrimSpace(tag)
+			if len(tag) > 0 {
+				config.Tags = append(config.Tags, tag)
+			}
+		}
+	}
+	setString("LOG_LEVEL", &config.Log.Level)
+	setString("LOG_FORMAT", &config.Log.Format)
+
+	return configErr.orNil()
+}
+
+// 校验配置，返回的错误中包含所有不合法的字段
+func (config *Config) Validate() error {
+	return config.validate(true)
+}
+
+// checkAddress为false时不检查MQ地址，用于设置了Dialer的情况
+func (config *Config) validate(checkAddress bool) error {
+	configErr := &ConfigError{}
+
+	if checkAddress {
+		if len(strings.TrimSpace(config.MQ.Host)) == 0 {
+			configErr.add("mq.host", "must not be empty")
+		}
+		if config.MQ.Port <= 0 || config.MQ.Port > 65535 {
+			configErr.add("mq.port", fmt.Sprintf("must be between 1 and 65535, got %d", config.MQ.Port))
+		}
+	}
+
+	if len(strings.TrimSpace(config.Key)) == 0 {
+		configErr.add("key", "must not be empty")
+	}
+
+	if config.User.Min <= 0 {
+		configErr.add("user.min", fmt.Sprintf("must be greater than 0, got %d", config.User.Min))
+	}
+	if config.User.Max <= 0 {
+		configErr.add("user.max", fmt.Sprintf("must be greater than 0, got %d", config.User.Max))
+	}
+	if config.User.Min > 0 && config.User.Max > 0 && config.User.Min > config.User.Max {
+		configErr.add("user.min", fmt.Sprintf("must not be greater than 'user.max', got [%d, %d]", config.User.Min, config.User.Max))
+	}
+
+	for index, tag := range config.Tags {
+		if len(strings.TrimSpace(tag)) == 0 {
+			configErr.add(fmt.Sprintf("tags[%d]", index), "must not be empty")
+		}
+	}
+
+	validateNotNegative(configErr, "maxMessagesPerSecond", config.MaxMessagesPerSecond)
+	validateNotNegative(configErr, "maxFrameSize", config.MaxFrameSize)
+	validateNotNegative(configErr, "heartbeat.interval", config.Heartbeat.Interval)
+	validateNotNegative(configErr, "drain.timeout", config.Drain.Timeout)
+	validateNotNegative(configErr, "reconnect.minInterval", config.Reconnect.MinInterval)
+	validateNotNegative(configErr, "reconnect.maxInterval", config.Reconnect.MaxInterval)
+	if config.Reconnect.MinInterval > 0 && config.Reconnect.MaxInterval > 0 && config.Reconnect.MinInterval > config.Reconnect.MaxInterval {
+		configErr.add("reconnect.minInterval", fmt.Sprintf("must not be greater than 'reconnect.maxInterval', got [%d, %d]", config.Reconnect.MinInterval, config.Reconnect.MaxInterval))
+	}
+
+	if _, err := logs.New(ioutil.Discard, config.Log); err != nil {
+		configErr.add("log", err.Error())
+	}
+
+	return configErr.orNil()
+}
+
+func validateNotNegative(configErr *ConfigError, field string, value int) {
+	if value < 0 {
+		configErr.add(field, fmt.Sprintf("must not be negative, got %d", value))
+	}
+}
@@ -0,0 +1,83 @@
+package worker
+
+import (
+	"testing"
+	"strings"
+)
+
+func TestConfig_Validate(t *testing.T) {
+	config := DefaultConfig()
+	config.Key = "k1"
+	config.User.Min = 1
+	config.User.Max = 100
+	err := config.Validate()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config.MQ.Port = 0
+	config.Key = ""
+	config.User.Min = 200
+	config.Reconnect.MinInterval = 2000
+	config.Reconnect.MaxInterval = 1000
+	config.Log.Format = "xml"
+	err = config.Validate()
+	configErr, ok := err.(*ConfigError)
+	if !ok {
+		t.Fatal("should return *ConfigError:", err)
+	}
+
+	fields := []string{}
+	for _, field := range configErr.Fields {
+		fields = append(fields, field.Field)
+	}
+	expected := []string{"mq.port", "key", "user.min", "reconnect.minInterval", "log"}
+	if strings.Join(fields, ",") != strings.Join(expected, ",") {
+		t.Fatal("unexpected fields:", fields)
+	}
+
+	// 使用Dialer时不检查MQ地址
+	config = DefaultConfig()
+	config.MQ.Host = ""
+	config.Key = "k1"
+	config.User.Min = 1
+	config.User.Max = 100
+	if config.validate(false) != nil {
+		t.Fatal("address should not be checked")
+	}
+}
+
+func TestConfig_ApplyEnv(t *testing.T) {
+	env := map[string]string{
+		"TEAWORKER_MQ_HOST":  "10.0.0.1",
+		"TEAWORKER_MQ_PORT":  "8888",
+		"TEAWORKER_KEY":      "k1",
+		"TEAWORKER_USER_MIN": "1",
+		"TEAWORKER_USER_MAX": "100",
+		"TEAWORKER_BACKUP":   "true",
+		"TEAWORKER_TAGS":     "vip, beta",
+	}
+	lookup := func(key string) (string, bool) {
+		value, found := env[key]
+		return value, found
+	}
+
+	config := DefaultConfig()
+	err := config.ApplyEnv(lookup)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.MQ.Host != "10.0.0.1" || config.MQ.Port != 8888 || config.Key != "k1" || config.User.Max != 100 || !config.Backup {
+		t.Fatal("env should override config:", config)
+	}
+	if strings.Join(config.Tags, ",") != "vip,beta" {
+		t.Fatal("tags should be split by comma:", config.Tags)
+	}
+
+	env["TEAWORKER_USER_MAX"] = "1e6"
+	err = DefaultConfig().ApplyEnv(lookup)
+	configErr, ok := err.(*ConfigError)
+	if !ok || len(configErr.Fields) != 1 || configErr.Fields[0].Field != "TEAWORKER_USER_MAX" {
+		t.Fatal("invalid env values should be reported:", err)
+	}
+}
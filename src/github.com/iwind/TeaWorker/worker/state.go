@@ -0,0 +1,105 @@
+package worker
+
+import (
+	"runtime"
+	"time"
+	"io/ioutil"
+	"strings"
+	"strconv"
+	"os"
+)
+
+// 运行状态，随心跳一起上报给MQ
+type State struct {
+	CPU               float64 `json:"cpu"`               // CPU使用率 0-100
+	Memory            uint64  `json:"memory"`            // 内存占用，单位为字节
+	Goroutines        int     `json:"goroutines"`        // goroutine数量
+	Load1             float64 `json:"load1"`             // 1分钟平均负载
+	Load5             float64 `json:"load5"`             // 5分钟平均负载
+	Load15            float64 `json:"load15"`            // 15分钟平均负载
+	QueueDepth        int     `json:"queueDepth"`        // 正在处理的消息数
+	MessagesPerSecond float64 `json:"messagesPerSecond"` // 每秒处理的消息数
+}
+
+// 状态采集器，CPU使用率和每秒消息数根据两次采集之间的差值计算
+type stateCollector struct {
+	collectedAt  time.Time
+	cpuTicks     int64
+	messageCount int64
+}
+
+func (collector *stateCollector) Collect(queueDepth int, messageCount int64) *State {
+	now := time.Now()
+	state := &State{
+		Goroutines: runtime.NumGoroutine(),
+		QueueDepth: queueDepth,
+	}
+
+	memStats := &runtime.MemStats{}
+	runtime.ReadMemStats(memStats)
+	state.Memory = memStats.Sys
+
+	state.Load1, state.Load5, state.Load15 = readLoadAverage()
+
+	cpuTicks, cpuOk := readProcessCPUTicks()
+	if !collector.collectedAt.IsZero() {
+		seconds := now.Sub(collector.collectedAt).Seconds()
+		if seconds > 0 {
+			state.MessagesPerSecond = float64(messageCount-collector.messageCount) / seconds
+			if cpuOk {
+				// /proc中的时间单位为时钟周期，绝大多数Linux系统为每秒100个
+				state.CPU = float64(cpuTicks-collector.cpuTicks) / 100 / seconds * 100
+			}
+		}
+	}
+
+	collector.collectedAt = now
+	collector.cpuTicks = cpuTicks
+	collector.messageCount = messageCount
+
+	return state
+}
+
+// 从/proc/loadavg中读取平均负载
+func readLoadAverage() (load1 float64, load5 float64, load15 float64) {
+	data, err := ioutil.ReadFile("/proc/loadavg")
+	if err != nil {
+		return
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) < 3 {
+		return
+	}
+	load1, _ = strconv.ParseFloat(fields[0], 64)
+	load5, _ = strconv.ParseFloat(fields[1], 64)
+	load15, _ = strconv.ParseFloat(fields[2], 64)
+	return
+}
+
+// 从/proc/[pid]/stat中读取进程使用的CPU时间（utime + stime）
+func readProcessCPUTicks() (int64, bool) {
+	data, err := ioutil.ReadFile("/proc/" + strconv.Itoa(os.Getpid()) + "/stat")
+	if err != nil {
+		return 0, false
+	}
+
+	// 进程名可能包含空格，所以从最后一个")"之后开始解析
+	content := string(data)
+	index := strings.LastIndex(content, ")")
+	if index < 0 {
+		return 0, false
+	}
+	fields := strings.Fields(content[index+1:])
+	if len(fields) < 13 {
+		return 0, false
+	}
+	utime, err := strconv.ParseInt(fields[11], 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	stime, err := strconv.ParseInt(fields[12], 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return utime + stime, true
+}
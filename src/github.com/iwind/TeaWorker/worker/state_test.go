@@ -0,0 +1,24 @@
+package worker
+
+import (
+	"testing"
+	"time"
+)
+
+func TestStateCollector_Collect(t *testing.T) {
+	collector := &stateCollector{}
+	collector.Collect(0, 0)
+
+	time.Sleep(100 * time.Millisecond)
+	state := collector.Collect(2, 10)
+	t.Logf("%#v", state)
+	if state.QueueDepth != 2 {
+		t.Fatal("queue depth should be 2")
+	}
+	if state.Goroutines <= 0 || state.Memory == 0 {
+		t.Fatal("runtime metrics should be collected")
+	}
+	if state.MessagesPerSecond <= 0 {
+		t.Fatal("messages per second should be calculated")
+	}
+}
@@ -0,0 +1,213 @@
+package worker
+
+import (
+	"reflect"
+	"encoding/json"
+	"strings"
+	"github.com/iwind/TeaMQ/logs"
+	"github.com/iwind/TeaWorker/message"
+)
+
+const (
+	ReplyCodeSuccess        = 200
+	ReplyCodeInvalidMessage = 400
+	ReplyCodeHandlerError   = 500
+)
+
+var (
+	messageType = reflect.TypeOf(&message.Message{})
+	workerType  = reflect.TypeOf(&Worker{})
+	errorType   = reflect.TypeOf((*error)(nil)).Elem()
+)
+
+// 字段校验错误
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// 消息体校验错误
+type ValidationError struct {
+	Fields []*FieldError `json:"fields"`
+}
+
+func (err *ValidationError) Error() string {
+	messages := []string{}
+	for _, field := range err.Fields {
+		messages = append(messages, field.Field+" "+field.Message)
+	}
+	return "invalid message body: " + strings.Join(messages, ", ")
+}
+
+func (err *ValidationError) add(field string, message string) {
+	err.Fields = append(err.Fields, &FieldError{
+		Field:   field,
+		Message: message,
+	})
+}
+
+// 注册带类型的处理函数，handler的格式为：
+// func(request *RequestType, message *message.Message, worker *Worker) (ResponseType, error)
+// 消息体会按照RequestType中的json标签自动解析，带有 validate:"required" 标签的字段必须在消息体中出现，
+// 返回的ResponseType会被编码后作为回复发送给客户端
+func (worker *Worker) HandleTyped(messageType string, handler interface{}) *Worker {
+	handlerValue := reflect.ValueOf(handler)
+	requestType := checkTypedHandler(handlerValue.Type())
+
+	return worker.Handle(messageType, func(messageObject *message.Message, worker *Worker) {
+		request := reflect.New(requestType)
+		err := decodeBody(messageObject.Body, request.Interface())
+		if err != nil {
+			worker.replyTyped(messageObject, nil, err)
+			return
+		}
+
+		results := handlerValue.Call([]reflect.Value{request, reflect.ValueOf(messageObject), reflect.ValueOf(worker)})
+		var response interface{}
+		if !isNilValue(results[0]) {
+			response = results[0].Interface()
+		}
+		if !results[1].IsNil() {
+			err = results[1].Interface().(error)
+		}
+		worker.replyTyped(messageObject, response, err)
+	})
+}
+
+// 回复处理结果
+func (worker *Worker) replyTyped(messageObject *message.Message, response interface{}, err error) {
+	body := map[string]interface{}{
+		"code":    ReplyCodeSuccess,
+		"message": "ok",
+		"data":    response,
+	}
+	if err != nil {
+		if validationErr, ok := err.(*ValidationError); ok {
+			body["code"] = ReplyCodeInvalidMessage
+			body["message"] = validationErr.Error()
+			body["data"] = validationErr
+		} else {
+			body["code"] = ReplyCodeHandlerError
+			body["message"] = err.Error()
+			body["data"] = nil
+		}
+	}
+
+	if messageObject.FromConnectionId <= 0 {
+		return
+	}
+
+	// 将返回的结构体转换为map，以便和其他消息一样编码
+	data, err := json.Marshal(body)
+	if err == nil {
+		body = map[string]interface{}{}
+		err = json.Unmarshal(data, &body)
+	}
+	if err != nil {
+		logs.Error("encode reply failed", logs.KeyQueue, messageObject.Queue, logs.KeyError, err)
+		return
+	}
+
+	err = worker.Reply(messageObject, body)
+	if err != nil {
+		logs.Error("send reply failed", logs.KeyQueue, messageObject.Queue, logs.KeyError, err)
+	}
+}
+
+// 检查处理函数的格式，并返回请求的结构体类型
+func checkTypedHandler(handlerType reflect.Type) reflect.Type {
+	if handlerType.Kind() != reflect.Func ||
+		handlerType.NumIn() != 3 ||
+		handlerType.NumOut() != 2 {
+		panic("handler should be func(request *RequestType, message *message.Message, worker *Worker) (ResponseType, error)")
+	}
+
+	requestType := handlerType.In(0)
+	if requestType.Kind() != reflect.Ptr || requestType.Elem().Kind() != reflect.Struct {
+		panic("handler request should be a pointer to struct, but got " + requestType.String())
+	}
+	if handlerType.In(1) != messageType || handlerType.In(2) != workerType {
+		panic("handler should accept (*message.Message, *worker.Worker) after request")
+	}
+	if handlerType.Out(1) != errorType {
+		panic("handler should return an error as the last result")
+	}
+	return requestType.Elem()
+}
+
+// 将消息体解析到结构体中，并校验必需的字段
+func decodeBody(body map[string]interface{}, request interface{}) error {
+	validationErr := &ValidationError{}
+
+	requestValue := reflect.ValueOf(request).Elem()
+	requestType := requestValue.Type()
+	for i := 0; i < requestType.NumField(); i ++ {
+		field := requestType.Field(i)
+		if len(field.PkgPath) > 0 {
+			continue
+		}
+		name := jsonFieldName(field)
+		if name == "-" {
+			continue
+		}
+
+		value, found := body[name]
+		if !found || value == nil {
+			if hasValidateRule(field, "required") {
+				validationErr.add(name, "is required")
+			}
+			continue
+		}
+
+		// 逐个字段解析，以便报告具体哪个字段的类型不正确
+		data, err := json.Marshal(value)
+		if err != nil {
+			validationErr.add(name, err.Error())
+			continue
+		}
+		fieldValue := reflect.New(field.Type)
+		err = json.Unmarshal(data, fieldValue.Interface())
+		if err != nil {
+			if typeErr, ok := err.(*json.UnmarshalTypeError); ok {
+				validationErr.add(name, "should be "+typeErr.Type.String()+", but got "+typeErr.Value)
+			} else {
+				validationErr.add(name, err.Error())
+			}
+			continue
+		}
+		requestValue.Field(i).Set(fieldValue.Elem())
+	}
+
+	if len(validationErr.Fields) > 0 {
+		return validationErr
+	}
+	return nil
+}
+
+func jsonFieldName(field reflect.StructField) string {
+	tag := field.Tag.Get("json")
+	if len(tag) > 0 {
+		name := strings.Split(tag, ",")[0]
+		if len(name) > 0 {
+			return name
+		}
+	}
+	return field.Name
+}
+
+func hasValidateRule(field reflect.StructField, rule string) bool {
+	for _, item := range strings.Split(field.Tag.Get("validate"), ",") {
+		if strings.TrimSpace(item) == rule {
+			return true
+		}
+	}
+	return false
+}
+
+func isNilValue(value reflect.Value) bool {
+	switch value.Kind() {
+	case reflect.Ptr, reflect.Map, reflect.Slice, reflect.Interface:
+		return value.IsNil()
+	}
+	return false
+}
@@ -0,0 +1,67 @@
+package worker
+
+import (
+	"testing"
+	"github.com/iwind/TeaWorker/message"
+)
+
+type testUserRequest struct {
+	UserId int64  `json:"userId" validate:"required"`
+	Name   string `json:"name"`
+}
+
+func TestDecodeBody(t *testing.T) {
+	request := &testUserRequest{}
+	err := decodeBody(map[string]interface{}{
+		"userId": float64(123),
+		"name":   "Li Bai",
+	}, request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if request.UserId != 123 || request.Name != "Li Bai" {
+		t.Fatalf("unexpected request: %#v", request)
+	}
+}
+
+func TestDecodeBody_Validation(t *testing.T) {
+	err := decodeBody(map[string]interface{}{
+		"name": 123,
+	}, &testUserRequest{})
+	validationErr, ok := err.(*ValidationError)
+	if !ok {
+		t.Fatalf("expected validation error, got %#v", err)
+	}
+	if len(validationErr.Fields) != 2 {
+		t.Fatalf("expected 2 field errors, got %d", len(validationErr.Fields))
+	}
+	t.Log(validationErr.Error())
+}
+
+func TestWorker_HandleTyped(t *testing.T) {
+	called := false
+	worker := NewWorker()
+	worker.HandleTyped("GET_USER", func(request *testUserRequest, message *message.Message, worker *Worker) (map[string]interface{}, error) {
+		called = true
+		return map[string]interface{}{"userId": request.UserId}, nil
+	})
+
+	messageObject := message.NewMessage()
+	messageObject.Queue = "GET_USER"
+	messageObject.Set("userId", 1)
+	worker.handlers["GET_USER"](messageObject, worker)
+	if !called {
+		t.Fatal("handler should be called")
+	}
+}
+
+func TestWorker_HandleTyped_InvalidHandler(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Fatal("expected panic for invalid handler")
+		}
+	}()
+	NewWorker().HandleTyped("GET_USER", func(request testUserRequest) error {
+		return nil
+	})
+}
@@ -2,16 +2,56 @@ package worker
 
 import (
 	"github.com/iwind/TeaWorker/message"
-	"io/ioutil"
-	"log"
-	"gopkg.in/yaml.v2"
+	mqmessage "github.com/iwind/TeaMQ/message"
+	"github.com/iwind/TeaMQ/logs"
 	"github.com/iwind/TeaWorker/nets"
 	"fmt"
 	"time"
+	"sync"
+	"errors"
+	"strconv"
+	"os"
+	"os/signal"
+	"syscall"
+	"sort"
+	"net"
+)
+
+const (
+	defaultHeartbeatInterval = 5 * time.Second  // 默认心跳间隔
+	defaultDrainTimeout      = 30 * time.Second // 默认下线等待时间
+	maxOutboxMessages        = 1000             // 断开连接时最多缓存的待发送消息数
+	maxHandledMessages       = 1000             // 最多记录的已处理消息数
+	handledMessageTTL        = 10 * time.Minute // 已处理消息的记录时间，用来对MQ重发的消息去重
 )
 
 type Worker struct {
 	handlers map[string]func(message *message.Message, worker *Worker)
+
+	client       *nets.Client
+	isRegistered bool
+	mutex        *sync.Mutex
+
+	inflightMessages map[string]bool      // { MessageKey: true, ... } 正在处理的消息
+	handledMessages  map[string]time.Time // { MessageKey: HandledTime, ... } 已处理完的消息
+	outbox           [][]byte             // 断开连接时待发送的数据
+
+	handlingCount  int   // 正在处理的消息数
+	messageCount   int64 // 接收到的消息总数
+	stateCollector *stateCollector
+
+	heartbeatInterval time.Duration
+	heartbeatDone     chan bool
+
+	isDraining   bool
+	drainAcked   chan bool
+	drainTimeout time.Duration
+
+	onConnected    func(worker *Worker)
+	onDisconnected func(worker *Worker)
+	onRegistered   func(worker *Worker)
+
+	dialer func() (net.Conn, error) // 为nil时使用TCP连接
 }
 
 type Config struct {
@@ -27,11 +67,48 @@ type Config struct {
 		Min int64
 		Max int64
 	}
+	Backup bool     // 是否为备用节点
+	Tags   []string // 标签，客户端可以通过消息中的service指定只发送给带有某个标签的worker
+
+	MaxMessagesPerSecond int `yaml:"maxMessagesPerSecond"` // 每秒最多接收的消息数，为0时不限制
+	MaxFrameSize         int `yaml:"maxFrameSize"`         // 单条消息的最大字节数，需要和MQ中的设置一致，为0时使用默认值
+
+	// 心跳设置，单位为ms（毫秒）
+	Heartbeat struct {
+		Interval int `yaml:"interval"`
+	}
+
+	// 下线设置，单位为ms（毫秒）
+	Drain struct {
+		Timeout int `yaml:"timeout"` // 等待正在处理的消息完成的最长时间
+	}
+
+	// 重连设置，单位为ms（毫秒）
+	Reconnect struct {
+		MinInterval int `yaml:"minInterval"`
+		MaxInterval int `yaml:"maxInterval"`
+	}
+
+	// 日志设置
+	Log logs.Config `yaml:"log"`
+}
+
+// 注册被MQ拒绝，这种错误不会重试
+type RegisterError struct {
+	Message string
+}
+
+func (err *RegisterError) Error() string {
+	return "register failed: " + err.Message
 }
 
 func NewWorker() *Worker {
 	worker := &Worker{
-		handlers: map[string]func(message *message.Message, worker *Worker){},
+		handlers:         map[string]func(message *message.Message, worker *Worker){},
+		mutex:            &sync.Mutex{},
+		inflightMessages: map[string]bool{},
+		handledMessages:  map[string]time.Time{},
+		stateCollector:   &stateCollector{},
 	}
 
 	return worker
@@ -42,62 +119,514 @@ func (worker *Worker) Handle(messageType string, handler func(message *message.M
 	return worker
 }
 
+// 取得所有已注册处理函数的消息类型
+func (worker *Worker) Types() []string {
+	types := []string{}
+	for messageType := range worker.handlers {
+		types = append(types, messageType)
+	}
+	sort.Strings(types)
+	return types
+}
+
 func (worker *Worker) Subscribe(queue string) *Worker {
 	return worker
 }
 
-func (worker *Worker) Start() {
-	worker.StartWithConfig("conf/worker.conf")
+// 设置连接到MQ后的回调
+func (worker *Worker) OnConnected(callback func(worker *Worker)) *Worker {
+	worker.onConnected = callback
+	return worker
+}
+
+// 设置和MQ断开连接后的回调
+func (worker *Worker) OnDisconnected(callback func(worker *Worker)) *Worker {
+	worker.onDisconnected = callback
+	return worker
+}
+
+// 设置在MQ上注册成功后的回调
+func (worker *Worker) OnRegistered(callback func(worker *Worker)) *Worker {
+	worker.onRegistered = callback
+	return worker
+}
+
+func (worker *Worker) Start() error {
+	return worker.StartWithConfig("conf/worker.conf")
 }
 
-func (worker *Worker) StartWithConfig(configFile string) {
-	data, err := ioutil.ReadFile(configFile)
+// 读取配置文件并启动worker，收到SIGTERM时下线，连接断开后会自动重连，只有在配置错误、注册被拒绝或下线后才返回
+func (worker *Worker) StartWithConfig(configFile string) error {
+	config, err := LoadConfig(configFile)
 	if err != nil {
-		log.Println("Error:" + err.Error())
-		return
+		logs.Error("load config failed", "file", configFile, logs.KeyError, err)
+		return err
 	}
+	return worker.StartWith(config)
+}
 
-	config := &Config{}
-	err = yaml.Unmarshal(data, config)
+// 使用配置启动worker，收到SIGTERM时下线，命令行程序可以在读取配置后覆盖其中的选项再调用
+func (worker *Worker) StartWith(config *Config) error {
+	err := worker.applyConfig(config)
 	if err != nil {
-		log.Println("Error:" + err.Error())
-		return
+		logs.Error("failed to start", logs.KeyError, err)
+		return err
 	}
 
+	// 收到SIGTERM时下线，处理完正在处理的消息后再退出
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM)
+	defer signal.Stop(signals)
+	go func() {
+		for range signals {
+			logs.Info("receive SIGTERM, start to drain")
+			err := worker.Drain(worker.drainTimeout)
+			if err != nil {
+				logs.Error("drain failed", logs.KeyError, err)
+			}
+		}
+	}()
+
+	return worker.run(config)
+}
+
+// 使用配置启动worker，不处理信号，可以在其他程序中嵌入，通过Drain()退出
+func (worker *Worker) Run(config *Config) error {
+	err := worker.applyConfig(config)
+	if err != nil {
+		return err
+	}
+	return worker.run(config)
+}
+
+// 设置连接MQ的方法，默认使用TCP连接配置中的地址，测试时可以使用内存连接
+func (worker *Worker) SetDialer(dialer func() (net.Conn, error)) *Worker {
+	worker.dialer = dialer
+	return worker
+}
+
+// 校验配置，并应用日志、心跳和下线设置，设置了Dialer时不检查MQ地址
+func (worker *Worker) applyConfig(config *Config) error {
+	err := config.validate(worker.dialer == nil)
+	if err != nil {
+		return err
+	}
+
+	err = logs.Configure(config.Log)
+	if err != nil {
+		return err
+	}
+
+	worker.heartbeatInterval = defaultHeartbeatInterval
+	if config.Heartbeat.Interval > 0 {
+		worker.heartbeatInterval = time.Duration(config.Heartbeat.Interval) * time.Millisecond
+	}
+
+	worker.drainTimeout = defaultDrainTimeout
+	if config.Drain.Timeout > 0 {
+		worker.drainTimeout = time.Duration(config.Drain.Timeout) * time.Millisecond
+	}
+	return nil
+}
+
+// 连接MQ并接收消息，断开后重连
+func (worker *Worker) run(config *Config) error {
+	var err error
+	reconnectBackoff := newBackoff(time.Duration(config.Reconnect.MinInterval)*time.Millisecond, time.Duration(config.Reconnect.MaxInterval)*time.Millisecond)
 	for {
+		if worker.IsDraining() {
+			return nil
+		}
+
 		// 连接MQ
 		client := &nets.Client{}
-		err = client.Connect("tcp", fmt.Sprintf("%s:%d", config.MQ.Host, config.MQ.Port))
+		if worker.dialer != nil {
+			var conn net.Conn
+			conn, err = worker.dialer()
+			if err == nil {
+				client.SetConnection(conn)
+			}
+		} else {
+			err = client.Connect("tcp", fmt.Sprintf("%s:%d", config.MQ.Host, config.MQ.Port))
+		}
 		if err != nil {
-			log.Println("Error:" + err.Error())
+			logs.Error("connect to MQ failed", logs.KeyError, err)
 
-			time.Sleep(time.Second * 5)
+			time.Sleep(reconnectBackoff.Next())
 
 			continue
 		}
 
-		// 注册Work，包括用户range
-		messageObject := message.NewMessage()
-		messageObject.Queue = "$tea.worker.register"
-		messageObject.Set("id", config.Id)
-		messageObject.Set("name", config.Name)
-		messageObject.Set("description", config.Description)
-		messageObject.Set("key", config.Key)
-		messageObject.Set("user", map[string]int64{
-			"min": config.User.Min,
-			"max": config.User.Max,
-		})
-		data, err := messageObject.Encode()
+		worker.mutex.Lock()
+		worker.client = client
+		worker.mutex.Unlock()
+
+		if worker.onConnected != nil {
+			worker.onConnected(worker)
+		}
+
+		var registerErr error
+		err = worker.register(client, config)
 		if err != nil {
-			log.Println("Error:" + err.Error())
+			logs.Error("register failed", logs.KeyError, err)
+			client.Close()
+		} else {
+			// 接收数据
+			client.SetMaxFrameSize(config.MaxFrameSize)
+			err = client.Receive(func(data []byte) {
+				if worker.IsRegistered() {
+					worker.receive(data)
+					return
+				}
+
+				// 注册结果
+				response, err := mqmessage.UnmarshalResponse(data)
+				if err != nil || (len(response.Queue) > 0 && response.Queue != "$tea.worker.register") {
+					logs.Warn("unexpected data before registered", logs.KeyBody, data)
+					return
+				}
+				if !response.IsSuccess() {
+					registerErr = &RegisterError{Message: response.Message}
+					client.Close()
+					return
+				}
+
+				reconnectBackoff.Reset()
+				worker.registered()
+			})
+			if err != nil {
+				logs.Error("receive from MQ failed", logs.KeyError, err)
+				client.Close()
+			}
+		}
+
+		worker.mutex.Lock()
+		worker.client = nil
+		worker.isRegistered = false
+		if worker.heartbeatDone != nil {
+			close(worker.heartbeatDone)
+			worker.heartbeatDone = nil
+		}
+		worker.mutex.Unlock()
+
+		if worker.onDisconnected != nil {
+			worker.onDisconnected(worker)
+		}
+
+		if registerErr != nil {
+			logs.Error("register rejected", logs.KeyError, registerErr)
+			return registerErr
+		}
+
+		if worker.IsDraining() {
+			logs.Info("worker is drained")
+			return nil
+		}
+
+		time.Sleep(reconnectBackoff.Next())
+	}
+}
+
+// 判断是否已在MQ上注册成功
+func (worker *Worker) IsRegistered() bool {
+	worker.mutex.Lock()
+	defer worker.mutex.Unlock()
+	return worker.isRegistered
+}
+
+// 判断是否正在下线
+func (worker *Worker) IsDraining() bool {
+	worker.mutex.Lock()
+	defer worker.mutex.Unlock()
+	return worker.isDraining
+}
+
+// 下线：通知MQ不再转发新的消息，等待正在处理的消息完成后断开连接，之后不再重连
+func (worker *Worker) Drain(timeout time.Duration) error {
+	worker.mutex.Lock()
+	if worker.isDraining {
+		worker.mutex.Unlock()
+		return nil
+	}
+	worker.isDraining = true
+	client := worker.client
+	isRegistered := worker.isRegistered
+	drainAcked := make(chan bool)
+	if isRegistered {
+		worker.drainAcked = drainAcked
+	}
+	worker.mutex.Unlock()
+
+	if client == nil {
+		return nil
+	}
+
+	deadline := time.Now().Add(timeout)
+	if isRegistered {
+		drain := message.NewMessage()
+		drain.Queue = "$tea.worker.drain"
+		data, err := drain.Encode()
+		if err == nil {
+			_, err = client.WriteBytes(data)
+		}
+		if err != nil {
+			client.Close()
+			return err
+		}
+
+		// MQ确认后不会再转发新的消息，在此之前转发的消息都已接收
+		select {
+		case <-drainAcked:
+		case <-time.After(timeout):
+			logs.Warn("wait for drain confirmation timeout")
+		}
+	}
+
+	for {
+		worker.mutex.Lock()
+		handlingCount := worker.handlingCount
+		worker.mutex.Unlock()
+		if handlingCount == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			logs.Warn("drain timeout, some messages are still handling", "count", handlingCount)
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	client.Close()
+	return nil
+}
+
+// 发送消息到MQ，如果当前未连接，则缓存到重连之后再发送
+func (worker *Worker) Send(messageObject *message.Message) error {
+	data, err := messageObject.Encode()
+	if err != nil {
+		return err
+	}
+
+	worker.mutex.Lock()
+	defer worker.mutex.Unlock()
+
+	if worker.client != nil && worker.isRegistered {
+		_, err = worker.client.WriteBytes(data)
+		if err == nil {
+			return nil
+		}
+		logs.Error("send message failed", logs.KeyError, err)
+	}
+
+	if len(worker.outbox) >= maxOutboxMessages {
+		return errors.New("worker is not connected to MQ and the outbox is full")
+	}
+	worker.outbox = append(worker.outbox, data)
+	return nil
+}
+
+// 回复消息给发送消息的客户端
+func (worker *Worker) Reply(messageObject *message.Message, body map[string]interface{}) error {
+	reply, err := messageObject.Reply()
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		reply.Body = body
+	}
+	return worker.Send(reply)
+}
+
+// 注册Worker，包括用户range
+func (worker *Worker) register(client *nets.Client, config *Config) error {
+	messageObject := message.NewMessage()
+	messageObject.Queue = "$tea.worker.register"
+	messageObject.Set("id", config.Id)
+	messageObject.Set("name", config.Name)
+	messageObject.Set("description", config.Description)
+	messageObject.Set("key", config.Key)
+	messageObject.Set("user", map[string]int64{
+		"min": config.User.Min,
+		"max": config.User.Max,
+	})
+	messageObject.Set("backup", config.Backup)
+	messageObject.Set("tags", config.Tags)
+	messageObject.Set("maxMessagesPerSecond", config.MaxMessagesPerSecond)
+	messageObject.Set("types", worker.Types())
+	data, err := messageObject.Encode()
+	if err != nil {
+		return err
+	}
+	logs.Debug("send register request", logs.KeyWorkerId, config.Id, logs.KeyBody, data)
+	_, err = client.WriteBytes(data)
+	return err
+}
+
+// 注册成功后发送断开期间缓存的数据
+func (worker *Worker) registered() {
+	worker.mutex.Lock()
+	worker.isRegistered = true
+	outbox := worker.outbox
+	worker.outbox = nil
+	for index, data := range outbox {
+		_, err := worker.client.WriteBytes(data)
+		if err != nil {
+			logs.Error("send outbox message failed", logs.KeyError, err)
+			worker.outbox = append(worker.outbox, outbox[index:]...)
+			break
+		}
+	}
+	worker.heartbeatDone = make(chan bool)
+	go worker.sendHeartbeats(worker.heartbeatDone)
+	worker.mutex.Unlock()
+
+	if worker.onRegistered != nil {
+		worker.onRegistered(worker)
+	}
+}
+
+// 处理MQ的响应
+func (worker *Worker) receiveResponse(response *mqmessage.Response) {
+	if !response.IsSuccess() {
+		logs.Warn("MQ returns an error", "code", response.Code, logs.KeyQueue, response.Queue, logs.KeyMessageId, response.Id, logs.KeyError, response.Message)
+	}
+
+	// MQ对下线请求的确认
+	if response.Queue == "$tea.worker.drain" {
+		worker.mutex.Lock()
+		if worker.drainAcked != nil {
+			close(worker.drainAcked)
+			worker.drainAcked = nil
+		}
+		worker.mutex.Unlock()
+	}
+}
+
+// 处理从MQ接收到的数据
+func (worker *Worker) receive(data []byte) {
+	// MQ的响应
+	if response, err := mqmessage.UnmarshalResponse(data); err == nil {
+		worker.receiveResponse(response)
+		return
+	}
+
+	messageObject, err := message.Unmarshal(data)
+	if err != nil {
+		logs.Error("decode message failed", logs.KeyError, err)
+		return
+	}
+
+	// MQ正在关闭，连接断开后会自动重连
+	if messageObject.Queue == "$tea.mq.shutdown" {
+		logs.Info("MQ is shutting down")
+		return
+	}
+
+	handler, found := worker.handlers[messageObject.Queue]
+	if !found {
+		logs.Warn("there is no handler for message", logs.KeyQueue, messageObject.Queue)
+		return
+	}
+
+	// MQ在worker重连后会重发未确认的消息，这里根据消息ID去重
+	key := ""
+	worker.mutex.Lock()
+	if len(messageObject.Id) > 0 {
+		key = strconv.Itoa(messageObject.FromConnectionId) + ":" + messageObject.Id
+
+		if worker.inflightMessages[key] {
+			worker.mutex.Unlock()
+			return
+		}
+		if _, found := worker.handledMessages[key]; found {
+			worker.mutex.Unlock()
+			worker.ack(messageObject)
 			return
 		}
-		log.Println("prepare to send data:" + string(data))
-		client.WriteBytes(data)
+		worker.inflightMessages[key] = true
+	}
+	worker.handlingCount ++
+	worker.messageCount ++
+	worker.mutex.Unlock()
 
-		// 接收数据
-		client.Receive(func(data []byte) {
-			log.Println(string(data))
-		})
+	go func() {
+		handler(messageObject, worker)
+		worker.finish(key, messageObject)
+	}()
+}
+
+// 消息处理完成
+func (worker *Worker) finish(key string, messageObject *message.Message) {
+	// 在确认之后再减少计数，保证下线时所有确认都已发送
+	defer func() {
+		worker.mutex.Lock()
+		worker.handlingCount --
+		worker.mutex.Unlock()
+	}()
+
+	if len(key) == 0 {
+		return
+	}
+
+	worker.mutex.Lock()
+	delete(worker.inflightMessages, key)
+
+	now := time.Now()
+	if len(worker.handledMessages) >= maxHandledMessages {
+		for handledKey, handledAt := range worker.handledMessages {
+			if now.Sub(handledAt) > handledMessageTTL {
+				delete(worker.handledMessages, handledKey)
+			}
+		}
+		for handledKey := range worker.handledMessages {
+			if len(worker.handledMessages) < maxHandledMessages {
+				break
+			}
+			delete(worker.handledMessages, handledKey)
+		}
+	}
+	worker.handledMessages[key] = now
+	worker.mutex.Unlock()
+
+	worker.ack(messageObject)
+}
+
+// 通知MQ消息已处理完
+func (worker *Worker) ack(messageObject *message.Message) {
+	ack := message.NewMessage()
+	ack.Queue = "$tea.worker.ack"
+	ack.Set("id", messageObject.Id)
+	ack.Set("fromConnectionId", messageObject.FromConnectionId)
+	err := worker.Send(ack)
+	if err != nil {
+		logs.Error("send ack failed", logs.KeyMessageId, messageObject.Id, logs.KeyError, err)
+	}
+}
+
+// 定时发送心跳，直到连接断开
+func (worker *Worker) sendHeartbeats(done chan bool) {
+	ticker := time.NewTicker(worker.heartbeatInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			worker.mutex.Lock()
+			heartbeat := message.NewMessage()
+			heartbeat.Queue = "$tea.worker.heartbeat"
+			heartbeat.Set("sentAt", float64(time.Now().UnixNano())/1000000000)
+			heartbeat.Set("state", worker.stateCollector.Collect(worker.handlingCount, worker.messageCount))
+			data, err := heartbeat.Encode()
+			if err == nil && worker.client != nil {
+				_, err = worker.client.WriteBytes(data)
+			}
+			worker.mutex.Unlock()
+
+			if err != nil {
+				logs.Error("send heartbeat failed", logs.KeyError, err)
+			}
+		}
 	}
 }
@@ -1,7 +1,90 @@
 package main
 
-import "github.com/iwind/TeaMQ/mq"
+import (
+	"github.com/iwind/TeaMQ/mq"
+	"github.com/iwind/TeaMQ/logs"
+	"os"
+	"os/signal"
+	"syscall"
+	"context"
+	"time"
+	"flag"
+	"fmt"
+)
+
+const (
+	defaultConfigFile = "conf/mq.conf"
+	shutdownTimeout   = 30 * time.Second // 收到退出信号后等待关闭的最长时间
+)
 
 func main() {
-	mq.NewMQ().Start()
-}
\ No newline at end of file
+	// 命令行参数优先于环境变量和配置文件
+	configFile := flag.String("config", defaultConfigFile, "config file")
+	bind := flag.String("bind", "", "address to listen on, overrides 'bind' in config file")
+	port := flag.Int("port", 0, "port to listen on, overrides 'port' in config file")
+	hashKey := flag.String("hash-key", "", "print the salted hash of a worker key for 'keys' or 'workerKeys' in config file, then exit")
+	flag.Parse()
+
+	if len(*hashKey) > 0 {
+		hash, err := mq.HashKey(*hashKey)
+		if err != nil {
+			logs.Error("hash key failed", logs.KeyError, err)
+			os.Exit(1)
+		}
+		fmt.Println(hash)
+		return
+	}
+
+	config, err := mq.LoadConfig(*configFile)
+	if err != nil {
+		logs.Error("load config failed", logs.KeyError, err)
+		os.Exit(1)
+	}
+	applyFlags := func(config *mq.Config) {
+		flag.Visit(func(f *flag.Flag) {
+			switch f.Name {
+			case "bind":
+				config.Bind = *bind
+			case "port":
+				config.Port = *port
+			}
+		})
+	}
+	applyFlags(config)
+	err = mq.ValidatePort(config.Port)
+	if err != nil {
+		logs.Error("invalid port", logs.KeyError, err)
+		os.Exit(1)
+	}
+
+	mqObject := mq.NewMQWithConfig(config)
+	err = mqObject.Start()
+	if err != nil {
+		logs.Error("failed to start", logs.KeyError, err)
+		os.Exit(1)
+	}
+
+	// 配置文件修改或收到SIGHUP时重新加载，重新加载时仍然使用命令行参数
+	mqObject.OnLoadConfig(applyFlags)
+	mqObject.WatchConfigFile(*configFile, 0)
+
+	// 收到SIGINT或SIGTERM时关闭MQ，通知所有连接并保存定时消息
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		logs.Info("receive signal, start to shutdown", "signal", sig.String())
+
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		err := mqObject.Shutdown(ctx)
+		if err != nil {
+			logs.Error("shutdown failed", logs.KeyError, err)
+		}
+	}()
+
+	err = mqObject.Wait()
+	if err != nil {
+		os.Exit(1)
+	}
+}
@@ -2,8 +2,43 @@ package main
 
 import (
 	"github.com/iwind/TeaDemo"
+	"github.com/iwind/TeaWorker/worker"
+	"github.com/iwind/TeaMQ/logs"
+	"flag"
+	"os"
 )
 
+const defaultConfigFile = "conf/worker.conf"
+
 func main() {
-	TeaDemo.Start()
+	// 命令行参数优先于环境变量和配置文件
+	configFile := flag.String("config", defaultConfigFile, "config file")
+	mqHost := flag.String("mq-host", "", "MQ host, overrides 'mq.host' in config file")
+	mqPort := flag.Int("mq-port", 0, "MQ port, overrides 'mq.port' in config file")
+	key := flag.String("key", "", "key to register with, overrides 'key' in config file")
+	id := flag.String("id", "", "worker id, overrides 'id' in config file")
+	flag.Parse()
+
+	config, err := worker.LoadConfig(*configFile)
+	if err != nil {
+		logs.Error("load config failed", "file", *configFile, logs.KeyError, err)
+		os.Exit(1)
+	}
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "mq-host":
+			config.MQ.Host = *mqHost
+		case "mq-port":
+			config.MQ.Port = *mqPort
+		case "key":
+			config.Key = *key
+		case "id":
+			config.Id = *id
+		}
+	})
+
+	err = TeaDemo.NewWorker().StartWith(config)
+	if err != nil {
+		os.Exit(1)
+	}
 }